@@ -0,0 +1,72 @@
+package api
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"errors"
+	"sync"
+)
+
+// flight is a call in progress, or just completed.
+type flight struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// coalescer makes sure that only one call with a given key runs at any time:
+// callers arriving while it's in progress wait for it, and share its result.
+// The zero value is ready to use.
+type coalescer struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+	// onWait, if set, is called when a caller starts waiting for a call in progress.
+	onWait func(key string)
+}
+
+// errAborted is the result of calls that panicked.
+var errAborted = errors.New("the call was aborted")
+
+// Do runs fn, unless a call with the same key is already in progress, in which
+// case it waits for that call to end. It returns the data and the error of the
+// call, and true if it was shared with another caller.
+func (c *coalescer) Do(key string, fn func() ([]byte, error)) ([]byte, bool, error) {
+	c.mu.Lock()
+	if c.flights == nil {
+		c.flights = make(map[string]*flight)
+	}
+	if f, ok := c.flights[key]; ok {
+		c.mu.Unlock()
+		if c.onWait != nil {
+			c.onWait(key)
+		}
+		<-f.done
+		return f.data, true, f.err
+	}
+	f := &flight{done: make(chan struct{}), err: errAborted}
+	c.flights[key] = f
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.flights, key)
+		c.mu.Unlock()
+		close(f.done)
+	}()
+	f.data, f.err = fn()
+	return f.data, false, f.err
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type CoalescerTestSuite struct {
+	suite.Suite
+	Sut *coalescer
+}
+
+func (s *CoalescerTestSuite) SetupTest() {
+	s.Sut = &coalescer{}
+}
+
+func (s *CoalescerTestSuite) TestShared() {
+	var calls int32
+	release := make(chan struct{})
+	fail := errors.New("failed")
+	var wg sync.WaitGroup
+	results := make([]bool, 5)
+	waiting := make(chan struct{}, len(results))
+	s.Sut.onWait = func(string) { waiting <- struct{}{} }
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data, shared, err := s.Sut.Do("key", func() ([]byte, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return []byte("data"), fail
+			})
+			s.Equal(fail, err, "all callers get the error of the call")
+			s.Equal([]byte("data"), data, "all callers get the data of the call")
+			results[i] = shared
+		}(i)
+	}
+	// Wait for all callers but the first one to queue up.
+	for i := 1; i < len(results); i++ {
+		<-waiting
+	}
+	close(release)
+	wg.Wait()
+
+	s.Equal(int32(1), calls)
+	var shared int
+	for _, r := range results {
+		if r {
+			shared++
+		}
+	}
+	s.Equal(len(results)-1, shared)
+}
+
+func (s *CoalescerTestSuite) TestSequential() {
+	var calls int
+	for i := 0; i < 3; i++ {
+		_, shared, err := s.Sut.Do("key", func() ([]byte, error) {
+			calls++
+			return nil, nil
+		})
+		s.Nil(err)
+		s.False(shared)
+	}
+	// Completed calls are not cached.
+	s.Equal(3, calls)
+}
+
+func (s *CoalescerTestSuite) TestDifferentKeys() {
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.Sut.Do("a", func() ([]byte, error) {
+			<-release
+			return nil, nil
+		})
+		close(done)
+	}()
+	// A call with another key doesn't wait for the first one.
+	_, shared, err := s.Sut.Do("b", func() ([]byte, error) { return nil, nil })
+	s.Nil(err)
+	s.False(shared)
+	close(release)
+	<-done
+}
+
+func (s *CoalescerTestSuite) TestPanic() {
+	s.Panics(func() {
+		s.Sut.Do("key", func() ([]byte, error) { panic("boom") })
+	})
+	// The key is released, and the next call runs.
+	_, shared, err := s.Sut.Do("key", func() ([]byte, error) { return nil, nil })
+	s.Nil(err)
+	s.False(shared)
+}
+
+func TestCoalescerTestSuite(t *testing.T) {
+	suite.Run(t, new(CoalescerTestSuite))
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/lavagetto/memeoid/storage"
 )
 
 var httpVerbs = []string{"CONNECT", "DELETE", "GET", "HEAD", "OPTIONS", "PATCH", "POST", "PUT", "TRACE"}
@@ -38,7 +39,13 @@ func (r *Controller) Load(tplPath string) {
 	// Form
 	r.routeFor("/generate", r.Handler.Form, true, "GET", "HEAD")
 	// I "heart" the action api
+	r.Router.Path("/w/api.php").Methods("GET").Queries("template", "{template}").HandlerFunc(r.Handler.MemeFromTemplate)
 	r.routeFor("/w/api.php", r.Handler.MemeFromRequest, true, "GET")
+	// Templates
+	r.Router.Path("/templates").Methods("GET", "HEAD").HandlerFunc(r.Handler.ListTemplates)
+	r.Router.Path("/templates").Methods("POST").HandlerFunc(r.Handler.UploadTemplate)
+	r.Router.Path("/templates/{template}").Methods("GET", "HEAD").HandlerFunc(r.Handler.ShowTemplate)
+	r.Router.Path("/templates/{template}/image").Methods("GET", "HEAD").HandlerFunc(r.Handler.TemplateImage)
 	// Thumbnails
 	r.Router.Path("/thumb/{width:[0-9]+}x{height:[0-9]+}/{from}").Methods("GET", "HEAD").HandlerFunc(r.Handler.Preview)
 }
@@ -48,3 +55,20 @@ func (r *Controller) StaticRoute(uriPrefix string, docRoot string) {
 	dir := http.FileServer(http.Dir(docRoot))
 	r.Router.PathPrefix(uriPrefix).Handler(http.StripPrefix(uriPrefix, dir))
 }
+
+// MemeRoute serves the generated memes, which are found at uriPrefix in the meme storage.
+func (r *Controller) MemeRoute(uriPrefix string) {
+	r.Router.Path(uriPrefix+"{name}").Methods("GET", "HEAD").HandlerFunc(r.Handler.ServeMemeFile)
+}
+
+// StorageRoute serves the files in a storage: local directories are served
+// directly, other storages redirect to the url of the file.
+func (r *Controller) StorageRoute(uriPrefix string, s storage.Storage) {
+	if local, ok := s.(*storage.Local); ok {
+		r.StaticRoute(uriPrefix, local.Dir)
+		return
+	}
+	r.Router.PathPrefix(uriPrefix).Handler(http.StripPrefix(uriPrefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, s.URL(r.URL.Path), http.StatusFound)
+	})))
+}
@@ -17,36 +17,68 @@ limitations under the License.
 */
 
 import (
-	"crypto/sha1"
-	"encoding/json"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"html/template"
-	"image/gif"
-	"image/jpeg"
 	"io/ioutil"
+	"math"
 	"net/http"
-	"os"
-	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/lavagetto/memeoid/img"
+	"github.com/lavagetto/memeoid/lru"
+	"github.com/lavagetto/memeoid/storage"
 )
 
 // MemeHandler is the base structure that
 // handles most web operations
 type MemeHandler struct {
-	// ImgPath is the filesystem path where all images are located
-	ImgPath string
-	// OutputPath is the path on the filesystem where all memes will be saved
-	OutputPath string
+	// Images is where all the images memes can be made from are stored
+	Images storage.Storage
+	// Memes is where all memes will be saved, and served from
+	Memes storage.Storage
+	// Thumbs is where thumbnails are cached. Defaults to Memes.
+	Thumbs storage.Storage
 	// FontName is the font to use
 	FontName string
-	// MemeURL is the url at which the file will be served
-	MemeURL   string
-	templates *template.Template
+	// Registry holds the meme templates
+	Registry *img.Registry
+	// Workers is the number of frames of a meme rendered in parallel.
+	// Defaults to GOMAXPROCS if not positive.
+	Workers int
+	// RenderMode is how the text is added to the frames; see img.RenderMode.
+	RenderMode img.RenderMode
+	// Dither enables dithering when converting frames back to their palette.
+	Dither bool
+	// Optimize shrinks the gifs before saving them; see img.Meme.Optimize.
+	Optimize bool
+	// OnOptimize, if set, is called with the report of every optimized gif.
+	OnOptimize func(img.OptimizeReport)
+	// Limits are the largest memes we generate. Larger ones are scaled down,
+	// or refused if that's not enough.
+	Limits img.Limits
+	// UploadToken is the bearer token needed to upload templates.
+	// If empty, uploads are disabled.
+	UploadToken string
+	// Direct sends memes in the response, instead of redirecting to them.
+	// The 'direct' parameter overrides it.
+	Direct bool
+	// Sources, if set, keeps the most recently used images in memory, decoded.
+	Sources *lru.Cache
+	// Rendered, if set, keeps the most recently generated memes in memory.
+	Rendered *lru.Cache
+	// inflight coalesces the generation of identical memes.
+	inflight coalescer
+	// identities caches the format, hash and frame count of the images; see identify.
+	identities sync.Map
+	templates  *template.Template
 }
 
 // LoadTemplates pre-parses the templates.
@@ -56,20 +88,22 @@ func (h *MemeHandler) LoadTemplates(basepath string) {
 		h.templates = template.Must(template.ParseFiles(
 			basepath+"/banner.html.gotmpl",
 			basepath+"/generate.html.gotmpl",
+			basepath+"/templates.html.gotmpl",
+			basepath+"/template.html.gotmpl",
 		))
 	}
 }
 
-// allGifs returns a list of all gifs
+// allGifs returns a list of all the images memes can be made from
 func (h *MemeHandler) allGifs() (*[]string, error) {
 	var gifs []string
-	files, err := ioutil.ReadDir(h.ImgPath)
+	files, err := h.Images.List("")
 	if err != nil {
 		return nil, err
 	}
 	for _, file := range files {
-		name := file.Name()
-		if filepath.Ext(name) == ".gif" {
+		name := file.Name
+		if f, ok := img.FormatFromExtension(name); ok && f.Readable() {
 			gifs = append(gifs, name)
 		}
 	}
@@ -77,13 +111,7 @@ func (h *MemeHandler) allGifs() (*[]string, error) {
 }
 
 func (h *MemeHandler) jsonBanner(gifs *[]string, w http.ResponseWriter) {
-	w.Header().Set("Content-Type", "application/json")
-	js, err := json.Marshal(gifs)
-	if err != nil {
-		http.Error(w, `{"error": "bad json encoding"}`, http.StatusInternalServerError)
-		return
-	}
-	w.Write(js)
+	h.writeJSON(w, gifs)
 }
 
 func (h *MemeHandler) htmlBanner(gifs *[]string, w http.ResponseWriter) {
@@ -95,23 +123,25 @@ func (h *MemeHandler) htmlBanner(gifs *[]string, w http.ResponseWriter) {
 }
 
 func (h *MemeHandler) getImageFromRequest(w http.ResponseWriter, r *http.Request) string {
-	// vars := mux.Vars(r)
-	// imageName, ok := vars["from"]
-	// if !ok {
-	// 	http.Error(w, "missing 'from' parameter", http.StatusBadRequest)
-	// 	return ""
-	// }
-	imageName := r.FormValue("from")
+	// The image is in the path for thumbnails, and in the query string everywhere else.
+	imageName := mux.Vars(r)["from"]
+	if imageName == "" {
+		imageName = r.FormValue("from")
+	}
 	if imageName == "" {
 		http.Error(w, "missing 'from' parameter", http.StatusBadRequest)
 		return ""
 	}
 	// Check that the gif actually exists
-	imgFullPath := path.Join(h.ImgPath, imageName)
-	if _, err := os.Stat(imgFullPath); os.IsNotExist(err) {
+	ok, err := h.Images.Exists(imageName)
+	if errors.Is(err, storage.ErrInvalidName) || (err == nil && !ok) {
 		http.Error(w, "image not found", http.StatusNotFound)
 		return ""
 	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return ""
+	}
 	return imageName
 }
 
@@ -128,7 +158,7 @@ func (h *MemeHandler) Form(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// ListGifs lists the available GIFs
+// ListGifs lists the available images
 func (h *MemeHandler) ListGifs(w http.ResponseWriter, r *http.Request) {
 	gifs, err := h.allGifs()
 	if err != nil {
@@ -136,39 +166,239 @@ func (h *MemeHandler) ListGifs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// If the request is for json data, return it
-	if acceptHeaders, ok := r.Header["Accept"]; ok {
-		for _, hdr := range acceptHeaders {
-			if strings.Contains(hdr, "/json") {
-				h.jsonBanner(gifs, w)
-				return
-			}
-		}
+	if wantsJSON(r) {
+		h.jsonBanner(gifs, w)
+		return
 	}
 	h.htmlBanner(gifs, w)
 }
 
-// UID returns the unique ID of the requested gif. This is determined
-// by a combination of the image name and the text (top and bottom)
+// UID returns the unique ID of the meme requested to MemeFromRequest. It only
+// depends on how the meme looks, see img.RenderSpec, so unrelated parameters
+// in the query string don't change it.
 func (h *MemeHandler) UID(r *http.Request) (string, error) {
-	// Get a sorted version of the request parameters
-	uid := []byte(r.URL.Query().Encode())
-	// No need to use anything fancier than sha1
-	hasher := sha1.New()
-	_, err := hasher.Write(uid)
+	imageName := mux.Vars(r)["from"]
+	if imageName == "" {
+		imageName = r.FormValue("from")
+	}
+	info, err := h.identify(imageName)
+	if err != nil {
+		return "", err
+	}
+	text, err := memeTextFromRequest(r)
+	if err != nil {
+		return "", err
+	}
+	style, err := styleFromRequest(r)
+	if err != nil {
+		return "", err
+	}
+	transform, err := transformFromRequest(r)
+	if err != nil {
+		return "", err
+	}
+	format, err := formatFromRequest(r, info.Format)
 	if err != nil {
 		return "", err
 	}
-	bs := hasher.Sum(nil)
-	return fmt.Sprintf("%x", bs), nil
+	spec := h.renderSpec(img.RenderSpec{Source: info.Hash, Frames: info.Frames, Text: text, Style: style, Transform: transform})
+	spec.Format = format
+	return spec.ID()
+}
+
+// renderSpec adds the options of the renderer to spec.
+func (h *MemeHandler) renderSpec(spec img.RenderSpec) img.RenderSpec {
+	spec.Font = h.FontName
+	spec.Mode = h.RenderMode
+	spec.Dither = h.Dither
+	spec.Optimize = h.Optimize
+	spec.Limits = h.Limits
+	return spec
+}
+
+// acceptedFormats are the output formats that can be requested via the Accept header.
+var acceptedFormats = map[string]img.Format{
+	"image/gif":  img.FormatGIF,
+	"image/apng": img.FormatAPNG,
+	"image/webp": img.FormatWebP,
+	"image/png":  img.FormatPNG,
+	"image/jpeg": img.FormatJPEG,
+}
+
+// formatFromRequest returns the format the meme should be saved in: the one
+// in the 'format' parameter if present, else the one the client prefers
+// according to its Accept header, else the format of the original image.
+func formatFromRequest(r *http.Request, native img.Format) (img.Format, error) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		return img.ParseFormat(name)
+	}
+	best, bestQ := native, 0.0
+	for _, hdr := range r.Header["Accept"] {
+		for _, item := range strings.Split(hdr, ",") {
+			parts := strings.Split(item, ";")
+			f, ok := acceptedFormats[strings.ToLower(strings.TrimSpace(parts[0]))]
+			if !ok {
+				// Wildcards don't tell us anything about what the client prefers.
+				continue
+			}
+			q := 1.0
+			for _, param := range parts[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+						q = v
+					}
+				}
+			}
+			// On a tie, don't convert the image.
+			if q > bestQ || (q == bestQ && f == native) {
+				best, bestQ = f, q
+			}
+		}
+	}
+	return best, nil
+}
+
+// render generates the meme returned by getMeme and encodes it in the given format,
+// shrinking it if needed to fit the limits.
+func (h *MemeHandler) render(ctx context.Context, format img.Format, getMeme func() (*img.Meme, error)) ([]byte, error) {
+	return img.EncodeWithin(h.Limits, format, func(l img.Limits) (*img.Meme, error) {
+		meme, err := getMeme()
+		if err != nil {
+			return nil, err
+		}
+		meme.Workers = h.Workers
+		meme.Mode = h.RenderMode
+		meme.Dither = h.Dither
+		if err := meme.Constrain(l); err != nil {
+			return nil, err
+		}
+		if err := meme.GenerateContext(ctx); err != nil {
+			return nil, err
+		}
+		if h.Optimize && format == img.FormatGIF {
+			report, err := meme.Optimize()
+			if err != nil {
+				return nil, err
+			}
+			if h.OnOptimize != nil {
+				h.OnOptimize(report)
+			}
+		}
+		return meme, nil
+	})
 }
 
-func (h *MemeHandler) saveImage(g *gif.GIF, path string) error {
-	out, err := os.Create(path)
+// textFromRequest returns the text pieces in the request, either as
+// repeated 'text' parameters or as numbered ones (text0, text1, ...).
+func textFromRequest(r *http.Request) ([]string, error) {
+	qs := r.URL.Query()
+	text := qs["text"]
+	numbered := make(map[int]string)
+	for key, values := range qs {
+		if !strings.HasPrefix(key, "text") || key == "text" {
+			continue
+		}
+		i, err := strconv.Atoi(key[len("text"):])
+		if err != nil || i < 0 {
+			continue
+		}
+		numbered[i] = values[0]
+	}
+	if len(numbered) == 0 {
+		return text, nil
+	}
+	if len(text) > 0 {
+		return nil, fmt.Errorf("use either 'text' or numbered 'textN' parameters, not both")
+	}
+	for i := 0; i < len(numbered); i++ {
+		t, ok := numbered[i]
+		if !ok {
+			return nil, fmt.Errorf("missing parameter 'text%d'", i)
+		}
+		text = append(text, t)
+	}
+	return text, nil
+}
+
+// styleFromRequest returns the text style set in the request parameters.
+func styleFromRequest(r *http.Request) (img.TextStyle, error) {
+	qs := r.URL.Query()
+	style := img.TextStyle{
+		Fill:   qs.Get("fill"),
+		Stroke: qs.Get("stroke"),
+		Align:  img.Alignment(qs.Get("align")),
+		VAlign: img.Anchor(qs.Get("valign")),
+	}
+	if sw := qs.Get("stroke_width"); sw != "" {
+		width, err := strconv.ParseFloat(sw, 64)
+		if err != nil {
+			return style, fmt.Errorf("invalid stroke width '%s'", sw)
+		}
+		style.StrokeWidth = &width
+	}
+	return style, style.Validate()
+}
+
+// transformFromRequest returns the changes to the image requested with the
+// width, crop, speed, reverse, boomerang and trim parameters.
+func transformFromRequest(r *http.Request) (img.Transform, error) {
+	qs := r.URL.Query()
+	var t img.Transform
+	var err error
+	if v := qs.Get("width"); v != "" {
+		if t.Width, err = strconv.Atoi(v); err != nil || t.Width <= 0 {
+			return t, fmt.Errorf("invalid width '%s'", v)
+		}
+	}
+	if v := qs.Get("crop"); v != "" {
+		if t.Crop, err = img.ParseRect(v); err != nil {
+			return t, err
+		}
+	}
+	if v := qs.Get("speed"); v != "" {
+		if t.Speed, err = strconv.ParseFloat(v, 64); err != nil || !(t.Speed > 0) || math.IsInf(t.Speed, 0) {
+			return t, fmt.Errorf("invalid speed '%s'", v)
+		}
+	}
+	for name, dst := range map[string]*bool{"reverse": &t.Reverse, "boomerang": &t.Boomerang} {
+		if v := qs.Get(name); v != "" {
+			if *dst, err = strconv.ParseBool(v); err != nil {
+				return t, fmt.Errorf("invalid value '%s' for '%s'", v, name)
+			}
+		}
+	}
+	if v := qs.Get("trim"); v != "" {
+		if t.Trim, err = img.ParseFrameRange(v); err != nil {
+			return t, err
+		}
+	}
+	return t, nil
+}
+
+// memeTextFromRequest returns the text of a simple meme: either the
+// 'text' parameters, or the 'top' and 'bottom' ones.
+func memeTextFromRequest(r *http.Request) ([]string, error) {
+	qs := r.URL.Query()
+	top := qs.Get("top")
+	bottom := qs.Get("bottom")
+	text, err := textFromRequest(r)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if len(text) == 0 {
+		if top == "" && bottom == "" {
+			return nil, errors.New("neither 'top' nor 'bottom' provided")
+		}
+		return []string{top, bottom}, nil
+	}
+	if top != "" || bottom != "" {
+		return nil, errors.New("use either 'top' and 'bottom' or 'text' parameters, not both")
 	}
-	defer out.Close()
-	return gif.EncodeAll(out, g)
+	if strings.Join(text, "") == "" {
+		return nil, errors.New("all 'text' parameters are empty")
+	}
+	return text, nil
 }
 
 // MemeFromRequest generates a meme image from a request, and saves it to disk. Then sends a
@@ -178,85 +408,319 @@ func (h *MemeHandler) MemeFromRequest(w http.ResponseWriter, r *http.Request) {
 	if imageName == "" {
 		return
 	}
-	imgFullPath := path.Join(h.ImgPath, imageName)
-	qs := r.URL.Query()
-	top := qs.Get("top")
-	bottom := qs.Get("bottom")
-	if top == "" && bottom == "" {
-		http.Error(w, "neither 'top' nor 'bottom' provided", http.StatusBadRequest)
+	text, err := memeTextFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	style, err := styleFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	transform, err := transformFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	uid, err := h.UID(r)
+	info, err := h.identify(imageName)
 	if err != nil {
-		http.Error(w, "internal error", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	// Now check if the file at $outputpath/$uid.gif exists. If it does,
-	// just redirect. Else generate the file and redirect
-	fullPath := path.Join(h.OutputPath, fmt.Sprintf("%s.gif", uid))
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-		meme, err := img.MemeFromFile(
-			imgFullPath,
-			top,
-			bottom,
-			h.FontName,
-		)
+	spec := img.RenderSpec{Source: info.Hash, Frames: info.Frames, Text: text, Style: style, Transform: transform}
+	h.serveMeme(w, r, info.Format, spec, func() (*img.Meme, error) {
+		// Decoding the image and fitting the text is only worth it if the meme doesn't exist yet.
+		src, err := h.source(imageName)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil, err
 		}
-		err = meme.Generate()
+		tpl, err := img.SimpleTemplateFor(src, h.FontName, 52.0, 8.0)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil, err
 		}
-		err = h.saveImage(meme.Gif, fullPath)
+		meme, err := tpl.WithStyle(style).GetMeme(text...)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil, err
 		}
+		return meme, meme.Transform(transform)
+	})
+}
+
+// serveMeme generates the meme returned by getMeme, unless it was already generated,
+// then redirects the user to it or sends it directly. The meme is saved in the format
+// requested by the client, or in the native format of its image. Memes are identified
+// by their spec, which is completed with the format and the options of the renderer.
+func (h *MemeHandler) serveMeme(w http.ResponseWriter, r *http.Request, native img.Format, spec img.RenderSpec, getMeme func() (*img.Meme, error)) {
+	format, err := formatFromRequest(r, native)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	direct, err := h.directFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	spec = h.renderSpec(spec)
+	spec.Format = format
+	uid, err := spec.ID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	redirURL := fmt.Sprintf("/%s/%s.gif", h.MemeURL, uid)
-	http.Redirect(w, r, redirURL, http.StatusPermanentRedirect)
+	h.serveCached(w, r, uid+format.Extension(), direct, func() ([]byte, error) {
+		return h.render(r.Context(), format, getMeme)
+	})
 }
 
-func (h *MemeHandler) memeExists(uid string) bool {
-	fullPath := path.Join(h.OutputPath, fmt.Sprintf("%s.gif", uid))
-	_, err := os.Stat(fullPath)
-	return !os.IsNotExist(err)
+// directFromRequest returns true if the meme should be sent in the response instead
+// of redirecting the client to it. The 'direct' parameter overrides the server default.
+func (h *MemeHandler) directFromRequest(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("direct")
+	if v == "" {
+		return h.Direct, nil
+	}
+	direct, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid value '%s' for 'direct'", v)
+	}
+	return direct, nil
 }
 
-// Preview returns a thumbnail, in jpeg format
-func (h *MemeHandler) Preview(w http.ResponseWriter, r *http.Request) {
-	fmt.Printf("In preview!")
-	vars := mux.Vars(r)
-	imageName := h.getImageFromRequest(w, r)
-	if imageName == "" {
-		http.Error(w, "Image not found", http.StatusNotFound)
-		return
+// imageVersion identifies a version of an image: images replaced with new
+// versions get a new one.
+func imageVersion(name string, info storage.Info) string {
+	return fmt.Sprintf("%s-%x-%x", name, info.ModTime.UnixNano(), info.Size)
+}
+
+// imageIdentity is the format, the hash and the frame count of a version of an image.
+type imageIdentity struct {
+	version string
+	info    img.ImageInfo
+}
+
+// identify returns the format of an image, the hash of its content and its
+// frame count, which are all we need to know if a meme exists. They're
+// computed without decoding the image, and only again when it changes.
+func (h *MemeHandler) identify(name string) (img.ImageInfo, error) {
+	info, err := h.Images.Stat(name)
+	if err != nil {
+		return img.ImageInfo{}, err
 	}
-	width, err := strconv.ParseUint(vars["width"], 10, 0)
+	version := imageVersion(name, info)
+	if cached, ok := h.identities.Load(name); ok && cached.(imageIdentity).version == version {
+		return cached.(imageIdentity).info, nil
+	}
+	f, err := h.Images.Get(name)
+	if err != nil {
+		return img.ImageInfo{}, err
+	}
+	defer f.Close()
+	id, err := img.IdentifyImage(f)
 	if err != nil {
-		http.Error(w, "width must be specified", http.StatusBadRequest)
+		return img.ImageInfo{}, err
+	}
+	h.identities.Store(name, imageIdentity{version: version, info: id})
+	return id, nil
+}
+
+// source returns the decoded image with the given name, from memory if possible.
+func (h *MemeHandler) source(name string) (*img.Source, error) {
+	return h.cachedSource(h.Images, name, name)
+}
+
+// templateSource returns the decoded base image of a template, from memory if possible.
+func (h *MemeHandler) templateSource(tpl *img.MemeTemplate) (*img.Source, error) {
+	path := tpl.Spec().Image
+	return h.cachedSource(storage.NewLocal(filepath.Dir(path), ""), filepath.Base(path), "template:"+path)
+}
+
+// cachedSource returns the decoded image with the given name in s, from memory
+// if possible. key identifies the image among all the cached ones.
+func (h *MemeHandler) cachedSource(s storage.Storage, name string, key string) (*img.Source, error) {
+	if h.Sources == nil {
+		return img.DecodeSource(s, name)
 	}
-	height, err := strconv.ParseUint(vars["height"], 10, 0)
+	info, err := s.Stat(name)
 	if err != nil {
-		http.Error(w, "height must be specified", http.StatusBadRequest)
+		return nil, err
+	}
+	key = imageVersion(key, info)
+	if src, ok := h.Sources.Get(key); ok {
+		return src.(*img.Source), nil
 	}
-	imgFullPath := path.Join(h.ImgPath, imageName)
-	tpl, err := img.SimpleTemplate(imgFullPath, h.FontName, 52.0, 8.0)
+	src, err := img.DecodeSource(s, name)
 	if err != nil {
-		http.Error(w, "error generating the thumbnail", http.StatusInternalServerError)
+		return nil, err
+	}
+	h.Sources.Add(key, src, src.Size())
+	return src, nil
+}
+
+// errorStatus returns the http status for an error generating an image.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, img.ErrTextCount), errors.Is(err, img.ErrInvalidTransform):
+		return http.StatusBadRequest
+	case errors.Is(err, img.ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// serveCached redirects the user to the file with the given name in the meme
+// storage, or sends it if direct is true, after creating it with the data returned
+// by generate if it doesn't exist. Concurrent requests for the same file share a
+// single call to generate.
+func (h *MemeHandler) serveCached(w http.ResponseWriter, r *http.Request, fileName string, direct bool, generate func() ([]byte, error)) {
+	// The format can depend on the Accept header, and so does where we redirect to.
+	w.Header().Set("Vary", "Accept")
+	if direct {
+		// The name changes with the content, so clients that have it are up to date.
+		if etagMatches(r, memeETag(fileName)) {
+			setMemeHeaders(w, fileName)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	var data []byte
+	for reread := false; ; {
+		var shared bool
+		var err error
+		data, shared, err = h.inflight.Do(fileName, func() ([]byte, error) {
+			return h.generateOnce(fileName, generate)
+		})
+		if r.Context().Err() != nil {
+			// The client went away, no need to go on.
+			return
+		}
+		// If the request we waited for was canceled, try again with ours.
+		if shared && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+			continue
+		}
+		if err == nil && direct && data == nil {
+			// The meme existed already; if it's gone since, generate it again, once.
+			data, err = h.readMeme(fileName)
+			if errors.Is(err, storage.ErrNotFound) && !reread {
+				reread = true
+				continue
+			}
+		}
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		break
+	}
+	if direct {
+		sendMeme(w, r, fileName, data)
 		return
 	}
-	g, err := tpl.GetGif()
+	status := http.StatusPermanentRedirect
+	if _, ok := h.Memes.(*storage.Cache); ok {
+		// Memes can be evicted, so clients must come back here to have them generated again.
+		status = http.StatusTemporaryRedirect
+	}
+	http.Redirect(w, r, h.Memes.URL(fileName), status)
+}
+
+// generateOnce saves the data returned by generate as the file with the given
+// name, unless it already exists, and returns it; it returns nil if the file
+// existed. The storage makes sure that nobody can see a partially written file.
+func (h *MemeHandler) generateOnce(fileName string, generate func() ([]byte, error)) ([]byte, error) {
+	exists, err := h.Memes.Exists(fileName)
+	if err != nil || exists {
+		return nil, err
+	}
+	data, err := generate()
 	if err != nil {
-		http.Error(w, "error generating the thumbnail", http.StatusInternalServerError)
+		return nil, err
+	}
+	if err := h.Memes.Put(fileName, data); err != nil {
+		return nil, err
+	}
+	if h.Rendered != nil {
+		h.Rendered.Add(fileName, data, int64(len(data)))
+	}
+	return data, nil
+}
+
+// ServeMemeFile serves a generated meme, from memory if possible.
+func (h *MemeHandler) ServeMemeFile(w http.ResponseWriter, r *http.Request) {
+	h.serveMemeFile(w, r, mux.Vars(r)["name"])
+}
+
+// memeETag returns the ETag of a meme. Memes never change once generated, so
+// their name is enough.
+func memeETag(name string) string {
+	return `"` + name + `"`
+}
+
+// setMemeHeaders sets the headers describing a meme, conditional responses included.
+func setMemeHeaders(w http.ResponseWriter, name string) {
+	w.Header().Set("ETag", memeETag(name))
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+}
+
+// etagMatches returns true if the If-None-Match header of the request matches etag.
+func etagMatches(r *http.Request, etag string) bool {
+	for _, header := range r.Header["If-None-Match"] {
+		for _, candidate := range strings.Split(header, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveMemeFile sends the generated meme with the given name; see sendMeme.
+func (h *MemeHandler) serveMemeFile(w http.ResponseWriter, r *http.Request, name string) {
+	data, err := h.readMeme(name)
+	if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrInvalidName) {
+		http.NotFound(w, r)
 		return
 	}
-	m := img.Meme{Gif: g}
-	thumb := m.Preview(uint(width), uint(height))
-	w.Header().Set("Content-Type", "image/jpeg")
-	jpeg.Encode(w, thumb, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sendMeme(w, r, name, data)
+}
 
+// readMeme returns the content of a generated meme, from memory if possible.
+func (h *MemeHandler) readMeme(name string) ([]byte, error) {
+	if h.Rendered != nil {
+		if cached, ok := h.Rendered.Get(name); ok {
+			if cache, ok := h.Memes.(*storage.Cache); ok {
+				cache.Touch(name)
+			}
+			return cached.([]byte), nil
+		}
+	}
+	f, err := h.Memes.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if h.Rendered != nil {
+		h.Rendered.Add(name, data, int64(len(data)))
+	}
+	return data, nil
+}
+
+// sendMeme sends a generated meme, with its content type, length and ETag.
+// Conditional and range requests are supported.
+func sendMeme(w http.ResponseWriter, r *http.Request, name string, data []byte) {
+	if f, ok := img.FormatFromExtension(name); ok {
+		w.Header().Set("Content-Type", f.ContentType())
+	}
+	setMemeHeaders(w, name)
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
 }
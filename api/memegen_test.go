@@ -1,15 +1,26 @@
 package api
 
 import (
+	"bytes"
 	"fmt"
+	"image/gif"
+	"image/png"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 
+	"github.com/gorilla/mux"
+	"github.com/lavagetto/memeoid/img"
+	"github.com/lavagetto/memeoid/lru"
+	"github.com/lavagetto/memeoid/storage"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -37,10 +48,9 @@ func (s *MemeGenTestSuite) TeardownSuite() {
 
 func (s *MemeGenTestSuite) SetupTest() {
 	s.Sut = &MemeHandler{
-		OutputPath: s.TempDir,
-		ImgPath:    baseImgPath,
-		FontName:   fontName,
-		MemeURL:    baseMemeUrl,
+		Images:   storage.NewLocal(baseImgPath, "/gifs/"),
+		Memes:    storage.NewLocal(s.TempDir, "/"+baseMemeUrl+"/"),
+		FontName: fontName,
 	}
 }
 
@@ -49,24 +59,46 @@ func (s *MemeGenTestSuite) TeardownTest() {
 }
 
 func (s *MemeGenTestSuite) TestUID() {
-	// Two requests with the same parameters create the same UID
-	reader := strings.NewReader("")
-	r := httptest.NewRequest(http.MethodGet, "http://localhost/w/api.php?first=a&last=b", reader)
-	r1 := httptest.NewRequest(http.MethodGet, "http://localhost/w/api.php?last=b&first=a", reader)
-
-	uid, err := s.Sut.UID(r)
-	s.Nil(err, "could not calculate the UID: %v", err)
+	uid := func(query string) string {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost/w/api.php?"+query, strings.NewReader(""))
+		id, err := s.Sut.UID(r)
+		s.Require().Nil(err, "could not calculate the UID of %s: %v", query, err)
+		return id
+	}
+	base := uid("from=gagarin.gif&top=a&bottom=b")
+	s.True(strings.HasPrefix(base, fmt.Sprintf("v%d-", img.RendererVersion)), "the UID includes the renderer version")
 
-	uid1, err := s.Sut.UID(r1)
-	s.Nil(err, "could not calculate the UID: %v", err)
-	s.Equal(uid, uid1, "expected the UIDs to be equal for the same query parameters")
+	// Requests for the same meme get the same UID.
+	for _, query := range []string{
+		"bottom=b&top=a&from=gagarin.gif",
+		"from=gagarin.gif&top=a&bottom=b&utm_source=twitter&First=a&_=12345",
+		"from=gagarin.gif&text=a&text=b",
+		"from=gagarin.gif&text1=b&text0=a",
+		"from=gagarin.gif&top=a&bottom=b&format=gif",
+		"from=gagarin.gif&top=a&bottom=b&trim=0:",
+		"from=gagarin.gif&top=a&bottom=b&trim=0:5",
+	} {
+		s.Equal(base, uid(query), "%s should be the same meme", query)
+	}
+	s.Equal(uid("from=gagarin.gif&top=a&fill=FFF"), uid("from=gagarin.gif&top=a&fill=%23ffffff"))
 
-	// But this is case-sensitive.
-	r1 = httptest.NewRequest(http.MethodGet, "http://localhost/w/api.php?last=b&First=a", reader)
+	// Anything that changes the meme changes the UID.
+	for _, query := range []string{
+		"from=gagarin.png&top=a&bottom=b",
+		"from=gagarin.gif&top=A&bottom=b",
+		"from=gagarin.gif&top=b&bottom=a",
+		"from=gagarin.gif&top=a&bottom=b&fill=000",
+		"from=gagarin.gif&top=a&bottom=b&reverse=true",
+		"from=gagarin.gif&top=a&bottom=b&format=webp",
+	} {
+		s.NotEqual(base, uid(query), "%s should be a different meme", query)
+	}
+	s.Sut.Dither = true
+	s.NotEqual(base, uid("from=gagarin.gif&top=a&bottom=b"), "the options of the renderer change the UID")
 
-	uid1, err = s.Sut.UID(r1)
-	s.Nil(err, "could not calculate the UID: %v", err)
-	s.NotEqual(uid, uid1, "expected the UIDs to be different for different capitalizations")
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/w/api.php?from=missing.gif&top=a", strings.NewReader(""))
+	_, err := s.Sut.UID(r)
+	s.Error(err)
 }
 
 func (s *MemeGenTestSuite) TestListGifs() {
@@ -76,15 +108,15 @@ func (s *MemeGenTestSuite) TestListGifs() {
 		Status      string
 		Body        string
 	}{
-		{"", "application/json", "200 OK", `["badfile.gif","earth.gif","gagarin.gif"]`},
+		{"", "application/json", "200 OK", `["badfile.gif","earth.gif","gagarin.gif","gagarin.jpg","gagarin.png"]`},
 		{"/nonexistent", "", "404 Not Found", ""},
 	}
 	for _, tc := range testCases {
 		testName := fmt.Sprintf("Path: %s - ContentType: %s - Status: %s - Body: %s", tc.Path, tc.ContentType, tc.Status, tc.Body)
 		s.Run(testName, func() {
-			s.Sut.ImgPath = baseImgPath
+			s.Sut.Images = storage.NewLocal(baseImgPath, "/gifs/")
 			if tc.Path != "" {
-				s.Sut.ImgPath = tc.Path
+				s.Sut.Images = storage.NewLocal(tc.Path, "/gifs/")
 			}
 			req := httptest.NewRequest(http.MethodGet, "http://localhost/gifs", strings.NewReader(""))
 			req.Header.Set("Accept", "text/json")
@@ -120,6 +152,23 @@ func (s *MemeGenTestSuite) TestMemeGenerate() {
 		{"http://localhost/w/api.php?from=earth.gif&top=test", http.StatusPermanentRedirect, true},
 		{"http://localhost/w/api.php?from=gagarin.gif&bottom=test", http.StatusPermanentRedirect, true},
 		{"http://localhost/w/api.php?from=gagarin.gif&bottom=test&top=test", http.StatusPermanentRedirect, true},
+		{"http://localhost/w/api.php?from=gagarin.gif&text=a&text=b", http.StatusPermanentRedirect, true},
+		{"http://localhost/w/api.php?from=gagarin.gif&text1=b&text0=a", http.StatusPermanentRedirect, true},
+		{"http://localhost/w/api.php?from=gagarin.gif&text=a", http.StatusBadRequest, false},
+		{"http://localhost/w/api.php?from=gagarin.gif&text=a&text=b&text=c", http.StatusBadRequest, false},
+		{"http://localhost/w/api.php?from=gagarin.gif&text=&text=", http.StatusBadRequest, false},
+		{"http://localhost/w/api.php?from=gagarin.gif&text=a&text=b&top=c", http.StatusBadRequest, false},
+		{"http://localhost/w/api.php?from=gagarin.gif&top=a&fill=000&stroke=fff&stroke_width=0&align=right&valign=top", http.StatusPermanentRedirect, true},
+		{"http://localhost/w/api.php?from=gagarin.gif&top=a&fill=black", http.StatusBadRequest, false},
+		{"http://localhost/w/api.php?from=gagarin.gif&top=a&stroke_width=thick", http.StatusBadRequest, false},
+		{"http://localhost/w/api.php?from=gagarin.png&top=still", http.StatusPermanentRedirect, true},
+		{"http://localhost/w/api.php?from=gagarin.jpg&top=still", http.StatusPermanentRedirect, true},
+		{"http://localhost/w/api.php?from=gagarin.gif&top=a&width=100&crop=0,0,200,300&speed=2&reverse=true&boomerang=1&trim=0:1", http.StatusPermanentRedirect, true},
+		{"http://localhost/w/api.php?from=gagarin.gif&top=a&width=big", http.StatusBadRequest, false},
+		{"http://localhost/w/api.php?from=gagarin.gif&top=a&crop=0,0,2000,300", http.StatusBadRequest, false},
+		{"http://localhost/w/api.php?from=gagarin.gif&top=a&speed=0", http.StatusBadRequest, false},
+		{"http://localhost/w/api.php?from=gagarin.gif&top=a&reverse=maybe", http.StatusBadRequest, false},
+		{"http://localhost/w/api.php?from=gagarin.gif&top=a&trim=5:10", http.StatusBadRequest, false},
 	}
 	for _, tc := range testCases {
 		testName := fmt.Sprintf("Uri: %s - StatusCode: %d - Genereate: %t", tc.Uri, tc.StatusCode, tc.FileGenerated)
@@ -141,6 +190,368 @@ func (s *MemeGenTestSuite) TestMemeGenerate() {
 				fileName := locationHeader[0][len(locationPrefix):]
 				filePath := path.Join(s.TempDir, fileName)
 				s.FileExists(filePath)
+				// The meme is saved in the format of the original
+				s.Equal(path.Ext(req.URL.Query().Get("from")), path.Ext(fileName))
+			}
+		})
+	}
+}
+
+func (s *MemeGenTestSuite) TestConcurrentGenerate() {
+	// Count the renders through the optimization report.
+	var renders int32
+	s.Sut.Optimize = true
+	s.Sut.OnOptimize = func(img.OptimizeReport) { atomic.AddInt32(&renders, 1) }
+	uri := "http://localhost/w/api.php?from=gagarin.gif&top=concurrent"
+	var wg sync.WaitGroup
+	locations := make([]string, 8)
+	for i := range locations {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			s.Sut.MemeFromRequest(rec, httptest.NewRequest(http.MethodGet, uri, strings.NewReader("")))
+			locations[i] = rec.Result().Header.Get("Location")
+		}(i)
+	}
+	wg.Wait()
+
+	s.Equal(int32(1), atomic.LoadInt32(&renders), "identical requests should share a single render")
+	for _, location := range locations {
+		s.Equal(locations[0], location)
+	}
+	s.FileExists(path.Join(s.TempDir, path.Base(locations[0])))
+	// No temporary files are left behind.
+	tmp, err := filepath.Glob(path.Join(s.TempDir, ".tmp-*"))
+	s.Nil(err)
+	s.Empty(tmp)
+}
+
+// lookups returns a counter of the hits and misses of a cache.
+func lookups(cache *lru.Cache) map[bool]int {
+	count := map[bool]int{}
+	cache.OnLookup = func(hit bool) { count[hit]++ }
+	return count
+}
+
+func (s *MemeGenTestSuite) TestMemoryCaches() {
+	s.Sut.Sources = lru.New(64 << 20)
+	s.Sut.Rendered = lru.New(64 << 20)
+	sources, rendered := lookups(s.Sut.Sources), lookups(s.Sut.Rendered)
+	generate := func(uri string) string {
+		rec := httptest.NewRecorder()
+		s.Sut.MemeFromRequest(rec, httptest.NewRequest(http.MethodGet, uri, strings.NewReader("")))
+		s.Require().Equal(http.StatusPermanentRedirect, rec.Code)
+		return path.Base(rec.Result().Header.Get("Location"))
+	}
+	serve := func(name string) *http.Response {
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "http://localhost/url/"+name, strings.NewReader("")), map[string]string{"name": name})
+		rec := httptest.NewRecorder()
+		s.Sut.ServeMemeFile(rec, req)
+		return rec.Result()
+	}
+
+	name := generate("http://localhost/w/api.php?from=gagarin.gif&top=memory")
+	generate("http://localhost/w/api.php?from=gagarin.gif&top=memory&bottom=again")
+	// The image is decoded once, and then found in memory.
+	s.Equal(map[bool]int{false: 1, true: 1}, sources)
+	s.Equal(1, s.Sut.Sources.Len())
+	// Memes that already exist don't need the image to be decoded.
+	s.Equal(name, generate("http://localhost/w/api.php?from=gagarin.gif&top=memory"))
+	s.Equal(map[bool]int{false: 1, true: 1}, sources)
+
+	// Memes just generated are served from memory, even if removed from disk.
+	s.Require().Nil(os.Remove(path.Join(s.TempDir, name)))
+	response := serve(name)
+	s.Equal(http.StatusOK, response.StatusCode)
+	s.Equal("image/gif", response.Header.Get("Content-Type"))
+	s.Equal(`"`+name+`"`, response.Header.Get("ETag"))
+	s.Equal(map[bool]int{true: 1}, rendered)
+
+	// Other memes are read from storage the first time.
+	s.Require().Nil(ioutil.WriteFile(path.Join(s.TempDir, "other.gif"), []byte("GIF89a"), 0644))
+	s.Equal(http.StatusOK, serve("other.gif").StatusCode)
+	s.Require().Nil(os.Remove(path.Join(s.TempDir, "other.gif")))
+	s.Equal(http.StatusOK, serve("other.gif").StatusCode)
+	s.Equal(map[bool]int{true: 2, false: 1}, rendered)
+
+	s.Equal(http.StatusNotFound, serve("missing.gif").StatusCode)
+	s.Equal(http.StatusNotFound, serve("..").StatusCode)
+}
+
+func (s *MemeGenTestSuite) TestEvicted() {
+	// The cache only fits one byte, so that cleaning it removes everything.
+	dir, err := ioutil.TempDir("", "memeoid-api-evicted")
+	s.Require().Nil(err)
+	defer os.RemoveAll(dir)
+	cache := storage.NewCache(storage.NewLocal(dir, "/"+baseMemeUrl+"/"), 1, 0)
+	s.Sut.Memes = cache
+	generate := func() string {
+		rec := httptest.NewRecorder()
+		s.Sut.MemeFromRequest(rec, httptest.NewRequest(http.MethodGet, "http://localhost/w/api.php?from=gagarin.gif&top=evicted", strings.NewReader("")))
+		s.Require().Equal(http.StatusTemporaryRedirect, rec.Code, "redirects to memes that can be evicted should not be cached")
+		return path.Base(rec.Result().Header.Get("Location"))
+	}
+	serve := func(name string) int {
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "http://localhost/url/"+name, strings.NewReader("")), map[string]string{"name": name})
+		rec := httptest.NewRecorder()
+		s.Sut.ServeMemeFile(rec, req)
+		return rec.Code
+	}
+
+	name := generate()
+	s.Equal(http.StatusOK, serve(name))
+	report, err := cache.Clean()
+	s.Require().Nil(err)
+	s.Require().Equal(1, report.Evicted)
+	s.Equal(http.StatusNotFound, serve(name))
+
+	// Following the redirect again generates the meme again.
+	s.Equal(name, generate())
+	s.Equal(http.StatusOK, serve(name))
+}
+
+func (s *MemeGenTestSuite) TestDirect() {
+	get := func(query string, headers map[string]string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/w/api.php?"+query, strings.NewReader(""))
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		s.Sut.MemeFromRequest(rec, req)
+		return rec.Result()
+	}
+
+	response := get("from=gagarin.gif&top=direct&direct=true", nil)
+	s.Require().Equal(http.StatusOK, response.StatusCode)
+	body, err := ioutil.ReadAll(response.Body)
+	s.Require().Nil(err)
+	s.Equal("image/gif", response.Header.Get("Content-Type"))
+	s.Equal(fmt.Sprintf("%d", len(body)), response.Header.Get("Content-Length"))
+	s.Contains(response.Header.Get("Cache-Control"), "immutable")
+	s.Equal("Accept", response.Header.Get("Vary"))
+	etag := response.Header.Get("ETag")
+	s.NotEmpty(etag)
+	_, err = gif.DecodeAll(bytes.NewReader(body))
+	s.Nil(err, "the body should be the meme")
+	// The meme is saved as usual.
+	saved, err := ioutil.ReadFile(path.Join(s.TempDir, strings.Trim(etag, `"`)))
+	s.Nil(err)
+	s.Equal(saved, body)
+
+	// Clients that have the meme don't get it again.
+	response = get("from=gagarin.gif&top=direct&direct=true", map[string]string{"If-None-Match": etag})
+	s.Equal(http.StatusNotModified, response.StatusCode)
+	s.Equal(etag, response.Header.Get("ETag"))
+	body, _ = ioutil.ReadAll(response.Body)
+	s.Empty(body)
+	response = get("from=gagarin.gif&top=direct&direct=true", map[string]string{"If-None-Match": `W/"other", ` + etag})
+	s.Equal(http.StatusNotModified, response.StatusCode)
+	response = get("from=gagarin.gif&top=direct&direct=true", map[string]string{"If-None-Match": `"other"`})
+	s.Equal(http.StatusOK, response.StatusCode)
+
+	// The parameter overrides the server default.
+	s.Sut.Direct = true
+	s.Equal(http.StatusOK, get("from=gagarin.gif&top=direct", nil).StatusCode)
+	s.Equal(http.StatusPermanentRedirect, get("from=gagarin.gif&top=direct&direct=false", nil).StatusCode)
+	s.Equal(http.StatusBadRequest, get("from=gagarin.gif&top=direct&direct=maybe", nil).StatusCode)
+
+	// The meme just generated is sent as it is, even if it's gone from the storage already.
+	s.Sut.Memes = forgetful{s.Sut.Memes}
+	response = get("from=gagarin.gif&top=forgotten", nil)
+	s.Require().Equal(http.StatusOK, response.StatusCode)
+	body, err = ioutil.ReadAll(response.Body)
+	s.Require().Nil(err)
+	_, err = gif.DecodeAll(bytes.NewReader(body))
+	s.Nil(err, "the body should be the meme")
+}
+
+// forgetful is a storage that loses files as soon as they're saved, as if they were evicted.
+type forgetful struct {
+	storage.Storage
+}
+
+func (forgetful) Get(name string) (io.ReadCloser, error) {
+	return nil, storage.ErrNotFound
+}
+
+func (s *MemeGenTestSuite) TestFormatFromRequest() {
+	var testCases = []struct {
+		Query    string
+		Accept   string
+		Expected img.Format
+		HasErr   bool
+	}{
+		{"", "", img.FormatGIF, false},
+		{"format=webp", "", img.FormatWebP, false},
+		{"format=APNG", "image/webp", img.FormatAPNG, false},
+		{"format=bmp", "", "", true},
+		{"", "image/webp,image/apng,*/*;q=0.8", img.FormatWebP, false},
+		{"", "image/webp;q=0.5, image/apng;q=0.9", img.FormatAPNG, false},
+		{"", "image/webp, image/gif", img.FormatGIF, false},
+		{"", "text/html,*/*", img.FormatGIF, false},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.Query+" - "+tc.Accept, func() {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/w/api.php?"+tc.Query, strings.NewReader(""))
+			if tc.Accept != "" {
+				req.Header.Set("Accept", tc.Accept)
+			}
+
+			format, err := formatFromRequest(req, img.FormatGIF)
+
+			if tc.HasErr {
+				s.Error(err)
+			} else {
+				s.Nil(err)
+				s.Equal(tc.Expected, format)
+			}
+		})
+	}
+}
+
+func (s *MemeGenTestSuite) TestMemeFormat() {
+	var testCases = []struct {
+		Query      string
+		Accept     string
+		StatusCode int
+		Ext        string
+	}{
+		{"from=gagarin.gif&top=format", "", http.StatusPermanentRedirect, ".gif"},
+		{"from=gagarin.gif&top=format&format=gif", "", http.StatusPermanentRedirect, ".gif"},
+		{"from=gagarin.gif&top=format&format=webp", "", http.StatusPermanentRedirect, ".webp"},
+		{"from=gagarin.gif&top=format", "image/webp,*/*", http.StatusPermanentRedirect, ".webp"},
+		{"from=gagarin.gif&top=format&format=apng", "", http.StatusPermanentRedirect, ".png"},
+		{"from=gagarin.png&top=format&format=jpg", "", http.StatusPermanentRedirect, ".jpg"},
+		{"from=gagarin.gif&top=format&format=frames", "", http.StatusPermanentRedirect, ".zip"},
+		{"from=gagarin.gif&top=format&format=bmp", "", http.StatusBadRequest, ""},
+	}
+	locations := make(map[string]string)
+	for _, tc := range testCases {
+		s.Run(tc.Query+" - "+tc.Accept, func() {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/w/api.php?"+tc.Query, strings.NewReader(""))
+			if tc.Accept != "" {
+				req.Header.Set("Accept", tc.Accept)
+			}
+			rec := httptest.NewRecorder()
+
+			s.Sut.MemeFromRequest(rec, req)
+
+			response := rec.Result()
+			s.Equal(tc.StatusCode, response.StatusCode)
+			if tc.Ext == "" {
+				return
+			}
+			s.Equal("Accept", response.Header.Get("Vary"), "the redirect depends on the Accept header")
+			location := response.Header.Get("Location")
+			s.Equal(tc.Ext, path.Ext(location))
+			s.FileExists(path.Join(s.TempDir, path.Base(location)))
+			locations[tc.Query+tc.Accept] = location
+		})
+	}
+	// Asking for the native format explicitly gives the same meme.
+	s.Equal(locations["from=gagarin.gif&top=format"], locations["from=gagarin.gif&top=format&format=gif"])
+	// The format changes the UID, however it's selected.
+	s.NotEqual(locations["from=gagarin.gif&top=format"], locations["from=gagarin.gif&top=formatimage/webp,*/*"])
+	s.Equal(locations["from=gagarin.gif&top=format&format=webp"], locations["from=gagarin.gif&top=formatimage/webp,*/*"])
+}
+
+func (s *MemeGenTestSuite) TestMemeOptimize() {
+	var testCases = []struct {
+		Query     string
+		Optimized bool
+	}{
+		{"from=gagarin.gif&top=optimize", true},
+		{"from=gagarin.gif&top=optimize&format=webp", false},
+		{"from=gagarin.png&top=optimize", false},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.Query, func() {
+			var reports []img.OptimizeReport
+			s.Sut.Optimize = true
+			s.Sut.OnOptimize = func(r img.OptimizeReport) { reports = append(reports, r) }
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/w/api.php?"+tc.Query, strings.NewReader(""))
+			rec := httptest.NewRecorder()
+
+			s.Sut.MemeFromRequest(rec, req)
+
+			s.Equal(http.StatusPermanentRedirect, rec.Result().StatusCode)
+			if tc.Optimized {
+				s.Require().Len(reports, 1, "only gifs are optimized")
+				s.Equal(1, reports[0].FramesAfter)
+			} else {
+				s.Empty(reports, "only gifs are optimized")
+			}
+		})
+	}
+}
+
+func (s *MemeGenTestSuite) TestMemeLimits() {
+	var testCases = []struct {
+		Query      string
+		Limits     img.Limits
+		StatusCode int
+		Width      int
+	}{
+		{"from=gagarin.png&top=limits", img.Limits{MaxWidth: 100}, http.StatusPermanentRedirect, 100},
+		{"from=gagarin.png&top=limits&bottom=bytes", img.Limits{MaxBytes: 20000}, http.StatusPermanentRedirect, 0},
+		{"from=gagarin.png&top=limits&bottom=tiny", img.Limits{MaxBytes: 10}, http.StatusRequestEntityTooLarge, 0},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.Query, func() {
+			s.Sut.Limits = tc.Limits
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/w/api.php?"+tc.Query, strings.NewReader(""))
+			rec := httptest.NewRecorder()
+
+			s.Sut.MemeFromRequest(rec, req)
+
+			response := rec.Result()
+			s.Equal(tc.StatusCode, response.StatusCode)
+			if tc.StatusCode != http.StatusPermanentRedirect {
+				return
+			}
+			f, err := os.Open(path.Join(s.TempDir, path.Base(response.Header.Get("Location"))))
+			s.Require().Nil(err)
+			defer f.Close()
+			stat, err := f.Stat()
+			s.Require().Nil(err)
+			if tc.Limits.MaxBytes > 0 {
+				s.True(stat.Size() <= int64(tc.Limits.MaxBytes), "the meme is too large: %d bytes", stat.Size())
+			}
+			cfg, err := png.DecodeConfig(f)
+			s.Require().Nil(err)
+			if tc.Width > 0 {
+				s.Equal(tc.Width, cfg.Width)
+			}
+		})
+	}
+}
+
+func (s *MemeGenTestSuite) TestTextFromRequest() {
+	var testCases = []struct {
+		Query  string
+		Text   []string
+		HasErr bool
+	}{
+		{"top=a", nil, false},
+		{"text=a&text=b&text=c", []string{"a", "b", "c"}, false},
+		{"text2=c&text0=a&text1=b", []string{"a", "b", "c"}, false},
+		{"text0=a&textual=b", []string{"a"}, false},
+		{"text0=a&text2=c", nil, true},
+		{"text1=a", nil, true},
+		{"text=a&text0=b", nil, true},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.Query, func() {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/w/api.php?"+tc.Query, strings.NewReader(""))
+
+			text, err := textFromRequest(req)
+
+			if tc.HasErr {
+				s.Error(err)
+			} else {
+				s.Nil(err)
+				s.Equal(tc.Text, text)
 			}
 		})
 	}
@@ -0,0 +1,288 @@
+package api
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lavagetto/memeoid/img"
+	"github.com/lavagetto/memeoid/storage"
+)
+
+// wantsJSON returns true if the client asked for a json response
+func wantsJSON(r *http.Request) bool {
+	if acceptHeaders, ok := r.Header["Accept"]; ok {
+		for _, hdr := range acceptHeaders {
+			if strings.Contains(hdr, "/json") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// publicSpec returns the specification of a template, without
+// disclosing where the image is stored on the filesystem.
+func publicSpec(tpl *img.MemeTemplate) img.TemplateSpec {
+	spec := tpl.Spec()
+	spec.Image = filepath.Base(spec.Image)
+	return spec
+}
+
+func (h *MemeHandler) templateFromRequest(w http.ResponseWriter, r *http.Request) *img.MemeTemplate {
+	name, ok := mux.Vars(r)["template"]
+	if !ok || name == "" {
+		http.Error(w, "missing 'template' parameter", http.StatusBadRequest)
+		return nil
+	}
+	if h.Registry == nil {
+		http.Error(w, "template not found", http.StatusNotFound)
+		return nil
+	}
+	tpl, ok := h.Registry.Get(name)
+	if !ok {
+		http.Error(w, "template not found", http.StatusNotFound)
+		return nil
+	}
+	return tpl
+}
+
+// ListTemplates lists the available meme templates
+func (h *MemeHandler) ListTemplates(w http.ResponseWriter, r *http.Request) {
+	var templates []*img.MemeTemplate
+	if h.Registry != nil {
+		templates = h.Registry.List()
+	}
+	if wantsJSON(r) {
+		specs := make([]img.TemplateSpec, len(templates))
+		for i, tpl := range templates {
+			specs[i] = publicSpec(tpl)
+		}
+		h.writeJSON(w, specs)
+		return
+	}
+	err := h.templates.ExecuteTemplate(w, "templates.html.gotmpl", templates)
+	if err != nil {
+		http.Error(w, "Bad data: maybe ploticus is not installed?", http.StatusInternalServerError)
+	}
+}
+
+// ShowTemplate returns the description of a template, or a form to generate
+// a meme from it.
+func (h *MemeHandler) ShowTemplate(w http.ResponseWriter, r *http.Request) {
+	tpl := h.templateFromRequest(w, r)
+	if tpl == nil {
+		return
+	}
+	if wantsJSON(r) {
+		h.writeJSON(w, publicSpec(tpl))
+		return
+	}
+	err := h.templates.ExecuteTemplate(w, "template.html.gotmpl", publicSpec(tpl))
+	if err != nil {
+		http.Error(w, "General error: is restbase calling itself?", http.StatusInternalServerError)
+	}
+}
+
+// TemplateImage serves the base image of a template
+func (h *MemeHandler) TemplateImage(w http.ResponseWriter, r *http.Request) {
+	tpl := h.templateFromRequest(w, r)
+	if tpl == nil {
+		return
+	}
+	http.ServeFile(w, r, tpl.Spec().Image)
+}
+
+// MemeFromTemplate generates a meme from a template, using the text
+// parameters in order to fill its boxes.
+func (h *MemeHandler) MemeFromTemplate(w http.ResponseWriter, r *http.Request) {
+	tpl := h.templateFromRequest(w, r)
+	if tpl == nil {
+		return
+	}
+	text, err := textFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(text) != tpl.NumBoxes() {
+		http.Error(w, fmt.Sprintf("template %s needs %d 'text' parameters, %d given", tpl.Name(), tpl.NumBoxes(), len(text)), http.StatusBadRequest)
+		return
+	}
+	if strings.Join(text, "") == "" {
+		http.Error(w, "all 'text' parameters are empty", http.StatusBadRequest)
+		return
+	}
+	style, err := styleFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	transform, err := transformFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	info, err := tpl.ImageInfo()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	layout := tpl.Spec()
+	spec := img.RenderSpec{Source: info.Hash, Frames: info.Frames, Template: &layout, Text: text, Style: style, Transform: transform}
+	h.serveMeme(w, r, tpl.Format(), spec, func() (*img.Meme, error) {
+		src, err := h.templateSource(tpl)
+		if err != nil {
+			return nil, err
+		}
+		meme, err := tpl.WithSource(src).WithStyle(style).GetMeme(text...)
+		if err != nil {
+			return nil, err
+		}
+		return meme, meme.Transform(transform)
+	})
+}
+
+// maxUploadSize is the maximum size of a template upload, image included.
+const maxUploadSize = 32 << 20
+
+// authorized checks the bearer token in the request matches the upload token.
+func (h *MemeHandler) authorized(r *http.Request) bool {
+	if h.UploadToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.UploadToken)) == 1
+}
+
+// readUpload extracts the template specification, and optionally the image, from the request.
+// The template can either be the body of the request, or the "template" field of a multipart
+// form, in which case the image can be uploaded as the "image" field.
+func readUpload(r *http.Request) (*img.TemplateSpec, io.ReadCloser, error) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		spec, err := img.ReadTemplateSpec(r.Body)
+		return spec, nil, err
+	}
+	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+		return nil, nil, err
+	}
+	var tplReader io.Reader
+	if tplText := r.FormValue("template"); tplText != "" {
+		tplReader = strings.NewReader(tplText)
+	} else {
+		tplFile, _, err := r.FormFile("template")
+		if err != nil {
+			return nil, nil, fmt.Errorf("missing 'template' field")
+		}
+		defer tplFile.Close()
+		tplReader = tplFile
+	}
+	spec, err := img.ReadTemplateSpec(tplReader)
+	if err != nil {
+		return nil, nil, err
+	}
+	image, _, err := r.FormFile("image")
+	if err == http.ErrMissingFile {
+		return spec, nil, nil
+	}
+	return spec, image, err
+}
+
+// UploadTemplate validates a template sent by the user, and adds it to the registry.
+// Requires the upload token to be passed as a bearer token.
+func (h *MemeHandler) UploadTemplate(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if h.Registry == nil {
+		http.Error(w, "no template registry configured", http.StatusNotFound)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	spec, image, err := readUpload(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if image != nil {
+		defer image.Close()
+	} else {
+		// The image must be one of the ones we already have.
+		imageName := filepath.Base(spec.Image)
+		if imageName != spec.Image {
+			http.Error(w, "the image must be the name of one of the available images", http.StatusBadRequest)
+			return
+		}
+		if ok, err := h.Images.Exists(imageName); err != nil || !ok {
+			http.Error(w, "image not found", http.StatusBadRequest)
+			return
+		}
+		if local, ok := h.Images.(*storage.Local); ok {
+			spec.Image = local.Path(imageName)
+			if !filepath.IsAbs(spec.Image) {
+				if spec.Image, err = filepath.Abs(spec.Image); err != nil {
+					http.Error(w, "internal error", http.StatusInternalServerError)
+					return
+				}
+			}
+		} else {
+			// Templates are loaded from the filesystem, so the registry
+			// gets its own copy of remote images.
+			if image, err = h.Images.Get(imageName); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer image.Close()
+		}
+	}
+	tpl, err := h.Registry.Add(spec, image)
+	switch {
+	case errors.Is(err, img.ErrTemplateExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, img.ErrInvalidTemplate):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/templates/"+tpl.Name())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	h.writeJSON(w, publicSpec(tpl))
+}
+
+func (h *MemeHandler) writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	js, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, `{"error": "bad json encoding"}`, http.StatusInternalServerError)
+		return
+	}
+	w.Write(js)
+}
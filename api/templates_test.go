@@ -0,0 +1,245 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image/gif"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/lavagetto/memeoid/img"
+	"github.com/lavagetto/memeoid/lru"
+	"github.com/lavagetto/memeoid/storage"
+	"github.com/stretchr/testify/suite"
+)
+
+const baseTplPath string = "../img/fixtures/templates"
+
+type TemplatesTestSuite struct {
+	suite.Suite
+	TempDir string
+	Sut     *Controller
+}
+
+func (s *TemplatesTestSuite) SetupSuite() {
+	tempdir, err := ioutil.TempDir("", "memeoid-api-templates")
+	if err != nil {
+		panic(err)
+	}
+	s.TempDir = tempdir
+}
+
+func (s *TemplatesTestSuite) TearDownSuite() {
+	os.RemoveAll(s.TempDir)
+}
+
+func (s *TemplatesTestSuite) SetupTest() {
+	registry := img.NewRegistry(baseTplPath)
+	if err := registry.Load(); err != nil {
+		panic(err)
+	}
+	s.Sut = &Controller{
+		Handler: &MemeHandler{
+			Images:   storage.NewLocal(baseImgPath, "/gifs/"),
+			Memes:    storage.NewLocal(s.TempDir, "/"+baseMemeUrl+"/"),
+			FontName: fontName,
+			Registry: registry,
+		},
+		Router: mux.NewRouter(),
+	}
+	s.Sut.Load("../templates")
+}
+
+func (s *TemplatesTestSuite) do(uri string, accept string) *http.Response {
+	req := httptest.NewRequest(http.MethodGet, uri, strings.NewReader(""))
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rec := httptest.NewRecorder()
+	s.Sut.Router.ServeHTTP(rec, req)
+	return rec.Result()
+}
+
+func (s *TemplatesTestSuite) TestListTemplates() {
+	response := s.do("http://localhost/templates", "application/json")
+
+	s.Equal(http.StatusOK, response.StatusCode)
+	var specs []img.TemplateSpec
+	s.Nil(json.NewDecoder(response.Body).Decode(&specs))
+	s.Len(specs, 2)
+	s.Equal("earth", specs[0].Name)
+	s.Equal("earth.gif", specs[0].Image, "the image path on disk should not be disclosed")
+	s.Len(specs[0].Boxes, 2)
+
+	response = s.do("http://localhost/templates", "text/html")
+	s.Equal(http.StatusOK, response.StatusCode)
+	body, _ := ioutil.ReadAll(response.Body)
+	s.Contains(string(body), `href="/templates/first-man-in-space"`)
+}
+
+func (s *TemplatesTestSuite) TestShowTemplate() {
+	var testCases = []struct {
+		Uri        string
+		Accept     string
+		StatusCode int
+		Contains   string
+	}{
+		{"http://localhost/templates/earth", "application/json", http.StatusOK, `"width":754`},
+		{"http://localhost/templates/earth", "", http.StatusOK, `name="template" value="earth"`},
+		{"http://localhost/templates/lala", "", http.StatusNotFound, ""},
+		{"http://localhost/templates/earth/image", "", http.StatusOK, "GIF89a"},
+	}
+	for _, tc := range testCases {
+		testName := fmt.Sprintf("Uri: %s - Accept: %s", tc.Uri, tc.Accept)
+		s.Run(testName, func() {
+			response := s.do(tc.Uri, tc.Accept)
+
+			s.Equal(tc.StatusCode, response.StatusCode)
+			body, _ := ioutil.ReadAll(response.Body)
+			s.Contains(string(body), tc.Contains)
+		})
+	}
+}
+
+func (s *TemplatesTestSuite) TestMemeFromTemplate() {
+	var testCases = []struct {
+		Uri           string
+		StatusCode    int
+		FileGenerated bool
+	}{
+		{"http://localhost/w/api.php?template=lala&text=a", http.StatusNotFound, false},
+		{"http://localhost/w/api.php?template=first-man-in-space", http.StatusBadRequest, false},
+		{"http://localhost/w/api.php?template=first-man-in-space&text=", http.StatusBadRequest, false},
+		{"http://localhost/w/api.php?template=first-man-in-space&text=a&text=b", http.StatusBadRequest, false},
+		{"http://localhost/w/api.php?template=first-man-in-space&text=test", http.StatusPermanentRedirect, true},
+	}
+	for _, tc := range testCases {
+		testName := fmt.Sprintf("Uri: %s - StatusCode: %d - Generate: %t", tc.Uri, tc.StatusCode, tc.FileGenerated)
+		s.Run(testName, func() {
+			response := s.do(tc.Uri, "")
+
+			s.Equal(tc.StatusCode, response.StatusCode)
+			if tc.FileGenerated {
+				location := response.Header.Get("Location")
+				fileName := location[len(baseMemeUrl)+2:]
+				s.FileExists(path.Join(s.TempDir, fileName))
+			}
+		})
+	}
+}
+
+func (s *TemplatesTestSuite) TestMemeFromTemplateTransform() {
+	plain := s.do("http://localhost/w/api.php?template=first-man-in-space&text=test", "")
+	response := s.do("http://localhost/w/api.php?template=first-man-in-space&text=test&width=200&reverse=true", "")
+
+	s.Equal(http.StatusPermanentRedirect, response.StatusCode)
+	location := response.Header.Get("Location")
+	s.NotEqual(plain.Header.Get("Location"), location, "the transform should change the meme")
+	f, err := os.Open(path.Join(s.TempDir, path.Base(location)))
+	s.Require().Nil(err)
+	defer f.Close()
+	cfg, err := gif.DecodeConfig(f)
+	s.Require().Nil(err)
+	s.Equal(200, cfg.Width)
+
+	response = s.do("http://localhost/w/api.php?template=first-man-in-space&text=test&speed=0", "")
+	s.Equal(http.StatusBadRequest, response.StatusCode)
+}
+
+func (s *TemplatesTestSuite) TestMemeFromTemplateMemory() {
+	s.Sut.Handler.Sources = lru.New(64 << 20)
+	sources := lookups(s.Sut.Handler.Sources)
+
+	for _, text := range []string{"memory", "again"} {
+		response := s.do("http://localhost/w/api.php?template=first-man-in-space&text="+text, "")
+		s.Require().Equal(http.StatusPermanentRedirect, response.StatusCode)
+	}
+
+	// The image is decoded once, and then found in memory.
+	s.Equal(map[bool]int{false: 1, true: 1}, sources)
+	s.Equal(1, s.Sut.Handler.Sources.Len())
+}
+
+func (s *TemplatesTestSuite) upload(body io.Reader, contentType string, token string) *http.Response {
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/templates", body)
+	req.Header.Set("Content-Type", contentType)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.Sut.Router.ServeHTTP(rec, req)
+	return rec.Result()
+}
+
+func (s *TemplatesTestSuite) TestUploadTemplate() {
+	tplDir, err := ioutil.TempDir("", "memeoid-api-upload")
+	s.Nil(err)
+	defer os.RemoveAll(tplDir)
+	s.Sut.Handler.Registry = img.NewRegistry(tplDir)
+	s.Sut.Handler.UploadToken = "s3cr3t"
+	box := "boxes: [{x: 0, y: 0, width: 100, height: 100}]\n"
+	var testCases = []struct {
+		Name       string
+		Body       string
+		Token      string
+		StatusCode int
+	}{
+		{"no token", "name: a\nimage: gagarin.gif\nfont: DejaVuSans\n" + box, "", http.StatusUnauthorized},
+		{"bad token", "name: a\nimage: gagarin.gif\nfont: DejaVuSans\n" + box, "lala", http.StatusUnauthorized},
+		{"bad yaml", "name: [a", "s3cr3t", http.StatusBadRequest},
+		{"missing image", "name: a\nimage: lala.gif\nfont: DejaVuSans\n" + box, "s3cr3t", http.StatusBadRequest},
+		{"image outside the gif dir", "name: a\nimage: ../fixtures/gagarin.gif\nfont: DejaVuSans\n" + box, "s3cr3t", http.StatusBadRequest},
+		{"bad font", "name: a\nimage: gagarin.gif\nfont: NoSuchFontAnywhere\n" + box, "s3cr3t", http.StatusBadRequest},
+		{"box outside", "name: a\nimage: gagarin.gif\nfont: DejaVuSans\nboxes: [{x: 600, y: 0, width: 100, height: 100}]", "s3cr3t", http.StatusBadRequest},
+		{"good", "name: a\nimage: gagarin.gif\nfont: DejaVuSans\n" + box, "s3cr3t", http.StatusCreated},
+		{"duplicate", "name: a\nimage: gagarin.gif\nfont: DejaVuSans\n" + box, "s3cr3t", http.StatusConflict},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.Name, func() {
+			response := s.upload(strings.NewReader(tc.Body), "application/yaml", tc.Token)
+
+			s.Equal(tc.StatusCode, response.StatusCode)
+		})
+	}
+	// The uploaded template can be used right away
+	response := s.do("http://localhost/w/api.php?template=a&text=test", "")
+	s.Equal(http.StatusPermanentRedirect, response.StatusCode)
+}
+
+func (s *TemplatesTestSuite) TestUploadTemplateWithImage() {
+	tplDir, err := ioutil.TempDir("", "memeoid-api-upload")
+	s.Nil(err)
+	defer os.RemoveAll(tplDir)
+	s.Sut.Handler.Registry = img.NewRegistry(tplDir)
+	s.Sut.Handler.UploadToken = "s3cr3t"
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("template", "name: earthling\nimage: ignored.gif\nfont: DejaVuSans\nboxes: [{x: 0, y: 0, width: 700, height: 100}]")
+	part, err := mw.CreateFormFile("image", "earth.gif")
+	s.Nil(err)
+	earth, err := ioutil.ReadFile(path.Join(baseImgPath, "earth.gif"))
+	s.Nil(err)
+	part.Write(earth)
+	mw.Close()
+
+	response := s.upload(&body, mw.FormDataContentType(), "s3cr3t")
+
+	s.Equal(http.StatusCreated, response.StatusCode)
+	s.Equal("/templates/earthling", response.Header.Get("Location"))
+	s.FileExists(path.Join(tplDir, "earthling.gif"))
+	s.FileExists(path.Join(tplDir, "earthling.yaml"))
+}
+
+func TestTemplatesTestSuite(t *testing.T) {
+	suite.Run(t, new(TemplatesTestSuite))
+}
@@ -0,0 +1,190 @@
+package api
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lavagetto/memeoid/img"
+	"github.com/lavagetto/memeoid/storage"
+)
+
+// maxThumbnailSize is the largest width and height of a thumbnail.
+const maxThumbnailSize = 1024
+
+// thumbnailFromRequest returns the thumbnail described by the size in the path
+// and the frame, animated and frames parameters. Unless another frame is
+// requested, still thumbnails show the most representative one.
+func thumbnailFromRequest(r *http.Request) (img.Thumbnail, error) {
+	vars := mux.Vars(r)
+	qs := r.URL.Query()
+	t := img.Thumbnail{Frame: img.FrameBest}
+	var err error
+	for name, dst := range map[string]*int{"width": &t.Width, "height": &t.Height} {
+		if *dst, err = strconv.Atoi(vars[name]); err != nil || *dst <= 0 || *dst > maxThumbnailSize {
+			return t, fmt.Errorf("%s must be between 1 and %d", name, maxThumbnailSize)
+		}
+	}
+	if v := qs.Get("frame"); v != "" && v != "best" {
+		if t.Frame, err = strconv.Atoi(v); err != nil || t.Frame < 0 {
+			return t, fmt.Errorf("invalid frame '%s'", v)
+		}
+	}
+	if v := qs.Get("animated"); v != "" {
+		if t.Animated, err = strconv.ParseBool(v); err != nil {
+			return t, fmt.Errorf("invalid value '%s' for 'animated'", v)
+		}
+	}
+	if v := qs.Get("frames"); v != "" {
+		if t.MaxFrames, err = strconv.Atoi(v); err != nil || t.MaxFrames <= 0 {
+			return t, fmt.Errorf("invalid number of frames '%s'", v)
+		}
+	}
+	return t, nil
+}
+
+// thumbs returns the storage where thumbnails are cached.
+func (h *MemeHandler) thumbs() storage.Storage {
+	if h.Thumbs != nil {
+		return h.Thumbs
+	}
+	return h.Memes
+}
+
+// sourceKey returns the prefix of the names of all the cached thumbnails of
+// an image, whatever its version.
+func sourceKey(imageName string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(imageName)))
+}
+
+// versionKey returns the prefix of the names of the cached thumbnails of the
+// current version of an image.
+func versionKey(src storage.Info) string {
+	return fmt.Sprintf("%s-%x", sourceKey(src.Name), src.ModTime.UnixNano())
+}
+
+// thumbnailKey returns the name of a cached thumbnail, without extension. It
+// changes whenever the image is modified, or different options are requested.
+func thumbnailKey(src storage.Info, options string) string {
+	return fmt.Sprintf("%s-%x", versionKey(src), sha1.Sum([]byte(options)))
+}
+
+// removeStaleThumbnails removes the cached thumbnails of older versions of an image.
+func (h *MemeHandler) removeStaleThumbnails(src storage.Info) {
+	current := versionKey(src) + "-"
+	files, _ := h.thumbs().List(sourceKey(src.Name) + "-")
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name, current) {
+			h.thumbs().Delete(file.Name)
+		}
+	}
+}
+
+// Preview returns a thumbnail of an image: a single frame in jpeg format, or
+// the whole animation in gif format if animated=true, unless another format
+// is requested with the format parameter or, for animations, the Accept header.
+// Thumbnails are cached in storage until the image changes, and served with an
+// ETag and the modification time of the image.
+func (h *MemeHandler) Preview(w http.ResponseWriter, r *http.Request) {
+	imageName := h.getImageFromRequest(w, r)
+	if imageName == "" {
+		return
+	}
+	thumb, err := thumbnailFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	src, err := h.Images.Stat(imageName)
+	if err != nil {
+		http.Error(w, "image not found", http.StatusNotFound)
+		return
+	}
+	format := img.FormatJPEG
+	if f, _ := img.FormatFromExtension(imageName); thumb.Animated && f == img.FormatGIF {
+		format = img.FormatGIF
+	}
+	// Browsers accept webp for every image, but for still thumbnails jpeg is
+	// smaller, so the Accept header is only used for animated ones.
+	if thumb.Animated || r.URL.Query().Get("format") != "" {
+		if format, err = formatFromRequest(r, format); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	options := fmt.Sprintf("%dx%d %d %t %d %s", thumb.Width, thumb.Height, thumb.Frame, thumb.Animated, thumb.MaxFrames, format)
+	key := thumbnailKey(src, options)
+	thumbName := key + format.Extension()
+	data, err := h.cachedThumbnail(thumbName)
+	if errors.Is(err, storage.ErrNotFound) {
+		data, err = h.generateThumbnail(imageName, thumb, format)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		if err := h.thumbs().Put(thumbName, data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h.removeStaleThumbnails(src)
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("ETag", `"`+key+`"`)
+	// The format can depend on the Accept header.
+	w.Header().Set("Vary", "Accept")
+	// ServeContent takes care of conditional and HEAD requests.
+	http.ServeContent(w, r, "", src.ModTime, bytes.NewReader(data))
+}
+
+// cachedThumbnail reads a thumbnail from the cache, or returns storage.ErrNotFound.
+func (h *MemeHandler) cachedThumbnail(name string) ([]byte, error) {
+	f, err := h.thumbs().Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// generateThumbnail makes a thumbnail of an image, in the given format.
+func (h *MemeHandler) generateThumbnail(imageName string, thumb img.Thumbnail, format img.Format) ([]byte, error) {
+	src, err := h.source(imageName)
+	if err != nil {
+		return nil, err
+	}
+	m, err := src.Meme()
+	if err != nil {
+		return nil, err
+	}
+	if err := m.Thumbnail(thumb); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = m.EncodeAs(&buf, format)
+	return buf.Bytes(), err
+}
@@ -0,0 +1,202 @@
+package api
+
+import (
+	"bytes"
+	"image"
+	"image/gif"
+	_ "image/jpeg"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lavagetto/memeoid/storage"
+	"github.com/stretchr/testify/suite"
+)
+
+type ThumbnailsTestSuite struct {
+	suite.Suite
+	TempDir string
+	Sut     *MemeHandler
+}
+
+func (s *ThumbnailsTestSuite) SetupTest() {
+	tempdir, err := ioutil.TempDir("", "memeoid-api-thumbs")
+	if err != nil {
+		panic(err)
+	}
+	s.TempDir = tempdir
+	s.Sut = &MemeHandler{
+		Images:   storage.NewLocal(baseImgPath, "/gifs/"),
+		Memes:    storage.NewLocal(s.TempDir, "/"+baseMemeUrl+"/"),
+		Thumbs:   storage.NewLocal(path.Join(s.TempDir, "thumbs"), "/thumbs/"),
+		FontName: fontName,
+	}
+}
+
+func (s *ThumbnailsTestSuite) TearDownTest() {
+	os.RemoveAll(s.TempDir)
+}
+
+// get requests the thumbnail of name at the given size, with the given query string and headers.
+func (s *ThumbnailsTestSuite) get(name, size, query string, headers map[string]string) *http.Response {
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/thumb/"+size+"/"+name+"?"+query, strings.NewReader(""))
+	dims := strings.Split(size, "x")
+	req = mux.SetURLVars(req, map[string]string{"width": dims[0], "height": dims[1], "from": name})
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	s.Sut.Preview(rec, req)
+	return rec.Result()
+}
+
+// cached returns the names of the cached thumbnails.
+func (s *ThumbnailsTestSuite) cached() []string {
+	names, err := filepath.Glob(filepath.Join(s.TempDir, "thumbs", "*"))
+	s.Require().Nil(err)
+	return names
+}
+
+func (s *ThumbnailsTestSuite) TestPreview() {
+	var testCases = []struct {
+		Name       string
+		Size       string
+		Query      string
+		StatusCode int
+		Format     string
+		Frames     int
+	}{
+		{"gagarin.gif", "100x100", "", http.StatusOK, "jpeg", 1},
+		{"gagarin.png", "100x100", "", http.StatusOK, "jpeg", 1},
+		{"gagarin.jpg", "100x100", "", http.StatusOK, "jpeg", 1},
+		{"gagarin.gif", "100x100", "frame=0&format=png", http.StatusOK, "png", 1},
+		{"earth.gif", "64x64", "animated=true&frames=3", http.StatusOK, "gif", 3},
+		{"gagarin.png", "64x64", "animated=true", http.StatusOK, "jpeg", 1},
+		{"gagarin.gif", "100x100", "frame=100", http.StatusBadRequest, "", 0},
+		{"gagarin.gif", "100x100", "frame=last", http.StatusBadRequest, "", 0},
+		{"gagarin.gif", "100x100", "frames=0", http.StatusBadRequest, "", 0},
+		{"gagarin.gif", "0x100", "", http.StatusBadRequest, "", 0},
+		{"gagarin.gif", "5000x100", "", http.StatusBadRequest, "", 0},
+		{"lala.gif", "100x100", "", http.StatusNotFound, "", 0},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.Name+" - "+tc.Size+" - "+tc.Query, func() {
+			response := s.get(tc.Name, tc.Size, tc.Query, nil)
+
+			s.Equal(tc.StatusCode, response.StatusCode)
+			if tc.Format == "" {
+				return
+			}
+			defer response.Body.Close()
+			body, err := ioutil.ReadAll(response.Body)
+			s.Require().Nil(err)
+			s.Equal("image/"+tc.Format, response.Header.Get("Content-Type"))
+			cfg, format, err := image.DecodeConfig(bytes.NewReader(body))
+			s.Require().Nil(err, "the thumbnail should be a valid image: %v", err)
+			s.Equal(tc.Format, format)
+			s.True(cfg.Width <= 100 && cfg.Height <= 100, "the thumbnail is too large: %dx%d", cfg.Width, cfg.Height)
+			if format == "gif" {
+				g, err := gif.DecodeAll(bytes.NewReader(body))
+				s.Require().Nil(err)
+				s.Len(g.Image, tc.Frames)
+			}
+		})
+	}
+}
+
+// TestBrowserAccept checks that browsers, which accept webp for every image, still
+// get jpeg for still thumbnails.
+func (s *ThumbnailsTestSuite) TestBrowserAccept() {
+	accept := map[string]string{"Accept": "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8"}
+	var testCases = []struct {
+		Query       string
+		ContentType string
+	}{
+		{"", "image/jpeg"},
+		{"frame=2", "image/jpeg"},
+		{"format=png", "image/png"},
+		{"animated=true", "image/webp"},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.Query, func() {
+			response := s.get("earth.gif", "64x64", tc.Query, accept)
+
+			s.Equal(http.StatusOK, response.StatusCode)
+			s.Equal(tc.ContentType, response.Header.Get("Content-Type"))
+		})
+	}
+}
+
+func (s *ThumbnailsTestSuite) TestConditional() {
+	response := s.get("gagarin.png", "64x64", "", nil)
+	s.Require().Equal(http.StatusOK, response.StatusCode)
+	etag := response.Header.Get("ETag")
+	s.NotEmpty(etag)
+	lastModified := response.Header.Get("Last-Modified")
+	s.NotEmpty(lastModified)
+
+	response = s.get("gagarin.png", "64x64", "", map[string]string{"If-None-Match": etag})
+	s.Equal(http.StatusNotModified, response.StatusCode)
+
+	response = s.get("gagarin.png", "64x64", "", map[string]string{"If-Modified-Since": lastModified})
+	s.Equal(http.StatusNotModified, response.StatusCode)
+
+	// Other sizes are different thumbnails.
+	response = s.get("gagarin.png", "32x32", "", map[string]string{"If-None-Match": etag})
+	s.Equal(http.StatusOK, response.StatusCode)
+	s.NotEqual(etag, response.Header.Get("ETag"))
+	s.Len(s.cached(), 2)
+}
+
+func (s *ThumbnailsTestSuite) TestInvalidation() {
+	// Work on a copy of the image, so that we can change it.
+	s.Sut.Images = storage.NewLocal(s.TempDir, "/gifs/")
+	data, err := ioutil.ReadFile(path.Join(baseImgPath, "gagarin.png"))
+	s.Require().Nil(err)
+	imgPath := path.Join(s.TempDir, "gagarin.png")
+	s.Require().Nil(ioutil.WriteFile(imgPath, data, 0644))
+
+	response := s.get("gagarin.png", "64x64", "", nil)
+	s.Require().Equal(http.StatusOK, response.StatusCode)
+	etag := response.Header.Get("ETag")
+	s.Len(s.cached(), 1)
+	// A second request uses the cache.
+	response = s.get("gagarin.png", "64x64", "", nil)
+	s.Equal(etag, response.Header.Get("ETag"))
+	s.Len(s.cached(), 1)
+
+	later := time.Now().Add(time.Hour)
+	s.Require().Nil(os.Chtimes(imgPath, later, later))
+
+	response = s.get("gagarin.png", "64x64", "", map[string]string{"If-None-Match": etag})
+	s.Equal(http.StatusOK, response.StatusCode, "the thumbnail should be generated again")
+	s.NotEqual(etag, response.Header.Get("ETag"))
+	s.Len(s.cached(), 1, "the old thumbnail should be removed")
+}
+
+func (s *ThumbnailsTestSuite) TestEvicted() {
+	// The cache only fits one byte, so that cleaning it removes everything.
+	cache := storage.NewCache(s.Sut.Thumbs, 1, 0)
+	s.Sut.Thumbs = cache
+	s.Require().Equal(http.StatusOK, s.get("gagarin.png", "64x64", "", nil).StatusCode)
+	s.Len(s.cached(), 1)
+
+	report, err := cache.Clean()
+
+	s.Nil(err)
+	s.Equal(1, report.Evicted)
+	s.Empty(s.cached())
+	s.Equal(http.StatusOK, s.get("gagarin.png", "64x64", "", nil).StatusCode, "evicted thumbnails should be generated again")
+	s.Len(s.cached(), 1)
+}
+
+func TestThumbnailsTestSuite(t *testing.T) {
+	suite.Run(t, new(ThumbnailsTestSuite))
+}
@@ -18,9 +18,10 @@ limitations under the License.
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
-
-	"image/gif"
+	"path/filepath"
+	"strings"
 
 	"github.com/lavagetto/memeoid/img"
 	homedir "github.com/mitchellh/go-homedir"
@@ -34,6 +35,25 @@ var topText string
 var bottomText string
 var outFile string
 var fontName string
+var text []string
+var templateFile string
+var workers int
+var renderMode string
+var dither bool
+var outFormat string
+var optimize bool
+var limits img.Limits
+var resizeWidth int
+var cropRect string
+var speed float64
+var reverse bool
+var boomerang bool
+var trimFrames string
+var fillColor string
+var strokeColor string
+var strokeWidth float64
+var align string
+var valign string
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
@@ -41,36 +61,155 @@ var rootCmd = &cobra.Command{
 	Short: "A non-cloud-native meme generator",
 	Long: `Memeoid is a simple CLI or HTTP meme generator.
   	 Currently only CLI works, and it's extremely crude!`,
-	Run: func(cmd *cobra.Command, args []string) {
-		meme, err := img.MemeFromFile(
-			gifPath,
-			topText,
-			bottomText,
-			fontName,
-		)
+	// Errors are reported by Execute, and they're not about usage most of the time.
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		style, err := textStyle(cmd)
+		if err != nil {
+			return err
+		}
+		meme, err := loadMeme(style)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		// Uncomment for debugging
 		/*
 			meme.GifMetaData()
 			return
 		*/
-		err = meme.Generate()
+		mode, err := img.ParseRenderMode(renderMode)
+		if err != nil {
+			return err
+		}
+		transform, err := imageTransform()
 		if err != nil {
-			panic(err)
+			return err
 		}
-		out, err := os.Create(outFile)
+		path, format, err := output(cmd, meme.Format)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		err = gif.EncodeAll(out, meme.Gif)
+		data, err := img.EncodeWithin(limits, format, func(l img.Limits) (*img.Meme, error) {
+			// Every attempt needs a fresh copy of the image.
+			if meme == nil {
+				if meme, err = loadMeme(style); err != nil {
+					return nil, err
+				}
+			}
+			m := meme
+			meme = nil
+			m.Workers = workers
+			m.Dither = dither
+			m.Mode = mode
+			if err := m.Transform(transform); err != nil {
+				return nil, err
+			}
+			if err := m.Constrain(l); err != nil {
+				return nil, err
+			}
+			if err := m.Generate(); err != nil {
+				return nil, err
+			}
+			if optimize && format == img.FormatGIF {
+				report, err := m.Optimize()
+				if err != nil {
+					return nil, err
+				}
+				fmt.Println("Optimized the gif:", report)
+			}
+			return m, nil
+		})
 		if err != nil {
-			panic(err)
+			return err
 		}
+		return ioutil.WriteFile(path, data, 0644)
 	},
 }
 
+// output returns the file to save the meme to, and its format. The format is the one
+// set with --format, else the one matching the extension of --out, else the one
+// of the base image. Unless it was set explicitly, the extension of the file
+// matches the format.
+func output(cmd *cobra.Command, native img.Format) (string, img.Format, error) {
+	format := native
+	if format == "" {
+		format = img.FormatGIF
+	}
+	if outFormat != "" {
+		f, err := img.ParseFormat(outFormat)
+		if err != nil {
+			return "", "", err
+		}
+		format = f
+	} else if f, ok := img.FormatFromExtension(outFile); ok && cmd.Flags().Changed("out") {
+		format = f
+	}
+	if !cmd.Flags().Changed("out") {
+		return strings.TrimSuffix(outFile, filepath.Ext(outFile)) + format.Extension(), format, nil
+	}
+	if f, ok := img.FormatFromExtension(outFile); !ok || f.Extension() != format.Extension() {
+		return "", "", fmt.Errorf("a %s meme can't be saved to %s", format, outFile)
+	}
+	return outFile, format, nil
+}
+
+// imageTransform returns the changes to the image set on the command line
+func imageTransform() (img.Transform, error) {
+	t := img.Transform{Width: resizeWidth, Speed: speed, Reverse: reverse, Boomerang: boomerang}
+	var err error
+	if cropRect != "" {
+		if t.Crop, err = img.ParseRect(cropRect); err != nil {
+			return t, err
+		}
+	}
+	if trimFrames != "" {
+		if t.Trim, err = img.ParseFrameRange(trimFrames); err != nil {
+			return t, err
+		}
+	}
+	return t, nil
+}
+
+// textStyle returns the text style set on the command line
+func textStyle(cmd *cobra.Command) (img.TextStyle, error) {
+	style := img.TextStyle{
+		Fill:   fillColor,
+		Stroke: strokeColor,
+		Align:  img.Alignment(align),
+		VAlign: img.Anchor(valign),
+	}
+	if cmd.Flags().Changed("stroke-width") {
+		style.StrokeWidth = &strokeWidth
+	}
+	return style, style.Validate()
+}
+
+// loadMeme builds the meme from either the template or the gif, with the text from the command line
+func loadMeme(style img.TextStyle) (*img.Meme, error) {
+	if len(text) > 0 && (topText != "" || bottomText != "") {
+		return nil, fmt.Errorf("use either --top and --bottom or --text, not both")
+	}
+	if templateFile != "" {
+		tpl, err := img.LoadTemplate(templateFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(text) == 0 {
+			return nil, fmt.Errorf("template %s needs %d --text flags", tpl.Name(), tpl.NumBoxes())
+		}
+		return tpl.WithStyle(style).GetMeme(text...)
+	}
+	tpl, err := img.SimpleTemplate(gifPath, fontName, 52.0, 8.0)
+	if err != nil {
+		return nil, err
+	}
+	if len(text) == 0 {
+		return tpl.WithStyle(style).GetMeme(topText, bottomText)
+	}
+	return tpl.WithStyle(style).GetMeme(text...)
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -88,10 +227,32 @@ func init() {
 	// will be global for your application.
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.memeoid.yaml)")
-	rootCmd.Flags().StringVar(&gifPath, "gif", "homer.gif", "The gif to use as a base for your meme")
+	rootCmd.Flags().StringVar(&gifPath, "gif", "homer.gif", "The gif, png or jpeg image to use as a base for your meme")
 	rootCmd.Flags().StringVarP(&topText, "top", "t", "", "The text to add at the top")
 	rootCmd.Flags().StringVarP(&bottomText, "bottom", "b", "", "The text to insert at the bottom")
-	rootCmd.Flags().StringVarP(&outFile, "out", "o", "meme.gif", "File to output to.")
+	rootCmd.Flags().StringArrayVar(&text, "text", nil, "Text to add to the boxes, in order. Repeat the flag for every box")
+	rootCmd.Flags().StringVar(&templateFile, "template", "", "A meme template file to use instead of --gif")
+	rootCmd.Flags().StringVar(&fillColor, "fill", "", "Color of the text, in hex notation (default: #FFF)")
+	rootCmd.Flags().StringVar(&strokeColor, "stroke", "", "Color of the text outline, in hex notation (default: #000)")
+	rootCmd.Flags().Float64Var(&strokeWidth, "stroke-width", 0, "Width of the text outline, in pixels. 0 removes the outline (default: proportional to the font size)")
+	rootCmd.Flags().StringVar(&align, "align", "", "Horizontal alignment of the text: left, center or right")
+	rootCmd.Flags().StringVar(&valign, "valign", "", "Vertical position of the text in the boxes: top, middle or bottom")
+	rootCmd.Flags().IntVar(&resizeWidth, "width", 0, "Resize the image to this width, keeping the aspect ratio")
+	rootCmd.Flags().StringVar(&cropRect, "crop", "", "Crop the image to the x,y,width,height rectangle")
+	rootCmd.Flags().Float64Var(&speed, "speed", 0, "Multiply the speed of the animation, e.g. 2 plays it twice as fast")
+	rootCmd.Flags().BoolVar(&reverse, "reverse", false, "Play the animation backwards")
+	rootCmd.Flags().BoolVar(&boomerang, "boomerang", false, "Play the animation forwards, then backwards")
+	rootCmd.Flags().StringVar(&trimFrames, "trim", "", "Only keep frames start:end of the animation, the end excluded")
+	rootCmd.Flags().StringVarP(&outFile, "out", "o", "meme.gif", "File to output to. Its extension sets the format, unless --format is used")
+	rootCmd.Flags().StringVar(&outFormat, "format", "", "Format to save the meme in: gif, apng, webp, png, jpeg, or frames for a zip of png frames (default: the format of the base image)")
+	rootCmd.PersistentFlags().StringVar(&renderMode, "render-mode", string(img.RenderFull), "How to draw the text: 'full' redraws every frame, 'regions' only the areas that change, for smaller gifs")
+	rootCmd.PersistentFlags().BoolVar(&dither, "dither", false, "Dither the frames when adding the text; smoother gradients, but larger gifs")
+	rootCmd.PersistentFlags().BoolVar(&optimize, "optimize", false, "Shrink gifs by only storing what changes between frames, and dropping repeated ones")
+	rootCmd.PersistentFlags().IntVar(&limits.MaxWidth, "max-width", 0, "Scale down memes wider than this, in pixels (default: no limit)")
+	rootCmd.PersistentFlags().IntVar(&limits.MaxHeight, "max-height", 0, "Scale down memes taller than this, in pixels (default: no limit)")
+	rootCmd.PersistentFlags().IntVar(&limits.MaxFrames, "max-frames", 0, "Drop frames evenly from animations longer than this (default: no limit)")
+	rootCmd.PersistentFlags().IntVar(&limits.MaxBytes, "max-bytes", 0, "Shrink memes until their file is at most this large, or fail (default: no limit)")
+	rootCmd.PersistentFlags().IntVar(&workers, "workers", 0, "Number of frames to render in parallel (default: the number of CPUs)")
 	rootCmd.PersistentFlags().StringVarP(&fontName, "font", "f", "DejaVuSans", "Name of the ttf font on your system you want to use (default: impact).")
 }
 
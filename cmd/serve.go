@@ -20,9 +20,16 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/lavagetto/memeoid/api"
+	"github.com/lavagetto/memeoid/img"
+	"github.com/lavagetto/memeoid/lru"
+	"github.com/lavagetto/memeoid/storage"
 	"github.com/spf13/cobra"
 
 	"github.com/gorilla/handlers"
@@ -35,28 +42,88 @@ import (
 
 var gifDir string
 var memeDir string
+var thumbDir string
 var port int
 var tplPath string
 var certPath string
+var memeTplDir string
+var uploadToken string
+var storageKind string
+var s3Endpoint string
+var s3Region string
+var s3Bucket string
+var s3PublicURL string
+var cacheSize int64
+var cacheMaxAge time.Duration
+var cacheInterval time.Duration
+var thumbCacheSize int64
+var thumbCacheMaxAge time.Duration
+var sourceCacheSize int64
+var renderedCacheSize int64
+var direct bool
 
 // serveCmd represents the serve command
 var serveCmd = &cobra.Command{
 	Use:   "serve",
 	Short: "An http server to generate memes on request.",
-	Long:  `At the moment memeoid only works with a local filesystem.`,
+	Long: `Images, memes and thumbnails are stored on the local filesystem, or in an
+S3-compatible bucket shared by all the replicas of the server.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		mode, err := img.ParseRenderMode(renderMode)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if cacheInterval <= 0 {
+			fmt.Println("--meme-cache-interval must be positive")
+			os.Exit(1)
+		}
+		// Accesses are tracked by each process, and hits on the bucket don't reach us.
+		if storageKind != "local" && (cacheSize > 0 || cacheMaxAge > 0) {
+			fmt.Println("--meme-cache-size and --meme-cache-max-age only work with local storage: use a lifecycle rule to expire memes in the bucket")
+			os.Exit(1)
+		}
+		if storageKind != "local" && (cmd.Flags().Changed("thumb-cache-size") || cmd.Flags().Changed("thumb-cache-max-age")) {
+			fmt.Println("--thumb-cache-size and --thumb-cache-max-age only work with local storage: use a lifecycle rule to expire thumbnails in the bucket")
+			os.Exit(1)
+		}
+		images, memes, thumbs, err := storages()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if cacheSize > 0 || cacheMaxAge > 0 {
+			memes = diskCache("memes", memes, cacheSize, cacheMaxAge)
+		}
+		// Any client can ask for thumbnails of any size, so they're limited by default.
+		if storageKind == "local" && (thumbCacheSize > 0 || thumbCacheMaxAge > 0) {
+			thumbs = diskCache("thumbs", thumbs, thumbCacheSize, thumbCacheMaxAge)
+		}
+		registry := img.NewRegistry(memeTplDir)
+		loadRegistry(registry)
 		ctl := api.Controller{
 			Handler: &api.MemeHandler{
-				ImgPath:    gifDir,
-				OutputPath: memeDir,
-				FontName:   fontName,
-				MemeURL:    "meme",
+				Images:      images,
+				Memes:       memes,
+				Thumbs:      thumbs,
+				FontName:    fontName,
+				Registry:    registry,
+				UploadToken: uploadToken,
+				Workers:     workers,
+				RenderMode:  mode,
+				Dither:      dither,
+				Optimize:    optimize,
+				OnOptimize:  observeOptimize,
+				Limits:      limits,
+				Direct:      direct,
+				Sources:     memoryCache("sources", sourceCacheSize),
+				Rendered:    memoryCache("rendered", renderedCacheSize),
 			},
 			Router: mux.NewRouter(),
 		}
 
-		ctl.StaticRoute("/gifs/", gifDir)
-		ctl.StaticRoute("/meme/", memeDir)
+		ctl.StorageRoute("/gifs/", images)
+		ctl.MemeRoute("/meme/")
 		ctl.Load(tplPath)
 		// Add prometheus metrics
 		ctl.Router.Use(telemetryMiddleware)
@@ -79,6 +146,100 @@ var serveCmd = &cobra.Command{
 	},
 }
 
+// storages returns where images, memes and thumbnails are stored.
+func storages() (images, memes, thumbs storage.Storage, err error) {
+	switch storageKind {
+	case "local":
+		thumbs := thumbDir
+		if thumbs == "" {
+			thumbs = path.Join(memeDir, "thumbs")
+		}
+		return storage.NewLocal(gifDir, "/gifs/"), storage.NewLocal(memeDir, "/meme/"), storage.NewLocal(thumbs, "/thumbs/"), nil
+	case "s3":
+		if s3Bucket == "" {
+			return nil, nil, nil, fmt.Errorf("--s3-bucket is required")
+		}
+		// Credentials are read from the environment, like the AWS tools do.
+		bucket := func(prefix string) *storage.S3 {
+			s := &storage.S3{
+				Endpoint:  s3Endpoint,
+				Region:    s3Region,
+				Bucket:    s3Bucket,
+				Prefix:    prefix,
+				AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+				SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+				Client:    &http.Client{Timeout: 30 * time.Second},
+			}
+			if s3PublicURL != "" {
+				s.PublicURL = strings.TrimSuffix(s3PublicURL, "/") + "/" + prefix
+			}
+			return s
+		}
+		return bucket("images/"), bucket("memes/"), bucket("thumbs/"), nil
+	default:
+		return nil, nil, nil, fmt.Errorf("unknown storage '%s': use local or s3", storageKind)
+	}
+}
+
+// loadRegistry loads the meme templates, and reloads them whenever we receive a SIGHUP.
+func loadRegistry(registry *img.Registry) {
+	if err := registry.Load(); err != nil {
+		fmt.Printf("Error loading meme templates from %s: %v\n", registry.Dir, err)
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			fmt.Println("Reloading meme templates")
+			if err := registry.Load(); err != nil {
+				fmt.Printf("Error loading meme templates from %s: %v\n", registry.Dir, err)
+			}
+		}
+	}()
+}
+
+// memoryCache returns an in-memory cache of the given size, or nil if the size is 0.
+func memoryCache(name string, size int64) *lru.Cache {
+	if size <= 0 {
+		return nil
+	}
+	cache := lru.New(size)
+	cache.OnLookup = func(hit bool) {
+		result := "miss"
+		if hit {
+			result = "hit"
+		}
+		memoryCacheLookups.WithLabelValues(name, result).Inc()
+	}
+	return cache
+}
+
+// diskCache returns a cache of the files in s with the given limits, cleaned up
+// in the background every --meme-cache-interval.
+func diskCache(name string, s storage.Storage, size int64, maxAge time.Duration) *storage.Cache {
+	cache := storage.NewCache(s, size, maxAge)
+	cache.OnClean = func(report storage.CleanReport) {
+		cacheBytes.WithLabelValues(name).Set(float64(report.Bytes))
+		cacheFiles.WithLabelValues(name).Set(float64(report.Files))
+		cacheEvictions.WithLabelValues(name).Add(float64(report.Evicted))
+	}
+	startJanitor(name, cache, cacheInterval)
+	return cache
+}
+
+// startJanitor cleans up the cache now, and then at every interval.
+func startJanitor(name string, cache *storage.Cache, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for {
+			if _, err := cache.Clean(); err != nil {
+				fmt.Printf("Error cleaning up the %s cache: %v\n", name, err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
 var httpDuration = promauto.NewHistogramVec(
 	prometheus.HistogramOpts{
 		Name: "memeoid_http_duration_seconds",
@@ -87,6 +248,51 @@ var httpDuration = promauto.NewHistogramVec(
 	[]string{"path", "gif"},
 )
 
+var optimizedBytes = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "memeoid_gif_optimize_bytes_total",
+		Help: "Size of the generated gifs before and after optimizing them",
+	},
+	[]string{"stage"},
+)
+
+func observeOptimize(report img.OptimizeReport) {
+	optimizedBytes.WithLabelValues("before").Add(float64(report.BytesBefore))
+	optimizedBytes.WithLabelValues("after").Add(float64(report.BytesAfter))
+}
+
+var cacheBytes = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "memeoid_disk_cache_bytes",
+		Help: "Total size of the generated memes and thumbnails",
+	},
+	[]string{"cache"},
+)
+
+var cacheFiles = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "memeoid_disk_cache_files",
+		Help: "Number of generated memes and thumbnails",
+	},
+	[]string{"cache"},
+)
+
+var cacheEvictions = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "memeoid_disk_cache_evictions_total",
+		Help: "Generated memes and thumbnails removed to stay within the cache limits",
+	},
+	[]string{"cache"},
+)
+
+var memoryCacheLookups = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "memeoid_memory_cache_lookups_total",
+		Help: "Lookups in the in-memory caches of decoded images and rendered memes",
+	},
+	[]string{"cache", "result"},
+)
+
 func telemetryMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
@@ -96,6 +302,8 @@ func telemetryMiddleware(next http.Handler) http.Handler {
 			gif := "-"
 			if g, ok := v["from"]; ok {
 				gif = g
+			} else if t, ok := v["template"]; ok {
+				gif = t
 			}
 			timer := prometheus.NewTimer(httpDuration.WithLabelValues(path, gif))
 			next.ServeHTTP(w, r)
@@ -119,7 +327,23 @@ func init() {
 	// flags and configuration settings.
 	serveCmd.Flags().StringVarP(&gifDir, "image-dir", "i", "./fixtures", "The directory where base gifs are stored")
 	serveCmd.Flags().StringVarP(&memeDir, "meme-dir", "m", "./memes", "The directory where memes are stored")
+	serveCmd.Flags().StringVar(&thumbDir, "thumb-dir", "", "The directory where thumbnails are cached (default: the thumbs directory in --meme-dir)")
 	serveCmd.Flags().IntVarP(&port, "port", "p", 3000, "The port to listen on")
 	serveCmd.Flags().StringVar(&tplPath, "templates", "./templates", "Path to the teplate directory")
+	serveCmd.Flags().StringVar(&memeTplDir, "meme-templates", "./meme-templates", "The directory where meme templates are stored. Send SIGHUP to reload them")
+	serveCmd.Flags().StringVar(&uploadToken, "upload-token", "", "The bearer token needed to upload new templates. Uploads are disabled if empty")
+	serveCmd.Flags().StringVar(&storageKind, "storage", "local", "Where to store images, memes and thumbnails: local, in the directories above, or s3")
+	serveCmd.Flags().StringVar(&s3Endpoint, "s3-endpoint", "https://s3.amazonaws.com", "The url of the S3-compatible service, e.g. http://minio:9000")
+	serveCmd.Flags().StringVar(&s3Region, "s3-region", "us-east-1", "The region of the S3 bucket")
+	serveCmd.Flags().StringVar(&s3Bucket, "s3-bucket", "", "The S3 bucket, with images under images/, memes under memes/ and thumbnails under thumbs/")
+	serveCmd.Flags().StringVar(&s3PublicURL, "s3-public-url", "", "The url the bucket is publicly served at, e.g. by a CDN (default: the bucket url)")
+	serveCmd.Flags().Int64Var(&cacheSize, "meme-cache-size", 0, "Remove the least recently used memes when they take more than this many bytes (default: no limit). Local storage only")
+	serveCmd.Flags().DurationVar(&cacheMaxAge, "meme-cache-max-age", 0, "Remove the memes that weren't used for this long, e.g. 720h (default: never). Local storage only")
+	serveCmd.Flags().DurationVar(&cacheInterval, "meme-cache-interval", 10*time.Minute, "How often to check the meme and thumbnail cache limits")
+	serveCmd.Flags().Int64Var(&thumbCacheSize, "thumb-cache-size", 256<<20, "Remove the least recently used thumbnails when they take more than this many bytes. 0 means no limit. Local storage only")
+	serveCmd.Flags().DurationVar(&thumbCacheMaxAge, "thumb-cache-max-age", 0, "Remove the thumbnails that weren't used for this long, e.g. 720h (default: never). Local storage only")
+	serveCmd.Flags().Int64Var(&sourceCacheSize, "source-cache-size", 256<<20, "Bytes of memory used to keep the most used images decoded. 0 disables the cache")
+	serveCmd.Flags().Int64Var(&renderedCacheSize, "rendered-cache-size", 64<<20, "Bytes of memory used to keep the most used memes. 0 disables the cache")
+	serveCmd.Flags().BoolVar(&direct, "direct", false, "Send memes in the response instead of redirecting to them. The direct query parameter overrides it")
 	serveCmd.Flags().StringVar(&certPath, "certpath", "", "Set this to your letsencrypt directory if you want TLS to work")
 }
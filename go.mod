@@ -5,7 +5,7 @@ go 1.14
 require (
 	github.com/flopp/go-findfont v0.0.0-20200805110358-089b91d05de8
 	github.com/fogleman/gg v1.3.0
-	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
+	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0
 	github.com/gorilla/handlers v1.5.1
 	github.com/gorilla/mux v1.8.0
 	github.com/mitchellh/go-homedir v1.1.0
@@ -14,4 +14,6 @@ require (
 	github.com/spf13/cobra v1.0.0
 	github.com/spf13/viper v1.7.0
 	github.com/stretchr/testify v1.3.0
+	golang.org/x/image v0.0.0-20190802002840-cff245a6509b
+	gopkg.in/yaml.v2 v2.2.4
 )
@@ -0,0 +1,193 @@
+package img
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"io"
+)
+
+// APNG is a PNG with a few more chunks describing the animation, see
+// https://wiki.mozilla.org/APNG_Specification. Frames are always stored
+// as 8-bit RGBA; the first one doubles as the image shown by viewers that
+// don't support animations.
+
+const pngHeader = "\x89PNG\r\n\x1a\n"
+
+// apngWriter writes the chunks of an APNG file.
+type apngWriter struct {
+	w   *bufio.Writer
+	seq uint32
+	err error
+}
+
+func (a *apngWriter) chunk(name string, data []byte) {
+	if a.err != nil {
+		return
+	}
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+	copy(header[4:], name)
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+	var footer [4]byte
+	binary.BigEndian.PutUint32(footer[:], crc.Sum32())
+	for _, b := range [][]byte{header[:], data, footer[:]} {
+		if _, a.err = a.w.Write(b); a.err != nil {
+			return
+		}
+	}
+}
+
+// frameControl writes the fcTL chunk for a frame.
+func (a *apngWriter) frameControl(r image.Rectangle, delay int) {
+	data := make([]byte, 26)
+	binary.BigEndian.PutUint32(data[0:], a.seq)
+	binary.BigEndian.PutUint32(data[4:], uint32(r.Dx()))
+	binary.BigEndian.PutUint32(data[8:], uint32(r.Dy()))
+	binary.BigEndian.PutUint32(data[12:], uint32(r.Min.X))
+	binary.BigEndian.PutUint32(data[16:], uint32(r.Min.Y))
+	binary.BigEndian.PutUint16(data[20:], uint16(delay))
+	binary.BigEndian.PutUint16(data[22:], 100)
+	// Dispose op "none", and blend op "source": the frame replaces what's beneath.
+	data[24], data[25] = 0, 0
+	a.seq++
+	a.chunk("fcTL", data)
+}
+
+func encodeAPNG(w io.Writer, m *Meme) error {
+	bounds, frames := m.animation(false)
+	a := apngWriter{w: bufio.NewWriter(w)}
+	if _, err := io.WriteString(a.w, pngHeader); err != nil {
+		return err
+	}
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(bounds.Dx()))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(bounds.Dy()))
+	// 8 bits per channel, truecolor with alpha, no interlacing.
+	ihdr[8], ihdr[9] = 8, 6
+	a.chunk("IHDR", ihdr)
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl[0:], uint32(len(frames)))
+	binary.BigEndian.PutUint32(actl[4:], uint32(m.loops()))
+	a.chunk("acTL", actl)
+	for i, frame := range frames {
+		a.frameControl(frame.img.Rect.Sub(bounds.Min), frame.delay)
+		data, err := pngImageData(frame.img)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			a.chunk("IDAT", data)
+			continue
+		}
+		fdat := make([]byte, 4+len(data))
+		binary.BigEndian.PutUint32(fdat, a.seq)
+		copy(fdat[4:], data)
+		a.seq++
+		a.chunk("fdAT", fdat)
+	}
+	a.chunk("IEND", nil)
+	if a.err != nil {
+		return a.err
+	}
+	return a.w.Flush()
+}
+
+// pngImageData returns the compressed scanlines of an image, as stored in IDAT chunks.
+func pngImageData(img *image.NRGBA) ([]byte, error) {
+	var buf bytes.Buffer
+	z, err := zlib.NewWriterLevel(&buf, zlib.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	width := 4 * img.Rect.Dx()
+	prev := make([]byte, width)
+	// One buffer per filter type, each starting with the type byte.
+	var filtered [5][]byte
+	for f := range filtered {
+		filtered[f] = make([]byte, width+1)
+		filtered[f][0] = byte(f)
+	}
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(img.Rect.Min.X, y):][:width]
+		if _, err := z.Write(filterRow(filtered, row, prev)); err != nil {
+			return nil, err
+		}
+		prev = row
+	}
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// filterRow applies all the PNG filters to a row, and returns the one
+// whose output has the smallest sum of absolute values, which is the heuristic
+// suggested by the PNG specification.
+func filterRow(filtered [5][]byte, row, prev []byte) []byte {
+	const bpp = 4
+	for i := range row {
+		var left, upLeft byte
+		if i >= bpp {
+			left, upLeft = row[i-bpp], prev[i-bpp]
+		}
+		up := prev[i]
+		filtered[0][i+1] = row[i]
+		filtered[1][i+1] = row[i] - left
+		filtered[2][i+1] = row[i] - up
+		filtered[3][i+1] = row[i] - byte((int(left)+int(up))/2)
+		filtered[4][i+1] = row[i] - paeth(left, up, upLeft)
+	}
+	best, bestSum := 0, -1
+	for f, data := range filtered {
+		sum := 0
+		for _, b := range data[1:] {
+			sum += absInt(int(int8(b)))
+		}
+		if bestSum < 0 || sum < bestSum {
+			best, bestSum = f, sum
+		}
+	}
+	return filtered[best]
+}
+
+// paeth is the Paeth predictor from the PNG specification.
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := absInt(p-int(a)), absInt(p-int(b)), absInt(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func absInt(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,95 @@
+package img
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"image"
+	"image/draw"
+	"image/gif"
+)
+
+// canvasBounds returns the logical screen of the gif. If it's not set, as it happens
+// for gifs built in memory, it's the smallest rectangle containing all the frames.
+func canvasBounds(g *gif.GIF) image.Rectangle {
+	if g.Config.Width > 0 && g.Config.Height > 0 {
+		return image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	}
+	var bounds image.Rectangle
+	for _, frame := range g.Image {
+		bounds = bounds.Union(frame.Bounds())
+	}
+	return bounds
+}
+
+// Compositor renders the frames of a gif the way a viewer would display
+// them, following the disposal method of each frame as defined in GIF89a.
+type Compositor struct {
+	g      *gif.GIF
+	canvas *image.RGBA
+	// saved is the content of the canvas to restore for DisposalPrevious
+	saved *image.RGBA
+	// next is the index of the next frame to render
+	next int
+}
+
+// NewCompositor returns a Compositor for g, with an empty canvas.
+func NewCompositor(g *gif.GIF) *Compositor {
+	return &Compositor{g: g, canvas: image.NewRGBA(canvasBounds(g))}
+}
+
+// Disposal returns the disposal method of frame i.
+func (c *Compositor) Disposal(i int) byte {
+	if i < len(c.g.Disposal) {
+		return c.g.Disposal[i]
+	}
+	return gif.DisposalNone
+}
+
+// Next renders the next frame on top of the canvas, and returns the canvas
+// as displayed with that frame, together with the frame index. The returned image
+// is only valid until the next call. It returns nil when all frames have been rendered.
+func (c *Compositor) Next() (*image.RGBA, int) {
+	i := c.next
+	if i >= len(c.g.Image) {
+		return nil, i
+	}
+	// First dispose of the previous frame
+	if i > 0 {
+		prev := c.g.Image[i-1].Bounds()
+		switch c.Disposal(i - 1) {
+		case gif.DisposalBackground:
+			// Everyone, browsers included, clears to transparent rather than to the
+			// background color.
+			draw.Draw(c.canvas, prev, image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			if c.saved != nil {
+				draw.Draw(c.canvas, prev, c.saved, prev.Min, draw.Src)
+			}
+		}
+	}
+	frame := c.g.Image[i]
+	if c.Disposal(i) == gif.DisposalPrevious {
+		if c.saved == nil {
+			c.saved = image.NewRGBA(c.canvas.Bounds())
+		}
+		draw.Draw(c.saved, frame.Bounds(), c.canvas, frame.Bounds().Min, draw.Src)
+	}
+	// Transparent pixels leave the canvas untouched.
+	draw.Draw(c.canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+	c.next++
+	return c.canvas, i
+}
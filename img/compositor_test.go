@@ -0,0 +1,141 @@
+package img
+
+import (
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type CompositorTestSuite struct {
+	suite.Suite
+}
+
+var (
+	red   = color.RGBA{0xff, 0, 0, 0xff}
+	green = color.RGBA{0, 0xff, 0, 0xff}
+	blue  = color.RGBA{0, 0, 0xff, 0xff}
+)
+
+// solidFrame returns a frame of a single color.
+func solidFrame(r image.Rectangle, c color.Color) *image.Paletted {
+	frame := image.NewPaletted(r, color.Palette{image.Transparent, red, green, blue})
+	for x := r.Min.X; x < r.Max.X; x++ {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			frame.Set(x, y, c)
+		}
+	}
+	return frame
+}
+
+func (s *CompositorTestSuite) TestDisposal() {
+	var testCases = []struct {
+		name     string
+		disposal byte
+		// expected color at (1, 1), in the second and third frames
+		expected []color.RGBA
+	}{
+		{"none", gif.DisposalNone, []color.RGBA{green, blue}},
+		{"background", gif.DisposalBackground, []color.RGBA{green, {}}},
+		{"previous", gif.DisposalPrevious, []color.RGBA{green, red}},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			g := &gif.GIF{
+				Image: []*image.Paletted{
+					solidFrame(image.Rect(0, 0, 4, 4), red),
+					solidFrame(image.Rect(0, 0, 2, 2), green),
+					solidFrame(image.Rect(2, 2, 4, 4), blue),
+				},
+				Disposal: []byte{gif.DisposalNone, tc.disposal, tc.disposal},
+			}
+			// The third frame needs to be on the same pixel for "none"
+			if tc.disposal == gif.DisposalNone {
+				g.Image[2] = solidFrame(image.Rect(1, 1, 2, 2), blue)
+			}
+			comp := NewCompositor(g)
+			canvas, i := comp.Next()
+			s.Equal(0, i)
+			s.Equal(red, canvas.RGBAAt(1, 1))
+			for n, expected := range tc.expected {
+				canvas, i = comp.Next()
+				s.Equal(n+1, i)
+				s.Equal(expected, canvas.RGBAAt(1, 1), "frame %d", i)
+				s.Equal(image.Rect(0, 0, 4, 4), canvas.Bounds())
+			}
+			canvas, _ = comp.Next()
+			s.Nil(canvas)
+		})
+	}
+}
+
+func (s *CompositorTestSuite) TestCanvasBounds() {
+	g := &gif.GIF{Image: []*image.Paletted{solidFrame(image.Rect(2, 2, 5, 5), red), solidFrame(image.Rect(0, 1, 3, 3), red)}}
+	s.Equal(image.Rect(0, 1, 5, 5), canvasBounds(g))
+	g.Config = image.Config{Width: 10, Height: 8}
+	s.Equal(image.Rect(0, 0, 10, 8), canvasBounds(g))
+}
+
+// disposalCases describe the fixture gifs: a red background, a green square with
+// a transparent hole disposed of with the given method, and a small blue square.
+var disposalCases = []struct {
+	name string
+	// expected color at (15, 15) in the third frame
+	expected color.RGBA
+}{
+	{"none", green},
+	{"background", color.RGBA{}},
+	{"previous", red},
+}
+
+func loadFixture(path string) *gif.GIF {
+	f, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	g, err := gif.DecodeAll(f)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+func (s *CompositorTestSuite) TestFixtures() {
+	for _, tc := range disposalCases {
+		s.Run(tc.name, func() {
+			frames := composite(loadFixture("fixtures/disposal/" + tc.name + ".gif"))
+
+			s.Len(frames, 3)
+			s.Equal(green, frames[1].RGBAAt(15, 15))
+			s.Equal(red, frames[1].RGBAAt(20, 20), "transparent pixels should show the frame beneath")
+			s.Equal(blue, frames[2].RGBAAt(5, 5))
+			s.Equal(tc.expected, frames[2].RGBAAt(15, 15))
+			s.Equal(red, frames[2].RGBAAt(35, 35))
+		})
+	}
+}
+
+func (s *CompositorTestSuite) TestNormalizeImage() {
+	for _, tc := range disposalCases {
+		s.Run(tc.name, func() {
+			g := loadFixture("fixtures/disposal/" + tc.name + ".gif")
+			expected := composite(g)
+			m := Meme{Gif: g}
+
+			m.NormalizeImage()
+
+			for i, frame := range g.Image {
+				s.Equal(image.Rect(0, 0, 40, 40), frame.Bounds(), "frame %d should be full size", i)
+			}
+			s.Equal(expected, composite(g), "normalizing should not change the animation")
+		})
+	}
+}
+
+func TestCompositorTestSuite(t *testing.T) {
+	suite.Run(t, new(CompositorTestSuite))
+}
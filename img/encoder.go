@@ -0,0 +1,177 @@
+package img
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// Encoder writes memes in an output format.
+type Encoder interface {
+	Encode(w io.Writer, m *Meme) error
+}
+
+// EncoderFunc adapts a function to the Encoder interface.
+type EncoderFunc func(w io.Writer, m *Meme) error
+
+// Encode calls f(w, m).
+func (f EncoderFunc) Encode(w io.Writer, m *Meme) error {
+	return f(w, m)
+}
+
+// jpegQuality is the quality used to encode jpeg memes.
+const jpegQuality = 90
+
+var encoders = map[Format]Encoder{
+	FormatGIF:    EncoderFunc(encodeGIF),
+	FormatPNG:    EncoderFunc(encodePNG),
+	FormatJPEG:   EncoderFunc(encodeJPEG),
+	FormatAPNG:   EncoderFunc(encodeAPNG),
+	FormatWebP:   EncoderFunc(encodeWebP),
+	FormatFrames: EncoderFunc(encodeFrames),
+}
+
+// EncoderFor returns the encoder for a format.
+func EncoderFor(f Format) (Encoder, error) {
+	enc, ok := encoders[f]
+	if !ok {
+		return nil, fmt.Errorf("%w: can't encode to %s", ErrUnsupportedFormat, f)
+	}
+	return enc, nil
+}
+
+// still returns the image to use when saving the meme in a still format:
+// the first frame, as displayed, for animations.
+func (m *Meme) still() image.Image {
+	if m.Still != nil {
+		return m.Still
+	}
+	canvas, _ := NewCompositor(m.Gif).Next()
+	return canvas
+}
+
+func encodeGIF(w io.Writer, m *Meme) error {
+	if m.Gif == nil {
+		// The standard library quantizes the image for us.
+		return gif.Encode(w, m.Still, nil)
+	}
+	return gif.EncodeAll(w, m.Gif)
+}
+
+func encodePNG(w io.Writer, m *Meme) error {
+	return png.Encode(w, m.still())
+}
+
+func encodeJPEG(w io.Writer, m *Meme) error {
+	return jpeg.Encode(w, m.still(), &jpeg.Options{Quality: jpegQuality})
+}
+
+// animationFrame is a frame of an animation in a truecolor format. Only the
+// area that changed from the previous frame is kept.
+type animationFrame struct {
+	img *image.NRGBA
+	// delay in hundredths of a second, like in gifs
+	delay int
+}
+
+// minDelay is the smallest delay browsers respect in gifs; anything shorter is
+// played at 100ms per frame. We do the same, so that animations play the same
+// in all formats.
+const minDelay = 2
+
+// animation returns the frames of the meme as displayed, dropping the ones
+// that don't change anything. If even is true, frames start at even coordinates.
+func (m *Meme) animation(even bool) (image.Rectangle, []animationFrame) {
+	if m.Still != nil {
+		frame := image.NewNRGBA(m.Still.Bounds())
+		draw.Draw(frame, frame.Rect, m.Still, frame.Rect.Min, draw.Src)
+		return frame.Rect, []animationFrame{{img: frame}}
+	}
+	comp := NewCompositor(m.Gif)
+	bounds := comp.canvas.Bounds()
+	var frames []animationFrame
+	var prev *image.RGBA
+	for canvas, i := comp.Next(); canvas != nil; canvas, i = comp.Next() {
+		delay := 0
+		if i < len(m.Gif.Delay) {
+			delay = m.Gif.Delay[i]
+		}
+		if delay < minDelay {
+			delay = 10
+		}
+		changed := bounds
+		if prev != nil {
+			changed = diffBounds(prev, canvas)
+			if changed.Empty() {
+				frames[len(frames)-1].delay += delay
+				continue
+			}
+			if even {
+				changed.Min.X -= (changed.Min.X - bounds.Min.X) % 2
+				changed.Min.Y -= (changed.Min.Y - bounds.Min.Y) % 2
+			}
+		} else {
+			prev = image.NewRGBA(bounds)
+		}
+		frame := image.NewNRGBA(changed)
+		draw.Draw(frame, changed, canvas, changed.Min, draw.Src)
+		frames = append(frames, animationFrame{img: frame, delay: delay})
+		copy(prev.Pix, canvas.Pix)
+	}
+	return bounds, frames
+}
+
+// diffBounds returns the smallest rectangle containing all the pixels that differ
+// between two images of the same size.
+func diffBounds(a, b *image.RGBA) image.Rectangle {
+	var r image.Rectangle
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		rowA := a.Pix[a.PixOffset(bounds.Min.X, y):a.PixOffset(bounds.Max.X, y)]
+		rowB := b.Pix[b.PixOffset(bounds.Min.X, y):b.PixOffset(bounds.Max.X, y)]
+		if bytes.Equal(rowA, rowB) {
+			continue
+		}
+		minX, maxX := bounds.Max.X, bounds.Min.X
+		for x := 0; x < len(rowA); x += 4 {
+			if !bytes.Equal(rowA[x:x+4], rowB[x:x+4]) {
+				minX = minInt(minX, bounds.Min.X+x/4)
+				maxX = maxInt(maxX, bounds.Min.X+x/4+1)
+			}
+		}
+		r = r.Union(image.Rect(minX, y, maxX, y+1))
+	}
+	return r
+}
+
+// loops returns the number of times the animation is played, 0 meaning forever.
+func (m *Meme) loops() int {
+	if m.Gif == nil || m.Gif.LoopCount == 0 {
+		return 0
+	}
+	if m.Gif.LoopCount < 0 {
+		return 1
+	}
+	return m.Gif.LoopCount + 1
+}
@@ -0,0 +1,280 @@
+package img
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/image/vp8l"
+	"golang.org/x/image/webp"
+)
+
+type EncoderTestSuite struct {
+	suite.Suite
+}
+
+// noisyImage returns an image with random pixels, and some flat areas.
+func noisyImage(r image.Rectangle, seed int64) *image.NRGBA {
+	rnd := rand.New(rand.NewSource(seed))
+	img := image.NewNRGBA(r)
+	rnd.Read(img.Pix)
+	draw.Draw(img, image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+r.Dy()/3), image.NewUniform(red), image.Point{}, draw.Src)
+	return img
+}
+
+type chunk struct {
+	name string
+	data []byte
+}
+
+// pngChunks splits a png file in chunks, checking the crc.
+func (s *EncoderTestSuite) pngChunks(b []byte) []chunk {
+	s.Require().Equal(pngHeader, string(b[:8]))
+	b = b[8:]
+	var chunks []chunk
+	for len(b) > 0 {
+		n := binary.BigEndian.Uint32(b)
+		c := chunk{string(b[4:8]), b[8 : 8+n]}
+		s.Equal(crc32.ChecksumIEEE(b[4:8+n]), binary.BigEndian.Uint32(b[8+n:]), "bad crc for %s", c.name)
+		chunks = append(chunks, c)
+		b = b[12+n:]
+	}
+	return chunks
+}
+
+// riffChunks splits the content of a riff chunk.
+func riffChunks(b []byte) []chunk {
+	var chunks []chunk
+	for len(b) > 0 {
+		n := binary.LittleEndian.Uint32(b[4:])
+		chunks = append(chunks, chunk{string(b[:4]), b[8 : 8+n]})
+		b = b[8+n+n%2:]
+	}
+	return chunks
+}
+
+func uint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
+
+// sameImage checks that two images have the same pixels, ignoring the color of transparent ones.
+func (s *EncoderTestSuite) sameImage(expected, actual image.Image, msg string) {
+	s.Require().Equal(expected.Bounds(), actual.Bounds(), msg)
+	b := expected.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			e := color.NRGBAModel.Convert(expected.At(x, y)).(color.NRGBA)
+			a := color.NRGBAModel.Convert(actual.At(x, y)).(color.NRGBA)
+			if e.A == 0 && a.A == 0 {
+				continue
+			}
+			if !s.Equal(e, a, "%s: pixel (%d, %d)", msg, x, y) {
+				return
+			}
+		}
+	}
+}
+
+func (s *EncoderTestSuite) TestHuffmanLengths() {
+	var testCases = []struct {
+		name      string
+		counts    []int
+		maxLength int
+	}{
+		{"empty", []int{0, 0, 0}, 15},
+		{"single", []int{0, 5, 0}, 15},
+		{"balanced", []int{1, 1, 1, 1}, 15},
+		{"fibonacci", []int{1, 1, 2, 3, 5, 8, 13, 21, 34, 55, 89, 144, 233, 377, 610, 987, 1597, 2584, 4181, 6765}, 7},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			lengths := huffmanLengths(tc.counts, tc.maxLength)
+
+			used, kraft := 0, 0.0
+			for _, l := range lengths {
+				s.True(int(l) <= tc.maxLength)
+				if l > 0 {
+					used++
+					kraft += 1 / float64(int(1)<<l)
+				}
+			}
+			if used == 1 {
+				return
+			}
+			s.Equal(1.0, kraft, "the code should be complete")
+		})
+	}
+}
+
+func (s *EncoderTestSuite) TestLZ77Prefix() {
+	for v := 1; v <= vp8lMaxLength; v++ {
+		symbol, extra, extraBits := lz77Prefix(v)
+		// This is how the decoder reads it.
+		decoded := symbol + 1
+		if symbol >= 4 {
+			decoded = (2+symbol&1)<<((symbol-2)>>1) + extra + 1
+		}
+		s.Equal(v, decoded)
+		s.True(extra < 1<<extraBits)
+		s.True(symbol < vp8lLengthCodes)
+	}
+}
+
+func (s *EncoderTestSuite) TestWebPStill() {
+	var testCases = []struct {
+		name string
+		img  *image.NRGBA
+	}{
+		{"noise", noisyImage(image.Rect(0, 0, 37, 21), 1)},
+		{"flat", noisyImage(image.Rect(0, 0, 64, 3), 2)},
+		{"pixel", noisyImage(image.Rect(0, 0, 1, 1), 3)},
+		{"gagarin", nil},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			m := Meme{Still: tc.img}
+			if tc.img == nil {
+				tpl, err := SimpleTemplate("fixtures/gagarin.png", "", 10, 10)
+				s.Require().Nil(err)
+				m.Still, err = tpl.GetStill()
+				s.Require().Nil(err)
+			}
+			var out bytes.Buffer
+
+			err := m.EncodeAs(&out, FormatWebP)
+
+			s.Require().Nil(err)
+			decoded, err := webp.Decode(&out)
+			s.Require().Nil(err)
+			s.sameImage(m.Still, decoded, tc.name)
+		})
+	}
+}
+
+func (s *EncoderTestSuite) TestWebPAnimation() {
+	for _, tc := range disposalCases {
+		s.Run(tc.name, func() {
+			g := loadFixture("fixtures/disposal/" + tc.name + ".gif")
+			g.LoopCount = 2
+			expected := composite(g)
+			var out bytes.Buffer
+
+			err := (&Meme{Gif: g}).EncodeAs(&out, FormatWebP)
+
+			s.Require().Nil(err)
+			b := out.Bytes()
+			s.Equal("RIFF", string(b[:4]))
+			s.Equal(len(b)-8, int(binary.LittleEndian.Uint32(b[4:])))
+			s.Equal("WEBP", string(b[8:12]))
+			chunks := riffChunks(b[12:])
+			s.Require().Equal("VP8X", chunks[0].name)
+			s.Equal(byte(0x02), chunks[0].data[0]&0x02, "animation flag")
+			s.Equal(40, uint24(chunks[0].data[4:])+1)
+			s.Equal("ANIM", chunks[1].name)
+			s.Equal(uint16(3), binary.LittleEndian.Uint16(chunks[1].data[4:]))
+			canvas := image.NewNRGBA(image.Rect(0, 0, 40, 40))
+			frames := chunks[2:]
+			s.Require().Len(frames, len(expected))
+			for i, c := range frames {
+				s.Equal("ANMF", c.name)
+				x, y := 2*uint24(c.data[0:]), 2*uint24(c.data[3:])
+				width, height := uint24(c.data[6:])+1, uint24(c.data[9:])+1
+				s.Equal(g.Delay[i]*10, uint24(c.data[12:]))
+				frameChunks := riffChunks(c.data[16:])
+				s.Require().Equal("VP8L", frameChunks[0].name)
+				frame, err := vp8l.Decode(bytes.NewReader(frameChunks[0].data))
+				s.Require().Nil(err)
+				s.Equal(image.Rect(0, 0, width, height), frame.Bounds())
+				draw.Draw(canvas, image.Rect(x, y, x+width, y+height), frame, image.Point{}, draw.Src)
+				s.sameImage(expected[i], canvas, "frame")
+			}
+		})
+	}
+}
+
+func (s *EncoderTestSuite) TestAPNG() {
+	for _, tc := range disposalCases {
+		s.Run(tc.name, func() {
+			g := loadFixture("fixtures/disposal/" + tc.name + ".gif")
+			expected := composite(g)
+			var out bytes.Buffer
+
+			err := (&Meme{Gif: g}).EncodeAs(&out, FormatAPNG)
+
+			s.Require().Nil(err)
+			// Viewers that don't know about APNG show the first frame.
+			first, err := png.Decode(bytes.NewReader(out.Bytes()))
+			s.Require().Nil(err)
+			s.sameImage(expected[0], first, "first frame")
+			chunks := s.pngChunks(out.Bytes())
+			s.Equal("IHDR", chunks[0].name)
+			s.Equal("acTL", chunks[1].name)
+			s.Equal(uint32(len(expected)), binary.BigEndian.Uint32(chunks[1].data))
+			s.Equal("IEND", chunks[len(chunks)-1].name)
+			// Rebuild every frame as a png on its own, and put it on the canvas.
+			canvas := image.NewNRGBA(image.Rect(0, 0, 40, 40))
+			seq, frame := uint32(0), 0
+			var fctl []byte
+			for _, c := range chunks[2 : len(chunks)-1] {
+				data := c.data
+				if c.name != "IDAT" {
+					s.Equal(seq, binary.BigEndian.Uint32(c.data), "sequence number of %s", c.name)
+					seq++
+					data = data[4:]
+				}
+				if c.name == "fcTL" {
+					fctl = c.data
+					continue
+				}
+				decoded, err := png.Decode(bytes.NewReader(framePNG(fctl, data)))
+				s.Require().Nil(err)
+				x, y := int(binary.BigEndian.Uint32(fctl[12:])), int(binary.BigEndian.Uint32(fctl[16:]))
+				draw.Draw(canvas, decoded.Bounds().Add(image.Pt(x, y)), decoded, image.Point{}, draw.Src)
+				s.sameImage(expected[frame], canvas, "frame")
+				frame++
+			}
+			s.Equal(len(expected), frame)
+		})
+	}
+}
+
+// framePNG builds a standalone png out of an APNG frame.
+func framePNG(fctl, data []byte) []byte {
+	var out bytes.Buffer
+	a := apngWriter{w: bufio.NewWriter(&out)}
+	a.w.WriteString(pngHeader)
+	ihdr := make([]byte, 13)
+	copy(ihdr, fctl[4:12])
+	ihdr[8], ihdr[9] = 8, 6
+	a.chunk("IHDR", ihdr)
+	a.chunk("IDAT", data)
+	a.chunk("IEND", nil)
+	a.w.Flush()
+	return out.Bytes()
+}
+
+func (s *EncoderTestSuite) TestAnimationSkipsUnchangedFrames() {
+	frame := solidFrame(image.Rect(0, 0, 4, 4), red)
+	g := &gif.GIF{Image: []*image.Paletted{frame, frame, solidFrame(image.Rect(1, 1, 2, 2), green)}, Delay: []int{5, 7, 0}}
+
+	bounds, frames := (&Meme{Gif: g}).animation(true)
+
+	s.Equal(image.Rect(0, 0, 4, 4), bounds)
+	s.Require().Len(frames, 2)
+	s.Equal(12, frames[0].delay)
+	s.Equal(10, frames[1].delay, "short delays are played at 100ms")
+	s.Equal(image.Rect(0, 0, 2, 2), frames[1].img.Rect, "frames should start at even coordinates")
+}
+
+func TestEncoderTestSuite(t *testing.T) {
+	suite.Run(t, new(EncoderTestSuite))
+}
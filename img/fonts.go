@@ -0,0 +1,70 @@
+package img
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+)
+
+// FontCache holds parsed fonts, so that we read and parse every ttf file only once.
+// It is safe for concurrent use.
+type FontCache struct {
+	mux   sync.Mutex
+	fonts map[string]*truetype.Font
+}
+
+// NewFontCache returns an empty font cache.
+func NewFontCache() *FontCache {
+	return &FontCache{fonts: make(map[string]*truetype.Font)}
+}
+
+// fonts is the cache used by all the text boxes.
+var fonts = NewFontCache()
+
+// Font returns the font at path, reading it from disk only the first time.
+func (c *FontCache) Font(path string) (*truetype.Font, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if f, ok := c.fonts[path]; ok {
+		return f, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := truetype.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	c.fonts[path] = f
+	return f, nil
+}
+
+// Face returns a face for the font at path, with the given size. Faces keep
+// an internal glyph cache and are not safe for concurrent use, so a new one
+// is returned on every call; creating it from the parsed font is cheap.
+func (c *FontCache) Face(path string, size float64) (font.Face, error) {
+	f, err := c.Font(path)
+	if err != nil {
+		return nil, err
+	}
+	return truetype.NewFace(f, &truetype.Options{Size: size}), nil
+}
@@ -0,0 +1,145 @@
+package img
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Format is an image format memes can be made from, or saved to.
+type Format string
+
+// Supported formats. PNG and JPEG images are treated as single-frame memes.
+// APNG, WebP and frames archives can only be used for output.
+const (
+	FormatGIF  Format = "gif"
+	FormatPNG  Format = "png"
+	FormatJPEG Format = "jpeg"
+	FormatAPNG Format = "apng"
+	FormatWebP Format = "webp"
+	// FormatFrames is a zip of png frames with a timing manifest, see FramesManifest.
+	FormatFrames Format = "frames"
+)
+
+// ErrUnsupportedFormat is returned when an image is not in one of the supported formats.
+var ErrUnsupportedFormat = errors.New("unsupported image format")
+
+// FormatFromExtension returns the format of a file, based on its extension.
+func FormatFromExtension(path string) (Format, bool) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gif":
+		return FormatGIF, true
+	case ".png":
+		return FormatPNG, true
+	case ".jpg", ".jpeg":
+		return FormatJPEG, true
+	case ".webp":
+		return FormatWebP, true
+	case ".zip":
+		return FormatFrames, true
+	}
+	return "", false
+}
+
+// ParseFormat returns the format with the given name.
+func ParseFormat(name string) (Format, error) {
+	switch f := Format(strings.ToLower(name)); f {
+	case FormatGIF, FormatPNG, FormatJPEG, FormatAPNG, FormatWebP, FormatFrames:
+		return f, nil
+	case "jpg":
+		return FormatJPEG, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrUnsupportedFormat, name)
+}
+
+// Readable returns true if memes can be made from images in this format.
+func (f Format) Readable() bool {
+	return f == FormatGIF || f == FormatPNG || f == FormatJPEG
+}
+
+// Extension returns the file extension for the format, including the dot.
+// Animated PNGs use the same extension as PNGs.
+func (f Format) Extension() string {
+	switch f {
+	case FormatJPEG:
+		return ".jpg"
+	case FormatAPNG:
+		return ".png"
+	case FormatFrames:
+		return ".zip"
+	}
+	return "." + string(f)
+}
+
+// ContentType returns the MIME type of the format.
+func (f Format) ContentType() string {
+	if f == FormatFrames {
+		return "application/zip"
+	}
+	return "image/" + string(f)
+}
+
+// DecodeImageConfig reads the size and format of an image, looking at its content
+// rather than at its extension.
+func DecodeImageConfig(path string) (image.Config, Format, error) {
+	return DecodeImageConfigFrom(filesystem{}, path)
+}
+
+// DecodeImageConfigFrom reads the size and format of the image with the given name in src.
+func DecodeImageConfigFrom(src ImageSource, name string) (image.Config, Format, error) {
+	r, err := src.Get(name)
+	if err != nil {
+		return image.Config{}, "", err
+	}
+	defer r.Close()
+	return decodeImageConfig(r)
+}
+
+// decodeImageConfig reads the size and format of an image, and checks we support it.
+func decodeImageConfig(r io.Reader) (image.Config, Format, error) {
+	cfg, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return cfg, "", err
+	}
+	switch f := Format(format); f {
+	case FormatGIF, FormatPNG, FormatJPEG:
+		return cfg, f, nil
+	}
+	return cfg, "", fmt.Errorf("%w: %s", ErrUnsupportedFormat, format)
+}
+
+// Encode writes the meme to w, in the format of its base image.
+func (m *Meme) Encode(w io.Writer) error {
+	return m.EncodeAs(w, m.Format)
+}
+
+// EncodeAs writes the meme to w in the given format, converting it if needed.
+func (m *Meme) EncodeAs(w io.Writer, f Format) error {
+	if f == "" {
+		f = FormatGIF
+	}
+	enc, err := EncoderFor(f)
+	if err != nil {
+		return err
+	}
+	return enc.Encode(w, m)
+}
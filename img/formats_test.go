@@ -0,0 +1,134 @@
+package img
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type FormatsTestSuite struct {
+	suite.Suite
+}
+
+func (s *FormatsTestSuite) TestFormatFromExtension() {
+	var testCases = []struct {
+		path   string
+		format Format
+		ok     bool
+	}{
+		{"earth.gif", FormatGIF, true},
+		{"some/dir/image.PNG", FormatPNG, true},
+		{"photo.jpg", FormatJPEG, true},
+		{"photo.jpeg", FormatJPEG, true},
+		{"Copyright", "", false},
+		{"frames.zip", FormatFrames, true},
+		{"movie.webm", "", false},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.path, func() {
+			format, ok := FormatFromExtension(tc.path)
+
+			s.Equal(tc.ok, ok)
+			s.Equal(tc.format, format)
+		})
+	}
+}
+
+func (s *FormatsTestSuite) TestDecodeImageConfig() {
+	var testCases = []struct {
+		path   string
+		format Format
+		width  int
+		isErr  bool
+	}{
+		{"fixtures/earth.gif", FormatGIF, 774, false},
+		{"fixtures/gagarin.png", FormatPNG, 307, false},
+		{"fixtures/gagarin.jpg", FormatJPEG, 307, false},
+		{"fixtures/badfile.gif", "", 0, true},
+		{"fixtures/non-existent.png", "", 0, true},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.path, func() {
+			cfg, format, err := DecodeImageConfig(tc.path)
+
+			if tc.isErr {
+				s.Error(err)
+				return
+			}
+			s.Nil(err)
+			s.Equal(tc.format, format)
+			s.Equal(tc.width, cfg.Width)
+		})
+	}
+}
+
+func (s *FormatsTestSuite) TestEncode() {
+	still := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	animated := &gif.GIF{Image: []*image.Paletted{image.NewPaletted(image.Rect(0, 0, 10, 10), palette.Plan9)}, Delay: []int{0}}
+	var testCases = []struct {
+		name   string
+		meme   Meme
+		decode func(*bytes.Buffer) error
+	}{
+		{"gif", Meme{Gif: animated}, func(b *bytes.Buffer) error { _, err := gif.DecodeAll(b); return err }},
+		{"png", Meme{Still: still, Format: FormatPNG}, func(b *bytes.Buffer) error { _, err := png.Decode(b); return err }},
+		{"jpeg", Meme{Still: still, Format: FormatJPEG}, func(b *bytes.Buffer) error { _, err := jpeg.Decode(b); return err }},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			var out bytes.Buffer
+
+			err := tc.meme.Encode(&out)
+
+			s.Nil(err)
+			s.Nil(tc.decode(&out), "the output should be a valid %s", tc.name)
+		})
+	}
+}
+
+func (s *FormatsTestSuite) TestEncodeAs() {
+	animated := &gif.GIF{Image: []*image.Paletted{image.NewPaletted(image.Rect(0, 0, 10, 10), palette.Plan9)}, Delay: []int{0}}
+	still := Meme{Still: image.NewRGBA(image.Rect(0, 0, 10, 10)), Format: FormatPNG}
+	var out bytes.Buffer
+	s.Nil(still.EncodeAs(&out, FormatGIF))
+	_, err := gif.DecodeAll(&out)
+	s.Nil(err, "stills can be saved as gifs")
+	s.Nil((&Meme{Gif: animated}).EncodeAs(&out, FormatPNG))
+	_, err = png.Decode(&out)
+	s.Nil(err, "animations can be saved as a png of their first frame")
+	s.True(errors.Is(still.EncodeAs(&out, "bmp"), ErrUnsupportedFormat))
+}
+
+func (s *FormatsTestSuite) TestParseFormat() {
+	var testCases = []struct {
+		name   string
+		format Format
+		isErr  bool
+	}{
+		{"gif", FormatGIF, false},
+		{"WebP", FormatWebP, false},
+		{"jpg", FormatJPEG, false},
+		{"apng", FormatAPNG, false},
+		{"frames", FormatFrames, false},
+		{"bmp", "", true},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			format, err := ParseFormat(tc.name)
+
+			s.Equal(tc.isErr, err != nil)
+			s.Equal(tc.format, format)
+		})
+	}
+}
+
+func TestFormatsTestSuite(t *testing.T) {
+	suite.Run(t, new(FormatsTestSuite))
+}
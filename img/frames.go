@@ -0,0 +1,102 @@
+package img
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+)
+
+// The frames format is a zip archive with every frame of the meme, as displayed,
+// in a numbered png file, and a manifest with their timing. It's meant to be
+// re-encoded as a video by other tools.
+
+// FramesManifestName is the name of the manifest in a frames archive.
+const FramesManifestName = "manifest.json"
+
+// FramesManifest describes the frames in a frames archive.
+type FramesManifest struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// LoopCount is the number of times the animation is played, 0 meaning forever.
+	LoopCount int           `json:"loop_count"`
+	Frames    []FrameRecord `json:"frames"`
+}
+
+// FrameRecord is a frame in a frames archive.
+type FrameRecord struct {
+	File string `json:"file"`
+	// Delay is in hundredths of a second, exactly as in the original gif.
+	Delay int `json:"delay"`
+	// DurationMs is the delay in milliseconds.
+	DurationMs int `json:"duration_ms"`
+}
+
+// frameName returns the name of the i-th frame in the archive.
+func frameName(i int) string {
+	return fmt.Sprintf("frame-%04d.png", i)
+}
+
+func encodeFrames(w io.Writer, m *Meme) error {
+	z := zip.NewWriter(w)
+	manifest := FramesManifest{LoopCount: m.loops()}
+	addFrame := func(frame image.Image, delay int) error {
+		name := frameName(len(manifest.Frames))
+		// Pngs are already compressed.
+		out, err := z.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err != nil {
+			return err
+		}
+		if err := png.Encode(out, frame); err != nil {
+			return err
+		}
+		manifest.Frames = append(manifest.Frames, FrameRecord{File: name, Delay: delay, DurationMs: delay * 10})
+		return nil
+	}
+	if m.Still != nil {
+		manifest.Width, manifest.Height = m.Still.Bounds().Dx(), m.Still.Bounds().Dy()
+		if err := addFrame(m.Still, 0); err != nil {
+			return err
+		}
+	} else {
+		comp := NewCompositor(m.Gif)
+		manifest.Width, manifest.Height = comp.canvas.Rect.Dx(), comp.canvas.Rect.Dy()
+		for canvas, i := comp.Next(); canvas != nil; canvas, i = comp.Next() {
+			delay := 0
+			if i < len(m.Gif.Delay) {
+				delay = m.Gif.Delay[i]
+			}
+			if err := addFrame(canvas, delay); err != nil {
+				return err
+			}
+		}
+	}
+	out, err := z.Create(FramesManifestName)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return err
+	}
+	return z.Close()
+}
@@ -0,0 +1,73 @@
+package img
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type FramesTestSuite struct {
+	suite.Suite
+}
+
+// readArchive returns the manifest and the frames in a frames archive.
+func (s *FramesTestSuite) readArchive(b []byte) (FramesManifest, map[string]image.Image) {
+	var manifest FramesManifest
+	frames := make(map[string]image.Image)
+	z, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	s.Require().Nil(err)
+	for _, f := range z.File {
+		r, err := f.Open()
+		s.Require().Nil(err)
+		if f.Name == FramesManifestName {
+			s.Require().Nil(json.NewDecoder(r).Decode(&manifest))
+		} else {
+			frames[f.Name], err = png.Decode(r)
+			s.Require().Nil(err, "%s should be a png", f.Name)
+		}
+		r.Close()
+	}
+	return manifest, frames
+}
+
+func (s *FramesTestSuite) TestAnimation() {
+	g := loadFixture("fixtures/disposal/previous.gif")
+	expected := composite(g)
+	var out bytes.Buffer
+
+	err := (&Meme{Gif: g}).EncodeAs(&out, FormatFrames)
+
+	s.Require().Nil(err)
+	manifest, frames := s.readArchive(out.Bytes())
+	s.Equal(40, manifest.Width)
+	s.Equal(40, manifest.Height)
+	s.Require().Len(manifest.Frames, len(expected))
+	s.Len(frames, len(expected))
+	for i, record := range manifest.Frames {
+		s.Equal(frameName(i), record.File)
+		s.Equal(g.Delay[i], record.Delay)
+		s.Equal(g.Delay[i]*10, record.DurationMs)
+		s.Equal(expected[i].Bounds(), frames[record.File].Bounds())
+		s.Equal(expected[i].At(15, 15), frames[record.File].At(15, 15), "frame %d", i)
+	}
+}
+
+func (s *FramesTestSuite) TestStill() {
+	var out bytes.Buffer
+
+	err := (&Meme{Still: noisyImage(image.Rect(0, 0, 7, 5), 1)}).EncodeAs(&out, FormatFrames)
+
+	s.Require().Nil(err)
+	manifest, frames := s.readArchive(out.Bytes())
+	s.Equal(FramesManifest{Width: 7, Height: 5, Frames: []FrameRecord{{File: "frame-0000.png"}}}, manifest)
+	s.Len(frames, 1)
+}
+
+func TestFramesTestSuite(t *testing.T) {
+	suite.Run(t, new(FramesTestSuite))
+}
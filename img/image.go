@@ -17,16 +17,17 @@ limitations under the License.
 */
 
 import (
+	"context"
 	"fmt"
 	"image"
 	"image/draw"
 	"image/gif"
-	"math"
-	"strings"
+	"runtime"
 	"sync"
 
 	"github.com/fogleman/gg"
 	"github.com/nfnt/resize"
+	"golang.org/x/image/font"
 )
 
 // Meme is a structure describing a meme
@@ -37,6 +38,19 @@ type Meme struct {
 	TextBoxes *[]TextBox
 	// Border (fraction of image size)
 	Border float64
+	// Workers is the number of frames rendered in parallel.
+	// Defaults to GOMAXPROCS if not positive.
+	Workers int
+	// Mode is the rendering mode; RenderFull if empty.
+	Mode RenderMode
+	// Format of the base image; the meme is encoded in the same format.
+	// An empty value means FormatGIF.
+	Format Format
+	// Still is the base image of memes made from png or jpeg files, that have no Gif.
+	Still image.Image
+	// Dither enables Floyd-Steinberg dithering when converting frames back
+	// to their palette. It smooths gradients, at the cost of larger files.
+	Dither bool
 }
 
 //TextBox represents a text box to add to the image.
@@ -55,66 +69,130 @@ type TextBox struct {
 	LineSpacingRatio float64
 	// the actual font size.
 	FontSize float64
+	// Style of the text
+	Style TextStyle
+	// Layout of the text, as calculated by SetText
+	Layout *Layout
 }
 
 // SetText substitutes text into the textbox, and calculates the font size
 func (t *TextBox) SetText(txt string, maxFontSize float64, minFontSize float64) error {
 	t.Txt = &txt
-	var err error
-	t.FontSize, err = t.CalculateFontSize(maxFontSize, minFontSize)
-	return err
+	layout, err := t.Fit(maxFontSize, minFontSize)
+	if err != nil {
+		return err
+	}
+	t.Layout = layout
+	t.FontSize = layout.FontSize
+	return nil
 }
 
 // CalculateFontSize calculates the maximum font size that can fit
 // the text in the textbox.
 func (t *TextBox) CalculateFontSize(maxFontSize float64, minFontSize float64) (float64, error) {
+	layout, err := t.Fit(maxFontSize, minFontSize)
+	if err != nil {
+		return 0.0, err
+	}
+	return layout.FontSize, nil
+}
+
+// fontSizePrecision is the precision, in points, of the search for the best font size
+const fontSizePrecision float64 = 0.25
+
+// Fit finds the layout with the largest font size that fits the text in the textbox,
+// with a binary search between the minimum and maximum font sizes.
+func (t *TextBox) Fit(maxFontSize float64, minFontSize float64) (*Layout, error) {
 	if t.Height <= 0 || t.Width <= 0 {
-		return 0.0, fmt.Errorf("image size is too small")
+		return nil, fmt.Errorf("image size is too small")
+	}
+	layoutAt := func(fs float64) (*Layout, error) {
+		face, err := fonts.Face(t.FontPath, fs)
+		if err != nil {
+			return nil, fmt.Errorf("font at %s could not be loaded at font size %d", t.FontPath, int(fs))
+		}
+		return t.ComputeLayout(face, fs), nil
+	}
+	best, err := layoutAt(maxFontSize)
+	if err != nil || best.Fits(t) {
+		return best, err
+	}
+	best, err = layoutAt(minFontSize)
+	if err != nil {
+		return nil, err
 	}
-	ctx := gg.NewContext(t.Width, t.Height)
-	for fs := maxFontSize; fs >= minFontSize; fs -= 2.0 {
-		err := ctx.LoadFontFace(t.FontPath, fs)
+	if !best.Fits(t) {
+		return nil, fmt.Errorf("text can't fit in the image")
+	}
+	// The text fits at lo, and doesn't at hi.
+	lo, hi := minFontSize, maxFontSize
+	for hi-lo > fontSizePrecision {
+		mid := (lo + hi) / 2
+		layout, err := layoutAt(mid)
 		if err != nil {
-			return 0.0, fmt.Errorf("font at %s could not be loaded at font size %d", t.FontPath, int(fs))
+			return nil, err
 		}
-		// Wrap text to fit maxWidth
-		lines := ctx.WordWrap(*t.Txt, float64(t.Width))
-		// This is a peculiarity of the gg API. Oh, well :P
-		width, height := ctx.MeasureMultilineString(strings.Join(lines, "\n"), math.Ceil(ctx.FontHeight()*t.LineSpacingRatio))
-		if int(width) <= t.Width && int(height) <= t.Height {
-			return fs, nil
+		if layout.Fits(t) {
+			lo, best = mid, layout
+		} else {
+			hi = mid
 		}
 	}
-	return 0.0, fmt.Errorf("text can't fit in the image")
+	return best, nil
+}
+
+// Face returns a font face of the right size for the text box.
+func (t *TextBox) Face() (font.Face, error) {
+	return fonts.Face(t.FontPath, t.FontSize)
 }
 
-// DrawText draws the text into a gg context
+// DrawText draws the text into a gg context, where the font face
+// of the right size must already be loaded.
 func (t *TextBox) DrawText(ctx *gg.Context) error {
 	if *t.Txt == "" {
 		return fmt.Errorf("trying to draw an empty string")
 	}
-	// Stroke size needs to be 40% of the line spacing.
-	lineSpacing := math.Ceil(ctx.FontHeight() * t.LineSpacingRatio)
-	strokeSize := int(lineSpacing * 0.4)
-	// Write the text with a white fill and black stroke.
+	if t.Layout == nil {
+		return fmt.Errorf("the text needs to be laid out before drawing it")
+	}
+	fill, err := t.Style.FillColor()
+	if err != nil {
+		return err
+	}
+	stroke, err := t.Style.StrokeColor()
+	if err != nil {
+		return err
+	}
+	strokeSize := t.Layout.Stroke
+	// Write the text with the fill color and the stroke around it.
 	// Inspired by the meme.go example in gg
-	ctx.SetHexColor("#000")
+	ctx.SetColor(stroke)
 	for dy := -strokeSize; dy <= strokeSize; dy++ {
 		for dx := -strokeSize; dx <= strokeSize; dx++ {
 			// Round corners (x^2 + y2 < r^2)
 			if dx*dx+dy*dy >= strokeSize*strokeSize {
 				continue
 			}
-			ctx.DrawStringWrapped(*t.Txt, float64(t.Center.X+dx), float64(t.Center.Y+dy), 0.5, 0.5, float64(t.Width), 1.0+t.LineSpacingRatio, gg.AlignCenter)
+			for i, line := range t.Layout.Lines {
+				origin := t.Layout.Origins[i]
+				ctx.DrawString(line, float64(origin.X+dx), float64(origin.Y+dy))
+			}
 		}
 	}
-	ctx.SetHexColor("#FFF")
-	ctx.DrawStringWrapped(*t.Txt, float64(t.Center.X), float64(t.Center.Y), 0.5, 0.5, float64(t.Width), 1.0+t.LineSpacingRatio, gg.AlignCenter)
+	ctx.SetColor(fill)
+	for i, line := range t.Layout.Lines {
+		origin := t.Layout.Origins[i]
+		ctx.DrawString(line, float64(origin.X), float64(origin.Y))
+	}
 	return nil
 }
 
 // GifMetaData returns metadata on the gif
 func (m *Meme) GifMetaData() {
+	if m.Gif == nil {
+		fmt.Printf("Still image, size: %v\n", m.Still.Bounds().Size())
+		return
+	}
 	for i, img := range m.Gif.Image {
 		fmt.Println("##")
 		fmt.Printf("Frame: %d\n", i)
@@ -127,67 +205,164 @@ func (m *Meme) GifMetaData() {
 	}
 }
 
-// NormalizeImage modifies the image it so that it has
-// all frames of the same size, with transparency.
+// NormalizeImage modifies the image so that all frames have the size of the
+// whole image, and show what a viewer would display at that point of the animation.
+// Full-size frames without transparent pixels are left untouched.
 func (m *Meme) NormalizeImage() {
 	g := m.Gif
-	size := g.Image[0].Bounds()
-	for i, img := range g.Image {
-		// If the image is not full-sized, we paint it on top of our last normalized image
-		if img.Bounds() != size {
-			// create an image of size "size", then draw the current image centered.
-			newImage := image.NewPaletted(size, img.Palette)
-			// First draw the previous image here
-			lastFullSize := g.Image[i-1]
-			draw.Draw(newImage, size, lastFullSize, image.Point{0, 0}, draw.Src)
-			draw.Draw(newImage, img.Bounds(), img, img.Bounds().Min, draw.Src)
-			// now swap the image
-			g.Image[i] = newImage
+	comp := NewCompositor(g)
+	// Frames can't be replaced while compositing, as we still need the originals.
+	frames := make([]*image.Paletted, len(g.Image))
+	for canvas, i := comp.Next(); canvas != nil; canvas, i = comp.Next() {
+		frame := g.Image[i]
+		if frame.Bounds() == canvas.Bounds() && frame.Opaque() {
+			frames[i] = frame
+			continue
+		}
+		palette := frame.Palette
+		if !canvas.Opaque() {
+			palette, _, _ = transparentIndex(palette)
+		}
+		normalized := image.NewPaletted(canvas.Bounds(), palette)
+		draw.Draw(normalized, canvas.Bounds(), canvas, canvas.Bounds().Min, draw.Src)
+		frames[i] = normalized
+	}
+	copy(g.Image, frames)
+	setDisposal(g)
+}
+
+// setDisposal sets the disposal of a gif where every frame covers the whole image:
+// a frame is only cleared if the next one has transparent pixels that would
+// otherwise show what was beneath.
+func setDisposal(g *gif.GIF) {
+	if len(g.Disposal) != len(g.Image) {
+		g.Disposal = make([]byte, len(g.Image))
+	}
+	for i := range g.Disposal {
+		g.Disposal[i] = gif.DisposalNone
+		if i+1 < len(g.Image) && !g.Image[i+1].Opaque() {
+			g.Disposal[i] = gif.DisposalBackground
 		}
 	}
 }
 
 // Preview returns a square of the required width and height
 func (m *Meme) Preview(width, height uint) image.Image {
-	toScreenshot := m.Gif.Image[0]
+	toScreenshot := m.Still
+	if toScreenshot == nil {
+		toScreenshot = m.Gif.Image[0]
+	}
 	return resize.Thumbnail(width, height, toScreenshot, resize.Lanczos3)
 }
 
 // Generate modifies the image adding the meme text
 func (m *Meme) Generate() error {
-	// We normalize the image as I'm not sure how drawing only on a fraction of the full gif would work.
-	// This might be revisited later for more space-efficient generated gifs
+	return m.GenerateContext(context.Background())
+}
+
+// GenerateContext modifies the image adding the meme text. Frames are rendered by
+// a pool of m.Workers goroutines; rendering stops at the first error, or when
+// the context is done.
+func (m *Meme) GenerateContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if m.Still != nil {
+		return m.generateStill()
+	}
+	workers := m.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if m.Mode == RenderRegions {
+		err := m.generateRegions(ctx, workers)
+		if err != errNeedsFullRender {
+			return err
+		}
+	}
+	// In full mode, we normalize the image and draw on every frame.
 	m.NormalizeImage()
-	// process every frame in a goroutine
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	frames := make(chan int)
+	// Every worker sends at most one error, so this never blocks.
+	errs := make(chan error, workers)
 	var wg sync.WaitGroup
-	var mux sync.Mutex
-	for i, img := range m.Gif.Image {
+	for w := 0; w < workers; w++ {
 		wg.Add(1)
-		go m.drawTextAt(i, img, &wg, &mux)
+		go func() {
+			defer wg.Done()
+			for i := range frames {
+				if err := m.drawTextAt(i); err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+	// Feed the frames to the workers, until we're done or something went wrong.
+feed:
+	for i := range m.Gif.Image {
+		select {
+		case frames <- i:
+		case <-ctx.Done():
+			break feed
+		}
 	}
-	// Wait for all frames to be rendered
+	close(frames)
 	wg.Wait()
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return ctx.Err()
+	}
+}
+
+// drawBoxes draws all the text boxes with some text on the context.
+func (m *Meme) drawBoxes(ctx *gg.Context) error {
+	for _, box := range *m.TextBoxes {
+		if *box.Txt != "" {
+			face, err := box.Face()
+			if err != nil {
+				return err
+			}
+			ctx.SetFontFace(face)
+			if err := box.DrawText(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// generateStill draws the text on a still image.
+func (m *Meme) generateStill() error {
+	canvas := image.NewRGBA(m.Still.Bounds())
+	draw.Draw(canvas, canvas.Rect, m.Still, canvas.Rect.Min, draw.Src)
+	if err := m.drawBoxes(gg.NewContextForRGBA(canvas)); err != nil {
+		return err
+	}
+	m.Still = canvas
 	return nil
 }
 
-func (m *Meme) drawTextAt(i int, img *image.Paletted, wg *sync.WaitGroup, mux *sync.Mutex) {
+// drawTextAt draws the text boxes on frame i. Every frame is only
+// ever touched by one goroutine, so no locking is needed.
+func (m *Meme) drawTextAt(i int) error {
+	img := m.Gif.Image[i]
 	size := img.Bounds()
 	// Build a GG context, and load the font face
 	ctx := gg.NewContext(size.Dx(), size.Dy())
 	ctx.DrawImage(img, 0, 0)
-	for _, box := range *m.TextBoxes {
-		if *box.Txt != "" {
-			ctx.LoadFontFace(box.FontPath, box.FontSize)
-			box.DrawText((ctx))
-		}
+	if err := m.drawBoxes(ctx); err != nil {
+		return fmt.Errorf("frame %d: %v", i, err)
 	}
 
-	// Now we need to get a palettedimage back
-	paletted := image.NewPaletted(img.Bounds(), img.Palette)
-	draw.Draw(paletted, paletted.Rect, ctx.Image(), img.Bounds().Min, draw.Src)
-	mux.Lock()
+	// Now we need to get a palettedimage back, with the text colors in the palette
+	paletted := image.NewPaletted(img.Bounds(), reservePalette(img, m.textColors()))
+	m.quantize(paletted, paletted.Rect, ctx.Image(), image.Point{})
 	m.Gif.Image[i] = paletted
-	mux.Unlock()
-	wg.Done()
-
+	return nil
 }
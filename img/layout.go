@@ -0,0 +1,166 @@
+package img
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"image"
+	"math"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// Layout is the arrangement of the text of a TextBox at a given font size.
+// It is computed once, and used both to check that the text fits the box
+// and to draw it, so that the two can't disagree.
+// All coordinates are snapped to whole pixels, as the rasterizer would otherwise
+// move glyphs around by a fraction of a pixel.
+type Layout struct {
+	// FontSize is the font size the layout was computed for
+	FontSize float64
+	// Lines of text, after word wrapping
+	Lines []string
+	// Origins of the baseline of every line, in image coordinates
+	Origins []image.Point
+	// Stroke is the width of the outline, in pixels
+	Stroke int
+	// Width of the text block, outline included
+	Width int
+	// Height of the text block, outline included
+	Height int
+}
+
+// Fits returns true if the text block fits the box it was computed for.
+func (l *Layout) Fits(t *TextBox) bool {
+	return l.Width <= t.Width && l.Height <= t.Height
+}
+
+func fixedToFloat(x fixed.Int26_6) float64 {
+	return float64(x) / 64.0
+}
+
+// strokeSize returns the size of the outline at a given font size.
+func (t *TextBox) strokeSize(fontSize float64) int {
+	if t.Style.StrokeWidth != nil {
+		return int(math.Round(*t.Style.StrokeWidth))
+	}
+	// Stroke size needs to be 40% of the line spacing.
+	// The font height is calculated the same way gg does.
+	fontHeight := fontSize * 72 / 96
+	return int(math.Ceil(fontHeight*t.LineSpacingRatio) * 0.4)
+}
+
+// wordWrap splits the text in lines no wider than width. Explicit newlines are respected,
+// while any other whitespace is collapsed. Words longer than width get a line of their own.
+func wordWrap(face font.Face, text string, width float64) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			candidate := word
+			if line != "" {
+				candidate = line + " " + word
+			}
+			if line != "" && fixedToFloat(font.MeasureString(face, candidate)) > width {
+				lines = append(lines, line)
+				line = word
+			} else {
+				line = candidate
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// ComputeLayout computes the layout of the text in the box, using the provided font face
+// (which must be of size fontSize).
+func (t *TextBox) ComputeLayout(face font.Face, fontSize float64) *Layout {
+	l := Layout{FontSize: fontSize, Stroke: t.strokeSize(fontSize)}
+	if t.Txt == nil || strings.TrimSpace(*t.Txt) == "" {
+		return &l
+	}
+	stroke := l.Stroke
+	l.Lines = wordWrap(face, *t.Txt, float64(t.Width-2*stroke))
+
+	// Measure the ink of every line; lines are spaced by a fraction of the
+	// font height, like gg does.
+	metrics := face.Metrics()
+	advance := int(math.Round(float64((metrics.Ascent + metrics.Descent).Ceil()) * (1.0 + t.LineSpacingRatio)))
+	inkWidth := make([]int, len(l.Lines))
+	inkLeft := make([]int, len(l.Lines))
+	top, bottom := math.MaxInt32, math.MinInt32
+	for i, line := range l.Lines {
+		bounds, _ := font.BoundString(face, line)
+		inkLeft[i] = bounds.Min.X.Floor()
+		inkWidth[i] = bounds.Max.X.Ceil() - inkLeft[i]
+		baseline := i * advance
+		// Every line takes at least the space defined by the font metrics,
+		// so that the spacing is consistent and empty lines are accounted for.
+		minY, maxY := -metrics.Ascent.Ceil(), metrics.Descent.Ceil()
+		if bounds.Max.Y > bounds.Min.Y {
+			minY, maxY = minInt(minY, bounds.Min.Y.Floor()), maxInt(maxY, bounds.Max.Y.Ceil())
+		}
+		top = minInt(top, baseline+minY)
+		bottom = maxInt(bottom, baseline+maxY)
+		l.Width = maxInt(l.Width, inkWidth[i])
+	}
+	blockHeight := bottom - top
+	l.Width += 2 * stroke
+	l.Height = blockHeight + 2*stroke
+
+	// Now position the lines in the box.
+	left := t.Center.X - t.Width/2
+	boxTop := t.Center.Y - t.Height/2
+	var y int
+	switch t.Style.VAlign {
+	case AnchorTop:
+		y = boxTop + stroke
+	case AnchorBottom:
+		y = boxTop + t.Height - stroke - blockHeight
+	default:
+		y = boxTop + (t.Height-blockHeight)/2
+	}
+	for i := range l.Lines {
+		var x int
+		switch t.Style.Align {
+		case AlignLeft:
+			x = left + stroke
+		case AlignRight:
+			x = left + t.Width - stroke - inkWidth[i]
+		default:
+			x = left + (t.Width-inkWidth[i])/2
+		}
+		l.Origins = append(l.Origins, image.Point{x - inkLeft[i], y - top + i*advance})
+	}
+	return &l
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,131 @@
+package img
+
+import (
+	"fmt"
+	"image"
+	"strings"
+	"testing"
+
+	"github.com/flopp/go-findfont"
+	"github.com/fogleman/gg"
+	"github.com/stretchr/testify/suite"
+)
+
+type LayoutTestSuite struct {
+	suite.Suite
+	fontPath string
+}
+
+func (s *LayoutTestSuite) SetupSuite() {
+	fontPath, err := findfont.Find(defaultFont)
+	if err != nil {
+		panic(err)
+	}
+	s.fontPath = fontPath
+}
+
+func (s *LayoutTestSuite) TestWordWrap() {
+	face, err := gg.LoadFontFace(s.fontPath, 20)
+	s.Nil(err)
+	var testCases = []struct {
+		text  string
+		lines []string
+	}{
+		{"short", []string{"short"}},
+		{"one does not simply walk into mordor", []string{"one does not", "simply walk", "into mordor"}},
+		{"trailing   spaces   ", []string{"trailing spaces"}},
+		{"explicit\nnewline", []string{"explicit", "newline"}},
+		{"supercalifragilisticexpialidocious", []string{"supercalifragilisticexpialidocious"}},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.text, func() {
+			s.Equal(tc.lines, wordWrap(face, tc.text, 160))
+		})
+	}
+}
+
+// TestDrawnTextInsideTheBox checks that the text actually drawn, outline included,
+// never exceeds the box it's supposed to be in.
+func (s *LayoutTestSuite) TestDrawnTextInsideTheBox() {
+	zero := 0.0
+	thick := 6.0
+	texts := []string{
+		"X",
+		"testing memeoid",
+		"one does not simply walk into mordor",
+		"Jumpy quirky glyphs: ÅÉÎ gjpqy",
+		"a very long text that will definitely need to be wrapped in a lot of lines in order to fit in the box",
+	}
+	styles := []TextStyle{
+		{},
+		{StrokeWidth: &zero},
+		{StrokeWidth: &thick, Align: AlignLeft, VAlign: AnchorTop},
+		{Align: AlignRight, VAlign: AnchorBottom},
+	}
+	sizes := []image.Point{{300, 200}, {200, 25}, {120, 300}, {500, 60}}
+	for _, txt := range texts {
+		for i, style := range styles {
+			for _, size := range sizes {
+				testName := fmt.Sprintf("%s - style %d - %v", txt, i, size)
+				s.Run(testName, func() {
+					// Put the box in the middle of a larger image, so that we can see any overflow.
+					box := TextBox{
+						Width:            size.X,
+						Height:           size.Y,
+						Center:           image.Point{size.X, size.Y},
+						FontPath:         s.fontPath,
+						LineSpacingRatio: 0.3,
+						Style:            style,
+					}
+					err := box.SetText(txt, 52.0, 4.0)
+					if err != nil {
+						s.True(strings.Contains(err.Error(), "can't fit"), "unexpected error %v", err)
+						return
+					}
+					ctx := gg.NewContext(2*size.X, 2*size.Y)
+					s.Nil(ctx.LoadFontFace(s.fontPath, box.FontSize))
+					s.Nil(box.DrawText(ctx))
+
+					topLeft := box.Center.Sub(image.Point{size.X / 2, size.Y / 2})
+					boxRect := image.Rectangle{topLeft, topLeft.Add(size)}
+					rendered := ctx.Image()
+					drawn := 0
+					for x := 0; x < 2*size.X; x++ {
+						for y := 0; y < 2*size.Y; y++ {
+							if _, _, _, a := rendered.At(x, y).RGBA(); a == 0 {
+								continue
+							}
+							drawn++
+							if !(image.Point{x, y}.In(boxRect)) {
+								s.Failf("text outside of the box", "found a pixel at %d,%d, outside of %v", x, y, boxRect)
+								return
+							}
+						}
+					}
+					s.NotZero(drawn, "some text should've been drawn")
+				})
+			}
+		}
+	}
+}
+
+func (s *LayoutTestSuite) TestLayoutIsShared() {
+	txt := "one does not simply walk into mordor"
+	box := TextBox{
+		Width:            200,
+		Height:           200,
+		Center:           image.Point{100, 100},
+		FontPath:         s.fontPath,
+		LineSpacingRatio: 0.3,
+	}
+	s.Nil(box.SetText(txt, 52.0, 8.0))
+
+	s.Equal(box.FontSize, box.Layout.FontSize)
+	s.Len(box.Layout.Origins, len(box.Layout.Lines))
+	s.True(len(box.Layout.Lines) > 1, "the text should be wrapped")
+	s.True(box.Layout.Fits(&box))
+}
+
+func TestLayoutTestSuite(t *testing.T) {
+	suite.Run(t, new(LayoutTestSuite))
+}
@@ -0,0 +1,200 @@
+package img
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/nfnt/resize"
+)
+
+// Limits are the largest memes we're willing to produce. Zero values mean no limit.
+type Limits struct {
+	MaxWidth  int
+	MaxHeight int
+	MaxFrames int
+	// MaxBytes is the maximum size of the encoded meme.
+	MaxBytes int
+}
+
+// ErrTooLarge is returned when a meme can't be made to fit the limits.
+var ErrTooLarge = errors.New("meme too large")
+
+const (
+	// shrinkFactor is how much the size and the number of frames of a meme
+	// are reduced every time its output is too large.
+	shrinkFactor = 0.75
+	// maxShrinks is how many times we try to shrink a meme before giving up.
+	maxShrinks = 6
+)
+
+// EncodeWithin encodes the meme returned by render in the given format. If the
+// output is larger than l.MaxBytes, render is called again with smaller limits,
+// until the output fits or we give up and return ErrTooLarge. render gets the
+// limits to pass to Constrain, and must return a newly generated meme every time.
+// Errors returned by render are returned unchanged.
+func EncodeWithin(l Limits, f Format, render func(Limits) (*Meme, error)) ([]byte, error) {
+	for shrinks := 0; ; shrinks++ {
+		m, err := render(l)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := m.EncodeAs(&buf, f); err != nil {
+			return nil, err
+		}
+		if l.MaxBytes <= 0 || buf.Len() <= l.MaxBytes {
+			return buf.Bytes(), nil
+		}
+		if shrinks == maxShrinks {
+			return nil, fmt.Errorf("%w: %d bytes, the limit is %d", ErrTooLarge, buf.Len(), l.MaxBytes)
+		}
+		l = l.shrink(m)
+	}
+}
+
+// shrink returns limits smaller than the size of the meme.
+func (l Limits) shrink(m *Meme) Limits {
+	b := m.bounds()
+	l.MaxWidth = maxInt(1, int(float64(b.Dx())*shrinkFactor))
+	l.MaxHeight = maxInt(1, int(float64(b.Dy())*shrinkFactor))
+	if frames := m.frameCount(); frames > 1 {
+		l.MaxFrames = maxInt(1, int(float64(frames)*shrinkFactor))
+	}
+	return l
+}
+
+// bounds returns the size of the meme.
+func (m *Meme) bounds() image.Rectangle {
+	if m.Still != nil {
+		return m.Still.Bounds()
+	}
+	return canvasBounds(m.Gif)
+}
+
+func (m *Meme) frameCount() int {
+	if m.Still != nil {
+		return 1
+	}
+	return len(m.Gif.Image)
+}
+
+// Constrain makes the meme fit the size and frame limits, before drawing the
+// text: the image is scaled down, keeping its aspect ratio, and frames are dropped
+// evenly, giving their delay to the previous one. The text boxes are scaled with
+// the image. MaxBytes is ignored; see EncodeWithin. It returns ErrTooLarge if
+// the text doesn't fit the smaller image.
+func (m *Meme) Constrain(l Limits) error {
+	b := m.bounds()
+	scale := 1.0
+	if l.MaxWidth > 0 && b.Dx() > l.MaxWidth {
+		scale = float64(l.MaxWidth) / float64(b.Dx())
+	}
+	if l.MaxHeight > 0 && b.Dy() > l.MaxHeight {
+		scale = math.Min(scale, float64(l.MaxHeight)/float64(b.Dy()))
+	}
+	frames := m.frameCount()
+	if l.MaxFrames > 0 && frames > l.MaxFrames {
+		frames = l.MaxFrames
+	}
+	if scale == 1 && frames == m.frameCount() {
+		return nil
+	}
+	width := maxInt(1, int(math.Round(float64(b.Dx())*scale)))
+	height := maxInt(1, int(math.Round(float64(b.Dy())*scale)))
+	if err := m.resize(width, height, frames); err != nil {
+		return fmt.Errorf("%w: can't shrink it to %dx%d: %v", ErrTooLarge, width, height, err)
+	}
+	return nil
+}
+
+// resize scales the meme to width x height, with the text boxes, keeping n frames.
+func (m *Meme) resize(width, height, n int) error {
+	b := m.bounds()
+	if m.Still != nil {
+		m.Still = resize.Resize(uint(width), uint(height), m.Still, resize.Lanczos3)
+	} else {
+		m.resample(width, height, n)
+	}
+	return m.scaleBoxes(float64(width)/float64(b.Dx()), float64(height)/float64(b.Dy()))
+}
+
+// resample replaces the frames of the gif with n evenly spaced full-size frames
+// of width x height pixels.
+func (m *Meme) resample(width, height, n int) {
+	g := m.Gif
+	total := len(g.Image)
+	// keep[j] is the index of the j-th frame we keep.
+	keep := make([]int, n)
+	for j := range keep {
+		keep[j] = j * total / n
+	}
+	images := make([]*image.Paletted, 0, n)
+	delays := make([]int, 0, n)
+	comp := NewCompositor(g)
+	for canvas, i := comp.Next(); canvas != nil; canvas, i = comp.Next() {
+		delay := 0
+		if i < len(g.Delay) {
+			delay = g.Delay[i]
+		}
+		if len(images) < n && keep[len(images)] == i {
+			var src image.Image = canvas
+			if width != canvas.Rect.Dx() || height != canvas.Rect.Dy() {
+				src = resize.Resize(uint(width), uint(height), canvas, resize.Lanczos3)
+			}
+			palette := g.Image[i].Palette
+			if !canvas.Opaque() {
+				palette, _, _ = transparentIndex(palette)
+			}
+			frame := image.NewPaletted(image.Rect(0, 0, width, height), palette)
+			m.quantize(frame, frame.Rect, src, src.Bounds().Min)
+			images = append(images, frame)
+			delays = append(delays, delay)
+		} else {
+			delays[len(delays)-1] += delay
+		}
+	}
+	g.Image, g.Delay = images, delays
+	g.Config.Width, g.Config.Height = width, height
+	setDisposal(g)
+}
+
+// scaleBoxes scales the text boxes, and lays out their text again.
+func (m *Meme) scaleBoxes(sx, sy float64) error {
+	if m.TextBoxes == nil {
+		return nil
+	}
+	boxes := make([]TextBox, len(*m.TextBoxes))
+	for i, box := range *m.TextBoxes {
+		box.Width = int(float64(box.Width) * sx)
+		box.Height = int(float64(box.Height) * sy)
+		box.Center = image.Pt(int(float64(box.Center.X)*sx), int(float64(box.Center.Y)*sy))
+		if box.Txt != nil && *box.Txt != "" {
+			fontSize := box.FontSize * math.Min(sx, sy)
+			if err := box.SetText(*box.Txt, fontSize, fontSize/2); err != nil {
+				return err
+			}
+		}
+		boxes[i] = box
+	}
+	m.TextBoxes = &boxes
+	return nil
+}
@@ -0,0 +1,129 @@
+package img
+
+import (
+	"context"
+	"errors"
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type LimitsTestSuite struct {
+	suite.Suite
+}
+
+func (s *LimitsTestSuite) TestConstrainGif() {
+	var testCases = []struct {
+		name   string
+		limits Limits
+		size   image.Rectangle
+		delays []int
+	}{
+		{"no limits", Limits{}, image.Rect(0, 0, 40, 40), []int{10, 11, 12, 13}},
+		{"large enough", Limits{MaxWidth: 40, MaxHeight: 100, MaxFrames: 4}, image.Rect(0, 0, 40, 40), []int{10, 11, 12, 13}},
+		{"width", Limits{MaxWidth: 20}, image.Rect(0, 0, 20, 20), []int{10, 11, 12, 13}},
+		{"height", Limits{MaxWidth: 30, MaxHeight: 10}, image.Rect(0, 0, 10, 10), []int{10, 11, 12, 13}},
+		{"frames", Limits{MaxFrames: 2}, image.Rect(0, 0, 40, 40), []int{10 + 11, 12 + 13}},
+		{"frames not evenly", Limits{MaxFrames: 3}, image.Rect(0, 0, 40, 40), []int{10, 11, 12 + 13}},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			m := Meme{Gif: opaqueGif()}
+
+			err := m.Constrain(tc.limits)
+
+			s.Nil(err)
+			s.Equal(tc.delays, m.Gif.Delay, "the duration should not change")
+			s.Len(m.Gif.Image, len(tc.delays))
+			s.Len(m.Gif.Disposal, len(tc.delays))
+			for _, frame := range m.Gif.Image {
+				s.Equal(tc.size, frame.Bounds())
+			}
+			s.Equal(tc.size, m.bounds())
+		})
+	}
+}
+
+func (s *LimitsTestSuite) TestConstrainStill() {
+	m, err := MemeFromFile("fixtures/gagarin.png", defaultFont, "top", "bottom")
+	s.Require().Nil(err)
+	top := (*m.TextBoxes)[0]
+
+	err = m.Constrain(Limits{MaxHeight: 192})
+
+	s.Require().Nil(err)
+	s.Equal(image.Rect(0, 0, 154, 192), m.Still.Bounds(), "the aspect ratio should be kept")
+	scaled := (*m.TextBoxes)[0]
+	s.Equal(top.Width/2, scaled.Width)
+	s.Equal(image.Pt(top.Center.X/2, top.Center.Y/2), scaled.Center)
+	s.True(scaled.FontSize < top.FontSize, "the text should be smaller")
+	s.True(scaled.Layout.Fits(&scaled), "the text should fit the box")
+	s.Nil(m.Generate())
+
+	m, err = MemeFromFile("fixtures/gagarin.png", defaultFont, "top", "bottom")
+	s.Require().Nil(err)
+	err = m.Constrain(Limits{MaxHeight: 2})
+	s.True(errors.Is(err, ErrTooLarge), "the text can't fit a tiny image")
+}
+
+func (s *LimitsTestSuite) TestEncodeWithin() {
+	var testCases = []struct {
+		name     string
+		limits   Limits
+		attempts int
+		isErr    bool
+	}{
+		{"no limits", Limits{}, 1, false},
+		{"fits", Limits{MaxBytes: 1 << 20}, 1, false},
+		{"shrinks", Limits{MaxBytes: 500}, 4, false},
+		{"too large", Limits{MaxBytes: 10}, maxShrinks + 1, true},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			var attempts []Limits
+			render := func(l Limits) (*Meme, error) {
+				attempts = append(attempts, l)
+				m := Meme{Still: noisyImage(image.Rect(0, 0, 20, 20), 1)}
+				return &m, m.Constrain(l)
+			}
+
+			data, err := EncodeWithin(tc.limits, FormatPNG, render)
+
+			s.Len(attempts, tc.attempts)
+			if tc.isErr {
+				s.True(errors.Is(err, ErrTooLarge))
+				return
+			}
+			s.Nil(err)
+			if tc.limits.MaxBytes > 0 {
+				s.True(len(data) <= tc.limits.MaxBytes)
+			}
+			if len(attempts) > 1 {
+				s.Equal(Limits{MaxWidth: 15, MaxHeight: 15, MaxBytes: tc.limits.MaxBytes}, attempts[1])
+			}
+		})
+	}
+}
+
+func (s *LimitsTestSuite) TestEncodeWithinError() {
+	attempts := 0
+	render := func(l Limits) (*Meme, error) {
+		attempts++
+		if attempts > 1 {
+			return nil, context.Canceled
+		}
+		m := Meme{Still: noisyImage(image.Rect(0, 0, 20, 20), 1)}
+		return &m, m.Constrain(l)
+	}
+
+	_, err := EncodeWithin(Limits{MaxBytes: 10}, FormatPNG, render)
+
+	s.Equal(2, attempts)
+	s.True(errors.Is(err, context.Canceled), "errors while shrinking should be returned unchanged")
+	s.False(errors.Is(err, ErrTooLarge))
+}
+
+func TestLimitsTestSuite(t *testing.T) {
+	suite.Run(t, new(LimitsTestSuite))
+}
@@ -0,0 +1,168 @@
+package img
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+)
+
+// OptimizeReport describes what Optimize did to a gif.
+type OptimizeReport struct {
+	FramesBefore, FramesAfter int
+	BytesBefore, BytesAfter   int
+}
+
+// Saved returns the number of bytes saved.
+func (r OptimizeReport) Saved() int {
+	return r.BytesBefore - r.BytesAfter
+}
+
+func (r OptimizeReport) String() string {
+	percent := 0.0
+	if r.BytesBefore > 0 {
+		percent = 100 * float64(r.Saved()) / float64(r.BytesBefore)
+	}
+	return fmt.Sprintf("saved %d bytes (%.1f%%): %d -> %d bytes, %d -> %d frames",
+		r.Saved(), percent, r.BytesBefore, r.BytesAfter, r.FramesBefore, r.FramesAfter)
+}
+
+// Optimize makes the gif of the meme smaller without changing how it looks: every
+// frame is cropped to the area that changed from the previous one, unchanged
+// pixels in that area become transparent, and frames identical to the previous
+// one are dropped, adding their delay to it. Animations with transparent areas are
+// left alone, as are the ones the optimization doesn't make any smaller.
+// Call it after Generate.
+func (m *Meme) Optimize() (OptimizeReport, error) {
+	var report OptimizeReport
+	if m.Gif == nil || len(m.Gif.Image) == 0 {
+		return report, nil
+	}
+	before, err := gifSize(m.Gif)
+	if err != nil {
+		return report, err
+	}
+	report.BytesBefore, report.BytesAfter = before, before
+	report.FramesBefore, report.FramesAfter = len(m.Gif.Image), len(m.Gif.Image)
+	optimized, ok := optimizeGIF(m.Gif)
+	if !ok {
+		return report, nil
+	}
+	after, err := gifSize(optimized)
+	if err != nil {
+		return report, err
+	}
+	if after < before {
+		m.Gif = optimized
+		report.BytesAfter, report.FramesAfter = after, len(optimized.Image)
+	}
+	return report, nil
+}
+
+// byteCounter is a writer that only counts what is written to it.
+type byteCounter int
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// gifSize returns the size of the encoded gif.
+func gifSize(g *gif.GIF) (int, error) {
+	var c byteCounter
+	err := gif.EncodeAll(&c, g)
+	return int(c), err
+}
+
+// optimizeGIF returns the optimized version of g, where every frame is drawn on
+// top of the previous ones. It returns false if the animation can't be optimized.
+func optimizeGIF(g *gif.GIF) (*gif.GIF, bool) {
+	out := &gif.GIF{Config: g.Config, LoopCount: g.LoopCount, BackgroundIndex: g.BackgroundIndex}
+	comp := NewCompositor(g)
+	var prev *image.RGBA
+	for canvas, i := comp.Next(); canvas != nil; canvas, i = comp.Next() {
+		// We can't make pixels transparent again without disposing of frames.
+		if !canvas.Opaque() {
+			return nil, false
+		}
+		delay := 0
+		if i < len(g.Delay) {
+			delay = g.Delay[i]
+		}
+		frame := g.Image[i]
+		if prev == nil {
+			// The canvas is opaque, so the first frame covers all of it.
+			prev = image.NewRGBA(canvas.Rect)
+		} else {
+			changed := diffBounds(prev, canvas)
+			if changed.Empty() {
+				out.Delay[len(out.Delay)-1] += delay
+				continue
+			}
+			var ok bool
+			if frame, ok = cropFrame(frame, changed, prev, canvas); !ok {
+				return nil, false
+			}
+		}
+		out.Image = append(out.Image, frame)
+		out.Delay = append(out.Delay, delay)
+		out.Disposal = append(out.Disposal, gif.DisposalNone)
+		copy(prev.Pix, canvas.Pix)
+	}
+	return out, true
+}
+
+// cropFrame returns the area r of the frame that turns prev into canvas. Pixels
+// that don't change are transparent, if the palette has room for it.
+func cropFrame(frame *image.Paletted, r image.Rectangle, prev, canvas *image.RGBA) (*image.Paletted, bool) {
+	p, transparent, hasTransparent := transparentIndex(frame.Palette)
+	dst := image.NewPaletted(r, p)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c := canvas.RGBAAt(x, y)
+			if hasTransparent && c == prev.RGBAAt(x, y) {
+				dst.SetColorIndex(x, y, transparent)
+				continue
+			}
+			if image.Pt(x, y).In(frame.Rect) {
+				if i := frame.ColorIndexAt(x, y); int(i) < len(frame.Palette) && sameColor(frame.Palette[i], c) {
+					dst.SetColorIndex(x, y, i)
+					continue
+				}
+			}
+			// The pixel comes from a frame restored by a disposal, look for its color.
+			i, ok := exactIndex(p, c)
+			if !ok {
+				return nil, false
+			}
+			dst.SetColorIndex(x, y, i)
+		}
+	}
+	return dst, true
+}
+
+// exactIndex returns the index of the color c in the palette, if it's there.
+func exactIndex(p color.Palette, c color.Color) (uint8, bool) {
+	for i, pc := range p {
+		if sameColor(pc, c) {
+			return uint8(i), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,103 @@
+package img
+
+import (
+	"image"
+	"image/gif"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type OptimizeTestSuite struct {
+	suite.Suite
+}
+
+// opaqueGif returns an animation where a green square moves over a red background,
+// stopping for a frame in the middle.
+func opaqueGif() *gif.GIF {
+	g := &gif.GIF{LoopCount: 3}
+	for i, x := range []int{0, 10, 10, 20} {
+		frame := solidFrame(image.Rect(0, 0, 40, 40), red)
+		for y := 10; y < 20; y++ {
+			for dx := 0; dx < 10; dx++ {
+				frame.Set(x+dx, y, green)
+			}
+		}
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10+i)
+		g.Disposal = append(g.Disposal, gif.DisposalNone)
+	}
+	return g
+}
+
+// sumDelay returns the total duration of the animation.
+func sumDelay(g *gif.GIF) int {
+	total := 0
+	for _, d := range g.Delay {
+		total += d
+	}
+	return total
+}
+
+func (s *OptimizeTestSuite) TestOptimize() {
+	g := opaqueGif()
+	expected := composite(g)
+	m := Meme{Gif: g}
+
+	report, err := m.Optimize()
+
+	s.Nil(err)
+	s.Equal(4, report.FramesBefore)
+	s.Equal(3, report.FramesAfter, "the repeated frame should be dropped")
+	s.True(report.Saved() > 0, "the gif should be smaller: %v", report)
+	s.Equal(report.BytesAfter, mustGifSize(m.Gif))
+	s.Equal(sumDelay(g), sumDelay(m.Gif), "the duration should not change")
+	s.Equal([]int{10, 11 + 12, 13}, m.Gif.Delay)
+	s.Equal(3, m.Gif.LoopCount)
+	s.Equal(image.Rect(0, 10, 20, 20), m.Gif.Image[1].Bounds(), "frames should only cover what changed")
+	actual := composite(m.Gif)
+	s.Equal(expected[0], actual[0])
+	s.Equal(expected[1], actual[1])
+	s.Equal(expected[3], actual[2])
+}
+
+func (s *OptimizeTestSuite) TestOptimizeDisposal() {
+	for _, tc := range disposalCases {
+		s.Run(tc.name, func() {
+			g := loadFixture("fixtures/disposal/" + tc.name + ".gif")
+			expected := composite(g)
+			m := Meme{Gif: g}
+			m.NormalizeImage()
+
+			report, err := m.Optimize()
+
+			s.Nil(err)
+			s.True(report.Saved() >= 0)
+			if tc.name == "background" {
+				s.Equal(0, report.Saved(), "animations with transparent areas should be left alone")
+			}
+			s.Equal(expected, composite(m.Gif), "the animation should look the same")
+		})
+	}
+}
+
+func (s *OptimizeTestSuite) TestOptimizeStill() {
+	m := Meme{Still: image.NewRGBA(image.Rect(0, 0, 4, 4))}
+
+	report, err := m.Optimize()
+
+	s.Nil(err)
+	s.Equal(OptimizeReport{}, report)
+}
+
+func mustGifSize(g *gif.GIF) int {
+	size, err := gifSize(g)
+	if err != nil {
+		panic(err)
+	}
+	return size
+}
+
+func TestOptimizeTestSuite(t *testing.T) {
+	suite.Run(t, new(OptimizeTestSuite))
+}
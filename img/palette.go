@@ -0,0 +1,124 @@
+package img
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// textColors returns the colors used to draw the text of all boxes.
+// Translucent colors are skipped, as they never end up on the image as they are.
+func (m *Meme) textColors() []color.Color {
+	var colors []color.Color
+	add := func(c color.Color, err error) {
+		if err != nil {
+			return
+		}
+		if _, _, _, a := c.RGBA(); a != 0xffff {
+			return
+		}
+		c = color.RGBAModel.Convert(c)
+		for _, existing := range colors {
+			if existing == c {
+				return
+			}
+		}
+		colors = append(colors, c)
+	}
+	for _, box := range *m.TextBoxes {
+		if box.Txt == nil || *box.Txt == "" {
+			continue
+		}
+		add(box.Style.FillColor())
+		if box.Layout == nil || box.Layout.Stroke > 0 {
+			add(box.Style.StrokeColor())
+		}
+	}
+	return colors
+}
+
+// sameColor returns true if the two colors are identical.
+func sameColor(a, b color.Color) bool {
+	r1, g1, b1, a1 := a.RGBA()
+	r2, g2, b2, a2 := b.RGBA()
+	return r1 == r2 && g1 == g2 && b1 == b2 && a1 == a2
+}
+
+// reservePalette returns a copy of the palette of frame that contains all the colors
+// exactly. Missing colors are appended if there's space left, otherwise they replace
+// the entries used by the fewest pixels of the frame. Transparent entries are never replaced.
+func reservePalette(frame *image.Paletted, colors []color.Color) color.Palette {
+	p := append(color.Palette{}, frame.Palette...)
+	reserved := make([]bool, 256)
+	var missing []color.Color
+	for _, c := range colors {
+		found := false
+		for i, entry := range p {
+			if sameColor(c, entry) {
+				reserved[i], found = true, true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, c)
+		}
+	}
+	var usage []int
+	for _, c := range missing {
+		if len(p) < 256 {
+			reserved[len(p)] = true
+			p = append(p, c)
+			continue
+		}
+		if usage == nil {
+			usage = make([]int, 256)
+			for _, idx := range frame.Pix {
+				usage[idx]++
+			}
+		}
+		victim := -1
+		for i, entry := range p {
+			if reserved[i] {
+				continue
+			}
+			if _, _, _, a := entry.RGBA(); a == 0 {
+				continue
+			}
+			if victim < 0 || usage[i] < usage[victim] {
+				victim = i
+			}
+		}
+		if victim < 0 {
+			break
+		}
+		// Pixels using the replaced entry will get the nearest remaining color when quantizing.
+		reserved[victim] = true
+		p[victim] = c
+	}
+	return p
+}
+
+// quantize converts an image to a paletted one, optionally dithering it.
+func (m *Meme) quantize(dst *image.Paletted, r image.Rectangle, src image.Image, sp image.Point) {
+	if m.Dither {
+		draw.FloydSteinberg.Draw(dst, r, src, sp)
+	} else {
+		draw.Draw(dst, r, src, sp, draw.Src)
+	}
+}
@@ -0,0 +1,112 @@
+package img
+
+import (
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+
+	"github.com/flopp/go-findfont"
+	"github.com/stretchr/testify/suite"
+)
+
+type PaletteTestSuite struct {
+	suite.Suite
+	fontPath string
+}
+
+func (s *PaletteTestSuite) SetupSuite() {
+	fontPath, err := findfont.Find(defaultFont)
+	if err != nil {
+		panic(err)
+	}
+	s.fontPath = fontPath
+}
+
+// redPalette returns a palette of n shades of red, with no white in it.
+func redPalette(n int) color.Palette {
+	var p color.Palette
+	for i := 0; i < n; i++ {
+		p = append(p, color.RGBA{uint8(i), 0, 0, 0xff})
+	}
+	return p
+}
+
+// redFrame returns a frame using the last used entries of the palette.
+func redFrame(p color.Palette, used int) *image.Paletted {
+	frame := image.NewPaletted(image.Rect(0, 0, 60, 40), p)
+	for i := range frame.Pix {
+		frame.Pix[i] = uint8(len(p) - used + i%used)
+	}
+	return frame
+}
+
+func (s *PaletteTestSuite) TestReservePalette() {
+	white := color.RGBA{0xff, 0xff, 0xff, 0xff}
+	black := color.RGBA{0, 0, 0, 0xff}
+	var testCases = []struct {
+		name    string
+		palette color.Palette
+		// expected index of white in the new palette
+		whiteAt int
+		length  int
+		// number of palette entries used by the frame
+		used int
+	}{
+		{"has space", redPalette(10), 10, 11, 10},
+		// black is at index 0, so the first unused entry is 1
+		{"full", redPalette(256), 1, 256, 10},
+		{"already there", append(redPalette(10), white), 10, 11, 10},
+		{"skips transparent", append(color.Palette{color.Transparent}, redPalette(255)...), 2, 256, 10},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			frame := redFrame(tc.palette, tc.used)
+			original := append(color.Palette{}, tc.palette...)
+
+			p := reservePalette(frame, []color.Color{white, black})
+
+			s.Len(p, tc.length)
+			s.Equal(white, p[tc.whiteAt])
+			s.Equal(black, p.Convert(black), "black should be in the palette")
+			s.Equal(original, tc.palette, "the original palette should not be modified")
+		})
+	}
+}
+
+func (s *PaletteTestSuite) TestTextColors() {
+	box := TextBox{Width: 50, Height: 20, Center: image.Point{30, 20}, FontPath: s.fontPath, LineSpacingRatio: 0.2}
+	s.Nil(box.SetText("hi", 20.0, 4.0))
+	empty := box
+	empty.Txt = new(string)
+	empty.Style = TextStyle{Fill: "#123456"}
+	box.Style = TextStyle{Fill: "#FF000080", Stroke: "#00F"}
+	m := Meme{TextBoxes: &[]TextBox{box, empty}}
+
+	s.Equal([]color.Color{color.RGBA{0, 0, 0xff, 0xff}}, m.textColors(), "translucent colors and empty boxes are skipped")
+}
+
+func (s *PaletteTestSuite) TestExactTextColors() {
+	for _, mode := range []RenderMode{RenderFull, RenderRegions} {
+		for _, dither := range []bool{false, true} {
+			box := TextBox{Width: 50, Height: 20, Center: image.Point{30, 20}, FontPath: s.fontPath, LineSpacingRatio: 0.2}
+			s.Nil(box.SetText("hi", 20.0, 4.0))
+			m := Meme{TextBoxes: &[]TextBox{box}, Mode: mode, Dither: dither}
+			m.Gif = &gif.GIF{Image: []*image.Paletted{redFrame(redPalette(256), 256)}, Delay: []int{10}}
+
+			s.Nil(m.Generate())
+
+			frame := m.Gif.Image[0]
+			counts := map[color.Color]int{}
+			for _, idx := range frame.Pix {
+				counts[frame.Palette[idx]]++
+			}
+			s.NotZero(counts[color.RGBA{0xff, 0xff, 0xff, 0xff}], "mode %s, dither %v: the fill should be white", mode, dither)
+			s.NotZero(counts[color.RGBA{0, 0, 0, 0xff}], "mode %s, dither %v: the stroke should be black", mode, dither)
+		}
+	}
+}
+
+func TestPaletteTestSuite(t *testing.T) {
+	suite.Run(t, new(PaletteTestSuite))
+}
@@ -0,0 +1,211 @@
+package img
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"sync"
+
+	"github.com/fogleman/gg"
+)
+
+// RenderMode determines how the text is added to the frames of a gif.
+type RenderMode string
+
+const (
+	// RenderFull normalizes every frame to the full size of the image,
+	// and draws the text on top of it. It's the default.
+	RenderFull RenderMode = "full"
+	// RenderRegions only adds to each frame the areas covered by the text boxes,
+	// keeping partial frames partial. The output is visually identical, but smaller.
+	RenderRegions RenderMode = "regions"
+)
+
+// ParseRenderMode checks a render mode is valid. The empty string means RenderFull.
+func ParseRenderMode(mode string) (RenderMode, error) {
+	switch RenderMode(mode) {
+	case "", RenderFull:
+		return RenderFull, nil
+	case RenderRegions:
+		return RenderRegions, nil
+	}
+	return "", fmt.Errorf("unknown render mode '%s'", mode)
+}
+
+// errNeedsFullRender is returned when a gif can't be rendered by regions.
+var errNeedsFullRender = errors.New("the gif needs to be rendered in full")
+
+// regionJob is a frame to be rendered in regions mode.
+type regionJob struct {
+	i int
+	// canvas is the displayed image, cropped to bounds
+	canvas *image.RGBA
+	bounds image.Rectangle
+	// painted are the areas of the frame that need to be painted; the rest is transparent
+	painted []image.Rectangle
+	palette color.Palette
+}
+
+// textRects returns the rectangles covered by the boxes with some text.
+func (m *Meme) textRects(canvas image.Rectangle) []image.Rectangle {
+	var rects []image.Rectangle
+	for _, box := range *m.TextBoxes {
+		if box.Txt == nil || *box.Txt == "" {
+			continue
+		}
+		topLeft := box.Center.Sub(image.Point{box.Width / 2, box.Height / 2})
+		r := image.Rectangle{topLeft, topLeft.Add(image.Point{box.Width, box.Height})}.Intersect(canvas)
+		if !r.Empty() {
+			rects = append(rects, r)
+		}
+	}
+	return rects
+}
+
+// transparentIndex returns the index of a fully transparent color in the palette,
+// adding it if there's space left. It returns false if there is no such color.
+func transparentIndex(p color.Palette) (color.Palette, uint8, bool) {
+	for i, c := range p {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return p, uint8(i), true
+		}
+	}
+	if len(p) < 256 {
+		p = append(p[:len(p):len(p)], color.RGBA{})
+		return p, uint8(len(p) - 1), true
+	}
+	return p, 0, false
+}
+
+// produceRegions composites the frames in order, and sends them to be rendered.
+// We need to paint the frame itself, the text boxes and, if the previous frame
+// was disposed of, the area it covered, as what's beneath might have changed.
+func (m *Meme) produceRegions(ctx context.Context, jobs chan<- regionJob) error {
+	defer close(jobs)
+	comp := NewCompositor(m.Gif)
+	text := m.textRects(comp.canvas.Bounds())
+	colors := m.textColors()
+	for {
+		canvas, i := comp.Next()
+		if canvas == nil {
+			return nil
+		}
+		frame := m.Gif.Image[i]
+		painted := append([]image.Rectangle{frame.Bounds()}, text...)
+		if i > 0 && comp.Disposal(i-1) != gif.DisposalNone {
+			painted = append(painted, m.Gif.Image[i-1].Bounds())
+		}
+		var bounds image.Rectangle
+		for _, r := range painted {
+			bounds = bounds.Union(r)
+		}
+		bounds = bounds.Intersect(canvas.Bounds())
+		crop := image.NewRGBA(bounds)
+		draw.Draw(crop, bounds, canvas, bounds.Min, draw.Src)
+		// With disposal none, we can't make a pixel go back to transparent.
+		if i > 0 {
+			for _, r := range painted {
+				if !isOpaque(crop.SubImage(r.Intersect(bounds)).(*image.RGBA)) {
+					return errNeedsFullRender
+				}
+			}
+		}
+		job := regionJob{i: i, canvas: crop, bounds: bounds, painted: painted, palette: reservePalette(frame, colors)}
+		select {
+		case jobs <- job:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// isOpaque is like image.RGBA.Opaque, but correctly handles empty images.
+func isOpaque(img *image.RGBA) bool {
+	return img.Bounds().Empty() || img.Opaque()
+}
+
+// renderRegion draws the text on a composited frame, and converts it back to a paletted image.
+func (m *Meme) renderRegion(job regionJob) (*image.Paletted, error) {
+	// Text is drawn in image coordinates, so the crop works as a clipping mask.
+	if err := m.drawBoxes(gg.NewContextForRGBA(job.canvas)); err != nil {
+		return nil, fmt.Errorf("frame %d: %v", job.i, err)
+	}
+	palette, transparent, ok := transparentIndex(job.palette)
+	out := image.NewPaletted(job.bounds, palette)
+	if !ok {
+		// No transparency available, paint everything.
+		m.quantize(out, job.bounds, job.canvas, job.bounds.Min)
+		return out, nil
+	}
+	for i := range out.Pix {
+		out.Pix[i] = transparent
+	}
+	for _, r := range job.painted {
+		r = r.Intersect(job.bounds)
+		m.quantize(out, r, job.canvas, r.Min)
+	}
+	return out, nil
+}
+
+// generateRegions renders the meme in RenderRegions mode.
+func (m *Meme) generateRegions(ctx context.Context, workers int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	jobs := make(chan regionJob)
+	// The frames are only swapped in at the end, so that we can fall back to a full render.
+	out := make([]*image.Paletted, len(m.Gif.Image))
+	errs := make(chan error, workers+1)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				frame, err := m.renderRegion(job)
+				if err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+				out[job.i] = frame
+			}
+		}()
+	}
+	if err := m.produceRegions(ctx, jobs); err != nil && err != context.Canceled {
+		errs <- err
+	}
+	wg.Wait()
+	select {
+	case err := <-errs:
+		return err
+	default:
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	copy(m.Gif.Image, out)
+	for i := range m.Gif.Disposal {
+		m.Gif.Disposal[i] = gif.DisposalNone
+	}
+	return nil
+}
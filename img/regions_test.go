@@ -0,0 +1,132 @@
+package img
+
+import (
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"testing"
+
+	"github.com/flopp/go-findfont"
+	"github.com/stretchr/testify/suite"
+)
+
+type RegionsTestSuite struct {
+	suite.Suite
+	fontPath string
+}
+
+func (s *RegionsTestSuite) SetupSuite() {
+	fontPath, err := findfont.Find(defaultFont)
+	if err != nil {
+		panic(err)
+	}
+	s.fontPath = fontPath
+}
+
+// partialMeme returns a meme on a small gif where all frames but the first
+// only cover part of the image.
+func (s *RegionsTestSuite) partialMeme(first color.Color) *Meme {
+	g := gif.GIF{Config: image.Config{Width: 120, Height: 80}}
+	for i := 0; i < 6; i++ {
+		r := image.Rect(0, 0, 120, 80)
+		if i > 0 {
+			r = image.Rect(10*i, 40, 10*i+30, 70)
+		}
+		p := palette.Plan9
+		if i == 0 {
+			p = append(color.Palette{first}, p[1:]...)
+		}
+		frame := image.NewPaletted(r, p)
+		for x := r.Min.X; x < r.Max.X; x++ {
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				if i == 0 {
+					frame.Set(x, y, first)
+				} else {
+					frame.SetColorIndex(x, y, uint8(i*40+x))
+				}
+			}
+		}
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10)
+		g.Disposal = append(g.Disposal, gif.DisposalNone)
+	}
+	box := TextBox{Width: 100, Height: 30, Center: image.Point{60, 20}, FontPath: s.fontPath, LineSpacingRatio: 0.2}
+	if err := box.SetText("test", 52.0, 8.0); err != nil {
+		panic(err)
+	}
+	return &Meme{Gif: &g, TextBoxes: &[]TextBox{box}}
+}
+
+// composite returns all the frames of the gif, as they are displayed.
+func composite(g *gif.GIF) []*image.RGBA {
+	var frames []*image.RGBA
+	comp := NewCompositor(g)
+	for canvas, _ := comp.Next(); canvas != nil; canvas, _ = comp.Next() {
+		frame := image.NewRGBA(canvas.Bounds())
+		copy(frame.Pix, canvas.Pix)
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+func (s *RegionsTestSuite) TestRegionsMatchFull() {
+	full := s.partialMeme(color.White)
+	s.Nil(full.Generate())
+	regions := s.partialMeme(color.White)
+	regions.Mode = RenderRegions
+	s.Nil(regions.Generate())
+
+	s.Equal(composite(full.Gif), composite(regions.Gif), "the two modes should render the same animation")
+	for i, frame := range regions.Gif.Image[1:] {
+		s.NotEqual(image.Rect(0, 0, 120, 80), frame.Bounds(), "frame %d should not be full size", i+1)
+		s.True(frame.Bounds().Overlaps(image.Rect(10, 5, 110, 35)), "frame %d should include the text", i+1)
+	}
+}
+
+func (s *RegionsTestSuite) TestRegionsDisposal() {
+	for _, tc := range disposalCases {
+		s.Run(tc.name, func() {
+			var results [][]*image.RGBA
+			for _, mode := range []RenderMode{RenderFull, RenderRegions} {
+				box := TextBox{Width: 30, Height: 10, Center: image.Point{20, 34}, FontPath: s.fontPath, LineSpacingRatio: 0.2}
+				s.Nil(box.SetText("ok", 12.0, 4.0))
+				m := Meme{Gif: loadFixture("fixtures/disposal/" + tc.name + ".gif"), TextBoxes: &[]TextBox{box}, Mode: mode}
+
+				s.Nil(m.Generate())
+
+				results = append(results, composite(m.Gif))
+			}
+			s.Equal(results[0], results[1], "the two modes should render the same animation")
+		})
+	}
+}
+
+func (s *RegionsTestSuite) TestRegionsFallback() {
+	// A transparent background can't be painted over with disposal none.
+	m := s.partialMeme(color.Transparent)
+	m.Mode = RenderRegions
+
+	s.Nil(m.Generate())
+
+	for i, frame := range m.Gif.Image {
+		s.Equal(image.Rect(0, 0, 120, 80), frame.Bounds(), "frame %d should have been normalized", i)
+	}
+}
+
+func (s *RegionsTestSuite) TestTransparentIndex() {
+	p, idx, ok := transparentIndex(color.Palette{color.Black, color.White})
+	s.True(ok)
+	s.Equal(uint8(2), idx)
+	s.Len(p, 3)
+	p, idx, ok = transparentIndex(color.Palette{color.Black, color.Transparent})
+	s.True(ok)
+	s.Equal(uint8(1), idx)
+	s.Len(p, 2)
+	_, _, ok = transparentIndex(palette.Plan9)
+	s.False(ok)
+}
+
+func TestRegionsTestSuite(t *testing.T) {
+	suite.Run(t, new(RegionsTestSuite))
+}
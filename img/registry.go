@@ -0,0 +1,206 @@
+package img
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// templateExtensions are the file extensions recognized as template files.
+var templateExtensions = map[string]bool{".yaml": true, ".yml": true, ".json": true}
+
+// LoadErrors collects the errors found while loading the templates in a directory.
+type LoadErrors []error
+
+func (e LoadErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Registry holds the meme templates found in a directory,
+// indexed by name. It is safe for concurrent use.
+type Registry struct {
+	// Dir is the directory the templates are loaded from
+	Dir       string
+	mux       sync.RWMutex
+	templates map[string]*MemeTemplate
+}
+
+// NewRegistry returns an empty registry for the templates in dir.
+// Call Load to actually read the templates.
+func NewRegistry(dir string) *Registry {
+	return &Registry{Dir: dir, templates: make(map[string]*MemeTemplate)}
+}
+
+// Load (re)reads all the templates in the registry directory, replacing the
+// ones currently loaded. Invalid templates are skipped, and reported
+// in the returned LoadErrors.
+func (r *Registry) Load() error {
+	files, err := ioutil.ReadDir(r.Dir)
+	if err != nil {
+		return err
+	}
+	templates := make(map[string]*MemeTemplate)
+	var errs LoadErrors
+	for _, file := range files {
+		if file.IsDir() || !templateExtensions[filepath.Ext(file.Name())] {
+			continue
+		}
+		tpl, err := LoadTemplate(filepath.Join(r.Dir, file.Name()))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, ok := templates[tpl.Name()]; ok {
+			errs = append(errs, fmt.Errorf("%s: duplicate template name %s", file.Name(), tpl.Name()))
+			continue
+		}
+		templates[tpl.Name()] = tpl
+	}
+	r.mux.Lock()
+	r.templates = templates
+	r.mux.Unlock()
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Get returns the template with the given name.
+func (r *Registry) Get(name string) (*MemeTemplate, bool) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	tpl, ok := r.templates[name]
+	return tpl, ok
+}
+
+// List returns all the templates, sorted by name.
+func (r *Registry) List() []*MemeTemplate {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	templates := make([]*MemeTemplate, 0, len(r.templates))
+	for _, tpl := range r.templates {
+		templates = append(templates, tpl)
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name() < templates[j].Name() })
+	return templates
+}
+
+// ErrTemplateExists is returned when adding a template with the
+// same name as one already in the registry.
+var ErrTemplateExists = errors.New("template already exists")
+
+// ErrInvalidTemplate is returned when adding a template that doesn't pass validation.
+var ErrInvalidTemplate = errors.New("invalid template")
+
+// validName is the format of the names of templates that can be added to the registry.
+var validName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Add validates a new template and saves it in the registry directory,
+// so that it will survive a reload. If image is not nil, it is saved
+// alongside the template and used as its base image; else the spec
+// must point to an existing image.
+func (r *Registry) Add(spec *TemplateSpec, image io.Reader) (*MemeTemplate, error) {
+	if !validName.MatchString(spec.Name) {
+		return nil, fmt.Errorf("%w: the name must only contain letters, numbers, '_' and '-'", ErrInvalidTemplate)
+	}
+	// We hold the write lock for the whole operation so that two uploads
+	// of the same template can't race each other.
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if _, ok := r.templates[spec.Name]; ok {
+		return nil, ErrTemplateExists
+	}
+	tplPath := filepath.Join(r.Dir, spec.Name+".yaml")
+	if _, err := os.Stat(tplPath); !os.IsNotExist(err) {
+		return nil, ErrTemplateExists
+	}
+	if image != nil {
+		tmpPath, err := writeTemp(r.Dir, image)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(tmpPath)
+		spec.Image = tmpPath
+		if _, err := spec.Validate(); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidTemplate, err)
+		}
+		// The image has been validated, so we know its format.
+		_, format, err := spec.imageConfig()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidTemplate, err)
+		}
+		imgPath := filepath.Join(r.Dir, spec.Name+format.Extension())
+		if _, err := os.Stat(imgPath); !os.IsNotExist(err) {
+			return nil, ErrTemplateExists
+		}
+		if err := os.Rename(tmpPath, imgPath); err != nil {
+			return nil, err
+		}
+		// Store the path relative to the template, so that the directory can be moved around.
+		spec.Image = filepath.Base(imgPath)
+	} else if _, err := spec.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTemplate, err)
+	}
+	data, err := yaml.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	tmpPath, err := writeTemp(r.Dir, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpPath)
+	if err := os.Rename(tmpPath, tplPath); err != nil {
+		return nil, err
+	}
+	tpl, err := LoadTemplate(tplPath)
+	if err != nil {
+		return nil, err
+	}
+	r.templates[tpl.Name()] = tpl
+	return tpl, nil
+}
+
+// writeTemp copies the content of the reader into a temporary file in dir, and returns its path.
+func writeTemp(dir string, content io.Reader) (string, error) {
+	tmp, err := ioutil.TempFile(dir, ".upload-")
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+	if _, err := io.Copy(tmp, content); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
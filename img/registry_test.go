@@ -0,0 +1,165 @@
+package img
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type RegistryTestSuite struct {
+	suite.Suite
+	TempDir string
+}
+
+func (s *RegistryTestSuite) SetupTest() {
+	tempdir, err := ioutil.TempDir("", "memeoid-registry")
+	if err != nil {
+		panic(err)
+	}
+	s.TempDir = tempdir
+}
+
+func (s *RegistryTestSuite) TearDownTest() {
+	os.RemoveAll(s.TempDir)
+}
+
+func (s *RegistryTestSuite) writeTemplate(name string, content string) {
+	err := ioutil.WriteFile(filepath.Join(s.TempDir, name), []byte(content), 0644)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (s *RegistryTestSuite) TestLoad() {
+	sut := NewRegistry("fixtures/templates")
+
+	err := sut.Load()
+
+	s.Nil(err, "error loading the templates: %v", err)
+	templates := sut.List()
+	s.Len(templates, 2)
+	s.Equal("earth", templates[0].Name())
+	s.Equal("first-man-in-space", templates[1].Name())
+	_, ok := sut.Get("earth")
+	s.True(ok, "the earth template should be found")
+	_, ok = sut.Get("gagarin")
+	s.False(ok, "templates are indexed by name, not by file name")
+}
+
+func (s *RegistryTestSuite) TestLoadNonExistentDir() {
+	sut := NewRegistry("fixtures/non-existent")
+
+	s.Error(sut.Load())
+	s.Empty(sut.List())
+}
+
+func (s *RegistryTestSuite) TestLoadSkipsInvalidTemplates() {
+	earth, err := filepath.Abs("fixtures/earth.gif")
+	s.Nil(err)
+	box := "boxes: [{x: 0, y: 0, width: 100, height: 100}]\n"
+	s.writeTemplate("good.yaml", "image: "+earth+"\nfont: DejaVuSans\n"+box)
+	s.writeTemplate("bad.yml", "image: "+earth+"\nfont: DejaVuSans\n")
+	s.writeTemplate("dup.json", `{"name": "good", "image": "`+earth+`", "font": "DejaVuSans", "boxes": [{"x": 0, "y": 0, "width": 10, "height": 10}]}`)
+	s.writeTemplate("README.txt", "not a template")
+	sut := NewRegistry(s.TempDir)
+
+	err = sut.Load()
+
+	s.IsType(LoadErrors{}, err)
+	s.Len(err, 2)
+	s.Len(sut.List(), 1)
+	_, ok := sut.Get("good")
+	s.True(ok, "valid templates should be loaded anyways")
+
+	// Reloading picks up changes
+	s.Nil(os.Remove(filepath.Join(s.TempDir, "good.yaml")))
+	s.Nil(os.Remove(filepath.Join(s.TempDir, "bad.yml")))
+	s.Nil(sut.Load())
+	_, ok = sut.Get("good")
+	s.True(ok, "the duplicate should now be loaded")
+}
+
+func (s *RegistryTestSuite) TestAdd() {
+	earth, err := os.Open("fixtures/earth.gif")
+	s.Nil(err)
+	defer earth.Close()
+	sut := NewRegistry(s.TempDir)
+	spec := TemplateSpec{
+		Name:  "uploaded",
+		Image: "whatever.gif",
+		Font:  "DejaVuSans",
+		Boxes: []BoxSpec{{X: 0, Y: 0, Width: 100, Height: 100}},
+	}
+
+	tpl, err := sut.Add(&spec, earth)
+
+	s.Nil(err, "error adding the template: %v", err)
+	s.Equal("uploaded", tpl.Name())
+	s.FileExists(filepath.Join(s.TempDir, "uploaded.yaml"))
+	s.FileExists(filepath.Join(s.TempDir, "uploaded.gif"))
+	_, ok := sut.Get("uploaded")
+	s.True(ok)
+	// The template survives a reload
+	s.Nil(sut.Load())
+	_, ok = sut.Get("uploaded")
+	s.True(ok)
+	// And can't be added twice
+	_, err = sut.Add(&spec, nil)
+	s.True(errors.Is(err, ErrTemplateExists))
+}
+
+func (s *RegistryTestSuite) TestAddStill() {
+	still, err := os.Open("fixtures/gagarin.jpg")
+	s.Nil(err)
+	defer still.Close()
+	sut := NewRegistry(s.TempDir)
+	spec := TemplateSpec{
+		Name:  "still",
+		Image: "whatever.gif",
+		Font:  "DejaVuSans",
+		Boxes: []BoxSpec{{X: 0, Y: 0, Width: 100, Height: 100}},
+	}
+
+	tpl, err := sut.Add(&spec, still)
+
+	s.Nil(err, "error adding the template: %v", err)
+	s.Equal(FormatJPEG, tpl.Format())
+	s.FileExists(filepath.Join(s.TempDir, "still.jpg"), "the extension should match the content of the image")
+	s.Equal("still.jpg", spec.Image)
+}
+
+func (s *RegistryTestSuite) TestAddInvalid() {
+	earth, err := filepath.Abs("fixtures/earth.gif")
+	s.Nil(err)
+	var testCases = []struct {
+		name  string
+		image string
+		boxes []BoxSpec
+	}{
+		{"../escape", earth, []BoxSpec{{X: 0, Y: 0, Width: 10, Height: 10}}},
+		{"", earth, []BoxSpec{{X: 0, Y: 0, Width: 10, Height: 10}}},
+		{"outside", earth, []BoxSpec{{X: 0, Y: 0, Width: 1000, Height: 10}}},
+		{"badgif", "fixtures/badfile.gif", []BoxSpec{{X: 0, Y: 0, Width: 10, Height: 10}}},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			sut := NewRegistry(s.TempDir)
+			spec := TemplateSpec{Name: tc.name, Image: tc.image, Font: "DejaVuSans", Boxes: tc.boxes}
+
+			_, err := sut.Add(&spec, nil)
+
+			s.True(errors.Is(err, ErrInvalidTemplate), "expected an invalid template error, got %v", err)
+			s.Empty(sut.List())
+			files, _ := ioutil.ReadDir(s.TempDir)
+			s.Empty(files, "nothing should be left on disk")
+		})
+	}
+}
+
+func TestRegistryTestSuite(t *testing.T) {
+	suite.Run(t, new(RegistryTestSuite))
+}
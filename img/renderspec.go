@@ -0,0 +1,193 @@
+package img
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/color"
+	"io"
+	"io/ioutil"
+)
+
+// RendererVersion is part of the ID of every meme. Bump it whenever a change
+// makes the same RenderSpec look different, so that the memes generated by
+// older versions are made again instead of being served.
+const RendererVersion = 1
+
+// RenderSpec is the canonical description of a meme: everything that changes
+// how it looks, and nothing else.
+type RenderSpec struct {
+	// Source is the hash of the content of the base image; see HashImage.
+	Source string `json:"source"`
+	// Template is the template the meme is made from, without its image.
+	// It's nil for the simple memes of SimpleTemplate.
+	Template  *TemplateSpec `json:"template,omitempty"`
+	Text      []string      `json:"text"`
+	Style     TextStyle     `json:"style"`
+	Transform Transform     `json:"transform"`
+	Format    Format        `json:"format"`
+	// The options of the renderer.
+	Font     string     `json:"font"`
+	Mode     RenderMode `json:"mode"`
+	Dither   bool       `json:"dither"`
+	Optimize bool       `json:"optimize"`
+	Limits   Limits     `json:"limits"`
+	// Frames is the number of frames of the base image. It's only used to
+	// tell which transforms are equivalent, as Source already identifies the image.
+	Frames int `json:"-"`
+}
+
+// ID returns a stable identifier of the meme, which changes with the spec and
+// with RendererVersion. Equivalent ways of writing colors give the same ID, and
+// so do equivalent trims if Frames is set.
+func (s RenderSpec) ID() (string, error) {
+	var err error
+	if s.Style, err = s.Style.canonical(); err != nil {
+		return "", err
+	}
+	if s.Frames > 0 {
+		s.Transform.Trim = s.Transform.Trim.Normalize(s.Frames)
+	}
+	if s.Template != nil {
+		tpl := *s.Template
+		tpl.Image = ""
+		s.Template = &tpl
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("v%d-%x", RendererVersion, sum[:20]), nil
+}
+
+// canonical returns the style with colors written as #rrggbbaa.
+func (s TextStyle) canonical() (TextStyle, error) {
+	for _, c := range []*string{&s.Fill, &s.Stroke} {
+		if *c == "" {
+			continue
+		}
+		parsed, err := ParseHexColor(*c)
+		if err != nil {
+			return s, err
+		}
+		rgba := parsed.(color.NRGBA)
+		*c = fmt.Sprintf("#%02x%02x%02x%02x", rgba.R, rgba.G, rgba.B, rgba.A)
+	}
+	return s, nil
+}
+
+// HashImage returns the hash of the content of an image.
+func HashImage(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// ImageInfo identifies an image, and tells how many frames it has.
+type ImageInfo struct {
+	Format Format
+	// Hash is the hash of the content of the image; see HashImage.
+	Hash   string
+	Frames int
+}
+
+// IdentifyImage returns the ImageInfo of an image, without decoding it.
+func IdentifyImage(r io.Reader) (ImageInfo, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	_, format, err := decodeImageConfig(bytes.NewReader(data))
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	hash, err := HashImage(bytes.NewReader(data))
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	info := ImageInfo{Format: format, Hash: hash, Frames: 1}
+	if format == FormatGIF {
+		if info.Frames, err = countFrames(data); err != nil {
+			return ImageInfo{}, err
+		}
+	}
+	return info, nil
+}
+
+// errTruncatedGif is returned when a gif ends before its trailer.
+var errTruncatedGif = errors.New("gif: truncated")
+
+// countFrames counts the images in a gif, skipping over the blocks without
+// decompressing them.
+func countFrames(data []byte) (int, error) {
+	// The header and the logical screen descriptor.
+	pos := 13
+	if len(data) < pos {
+		return 0, errTruncatedGif
+	}
+	if data[10]&0x80 != 0 {
+		pos += 3 << (uint(data[10]&0x07) + 1)
+	}
+	// skipSubBlocks moves pos past a sequence of data sub-blocks.
+	skipSubBlocks := func() error {
+		for {
+			if pos >= len(data) {
+				return errTruncatedGif
+			}
+			size := int(data[pos])
+			pos += size + 1
+			if size == 0 {
+				return nil
+			}
+		}
+	}
+	frames := 0
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21:
+			// An extension: its label, then the sub-blocks.
+			pos += 2
+		case 0x2c:
+			// An image descriptor, its local color table and the lzw minimum code size.
+			if pos+10 > len(data) {
+				return 0, errTruncatedGif
+			}
+			packed := data[pos+9]
+			pos += 10
+			if packed&0x80 != 0 {
+				pos += 3 << (uint(packed&0x07) + 1)
+			}
+			pos++
+			frames++
+		case 0x3b:
+			return frames, nil
+		default:
+			return 0, fmt.Errorf("gif: unknown block type 0x%02x", data[pos])
+		}
+		if err := skipSubBlocks(); err != nil {
+			return 0, err
+		}
+	}
+	return 0, errTruncatedGif
+}
@@ -0,0 +1,126 @@
+package img
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type RenderSpecTestSuite struct {
+	suite.Suite
+}
+
+func (s *RenderSpecTestSuite) base() RenderSpec {
+	return RenderSpec{Source: "abc", Text: []string{"top", "bottom"}, Format: FormatGIF, Font: defaultFont}
+}
+
+func (s *RenderSpecTestSuite) id(spec RenderSpec) string {
+	id, err := spec.ID()
+	s.Require().Nil(err)
+	return id
+}
+
+func (s *RenderSpecTestSuite) TestID() {
+	id := s.id(s.base())
+	s.True(strings.HasPrefix(id, fmt.Sprintf("v%d-", RendererVersion)))
+	s.Len(id, len(fmt.Sprintf("v%d-", RendererVersion))+40)
+	s.Equal(id, s.id(s.base()), "the ID is stable")
+
+	width := 2.0
+	changes := map[string]func(*RenderSpec){
+		"source":    func(r *RenderSpec) { r.Source = "def" },
+		"text":      func(r *RenderSpec) { r.Text = []string{"top", "Bottom"} },
+		"style":     func(r *RenderSpec) { r.Style.StrokeWidth = &width },
+		"transform": func(r *RenderSpec) { r.Transform.Reverse = true },
+		"format":    func(r *RenderSpec) { r.Format = FormatWebP },
+		"template":  func(r *RenderSpec) { r.Template = &TemplateSpec{Name: "earth"} },
+		"renderer":  func(r *RenderSpec) { r.Mode = RenderRegions },
+		"limits":    func(r *RenderSpec) { r.Limits.MaxWidth = 100 },
+	}
+	for name, change := range changes {
+		s.Run(name, func() {
+			spec := s.base()
+			change(&spec)
+			s.NotEqual(id, s.id(spec))
+		})
+	}
+}
+
+func (s *RenderSpecTestSuite) TestCanonical() {
+	spec := s.base()
+	spec.Style.Fill = "FFF"
+	other := s.base()
+	other.Style.Fill = "#ffffffff"
+	s.Equal(s.id(spec), s.id(other), "colors are compared by value")
+
+	// Where the template image is stored doesn't matter, only its content does.
+	spec.Template = &TemplateSpec{Name: "earth", Image: "/srv/earth.gif"}
+	other.Template = &TemplateSpec{Name: "earth", Image: "/tmp/earth.gif"}
+	s.Equal(s.id(spec), s.id(other))
+	s.Equal("/srv/earth.gif", spec.Template.Image, "the spec is not modified")
+
+	spec.Style.Fill = "white"
+	_, err := spec.ID()
+	s.Error(err)
+}
+
+func (s *RenderSpecTestSuite) TestHash() {
+	src, err := DecodeSource(filesystem{}, "fixtures/gagarin.gif")
+	s.Require().Nil(err)
+	tpl := MemeTemplate{imagePath: "fixtures/gagarin.gif"}
+	hash, err := tpl.ImageHash()
+	s.Nil(err)
+	s.Equal(src.Hash, hash)
+	s.Len(hash, 64)
+
+	other, err := DecodeSource(filesystem{}, "fixtures/gagarin.png")
+	s.Require().Nil(err)
+	s.NotEqual(src.Hash, other.Hash)
+
+	earth, err := DecodeSource(filesystem{}, "fixtures/earth.gif")
+	s.Require().Nil(err)
+	for _, decoded := range []*Source{src, other, earth} {
+		data, err := ioutil.ReadFile(decoded.Name)
+		s.Require().Nil(err)
+		info, err := IdentifyImage(bytes.NewReader(data))
+		s.Nil(err)
+		s.Equal(decoded.Info(), info, "identifying an image should not need decoding it")
+	}
+	s.Equal(len(earth.Gif.Image), earth.Info().Frames)
+	_, err = IdentifyImage(strings.NewReader("not an image"))
+	s.Error(err)
+	data, err := ioutil.ReadFile("fixtures/earth.gif")
+	s.Require().Nil(err)
+	_, err = IdentifyImage(bytes.NewReader(data[:len(data)/2]))
+	s.Error(err, "truncated gifs should be detected")
+
+	loaded, err := LoadTemplate("fixtures/templates/earth.yaml")
+	s.Require().Nil(err)
+	s.NotNil(loaded.imageInfo, "templates read their image when loaded")
+}
+
+func (s *RenderSpecTestSuite) TestTrim() {
+	spec := s.base()
+	spec.Frames = 4
+	all := s.id(spec)
+	for _, trim := range []*FrameRange{{0, -1}, {0, 4}, {0, 10}} {
+		spec.Transform.Trim = trim
+		s.Equal(all, s.id(spec), "trimming %v keeps all the frames", *trim)
+	}
+
+	spec.Transform.Trim = &FrameRange{1, -1}
+	partial := s.id(spec)
+	s.NotEqual(all, partial)
+	spec.Transform.Trim = &FrameRange{1, 4}
+	s.Equal(partial, s.id(spec))
+	spec.Transform.Trim = &FrameRange{1, 3}
+	s.NotEqual(partial, s.id(spec))
+}
+
+func TestRenderSpecTestSuite(t *testing.T) {
+	suite.Run(t, new(RenderSpecTestSuite))
+}
@@ -0,0 +1,104 @@
+package img
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"bytes"
+	"image"
+	"image/gif"
+	"io/ioutil"
+)
+
+// Source is a decoded base image. Memes made from it share its frames, which
+// are never modified in place, so it can be kept in memory and reused.
+type Source struct {
+	Name   string
+	Format Format
+	Config image.Config
+	Gif    *gif.GIF
+	Still  image.Image
+	// Hash is the hash of the content of the image; see HashImage.
+	Hash string
+}
+
+// DecodeSource reads the image with the given name in src, and decodes it.
+func DecodeSource(src ImageSource, name string) (*Source, error) {
+	r, err := src.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	cfg, format, err := decodeImageConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	hash, err := HashImage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	s := &Source{Name: name, Format: format, Config: cfg, Hash: hash}
+	if format == FormatGIF {
+		s.Gif, err = gif.DecodeAll(bytes.NewReader(data))
+	} else {
+		s.Still, _, err = image.Decode(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Info returns the ImageInfo of the image.
+func (s *Source) Info() ImageInfo {
+	frames := 1
+	if s.Gif != nil {
+		frames = len(s.Gif.Image)
+	}
+	return ImageInfo{Format: s.Format, Hash: s.Hash, Frames: frames}
+}
+
+// Size returns roughly how many bytes of memory the decoded image takes.
+func (s *Source) Size() int64 {
+	if s.Gif == nil {
+		b := s.Still.Bounds()
+		return int64(b.Dx()) * int64(b.Dy()) * 4
+	}
+	var size int64
+	for _, frame := range s.Gif.Image {
+		size += int64(len(frame.Pix) + 4*len(frame.Palette))
+	}
+	return size
+}
+
+// copyGif returns a copy of the gif that a meme can modify. Frames are shared.
+func (s *Source) copyGif() *gif.GIF {
+	g := *s.Gif
+	g.Image = append([]*image.Paletted(nil), s.Gif.Image...)
+	g.Delay = append([]int(nil), s.Gif.Delay...)
+	g.Disposal = append([]byte(nil), s.Gif.Disposal...)
+	return &g
+}
+
+// Meme returns a meme of the image with no text boxes, like LoadImage.
+func (s *Source) Meme() (*Meme, error) {
+	tpl := MemeTemplate{imagePath: s.Name, format: s.Format, decoded: s}
+	return tpl.GetMeme()
+}
@@ -0,0 +1,88 @@
+package img
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type SourceTestSuite struct {
+	suite.Suite
+}
+
+func (s *SourceTestSuite) TestDecodeSource() {
+	var testCases = []struct {
+		path   string
+		format Format
+	}{
+		{"fixtures/earth.gif", FormatGIF},
+		{"fixtures/gagarin.png", FormatPNG},
+		{"fixtures/gagarin.jpg", FormatJPEG},
+		{"fixtures/badfile.gif", ""},
+		{"fixtures/templates/earth.yaml", ""},
+		{"fixtures/missing.gif", ""},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.path, func() {
+			src, err := DecodeSource(filesystem{}, tc.path)
+
+			if tc.format == "" {
+				s.Error(err)
+				return
+			}
+			s.Require().Nil(err)
+			s.Equal(tc.path, src.Name)
+			s.Equal(tc.format, src.Format)
+			s.Equal(tc.format == FormatGIF, src.Gif != nil)
+			s.Equal(tc.format != FormatGIF, src.Still != nil)
+			cfg, _, err := DecodeImageConfig(tc.path)
+			s.Nil(err)
+			s.Equal(cfg, src.Config)
+			s.True(src.Size() >= int64(cfg.Width*cfg.Height), "the size is at least one byte per pixel")
+		})
+	}
+}
+
+// TestShared checks that memes made from a decoded image leave it untouched.
+func (s *SourceTestSuite) TestShared() {
+	src, err := DecodeSource(filesystem{}, "fixtures/gagarin.gif")
+	s.Require().Nil(err)
+	frames := append(src.Gif.Image[:0:0], src.Gif.Image...)
+	delays := append(src.Gif.Delay[:0:0], src.Gif.Delay...)
+	tpl, err := SimpleTemplateFor(src, defaultFont, 52.0, 8.0)
+	s.Require().Nil(err)
+	s.Equal(FormatGIF, tpl.Format())
+
+	for i := 0; i < 2; i++ {
+		meme, err := tpl.GetMeme("top", "bottom")
+		s.Require().Nil(err)
+		s.Require().Nil(meme.Transform(Transform{Speed: 2, Reverse: true}))
+		s.Require().Nil(meme.Generate())
+	}
+
+	s.Equal(frames, src.Gif.Image)
+	s.Equal(delays, src.Gif.Delay)
+	for i, frame := range src.Gif.Image {
+		s.True(frame == frames[i], "frame %d was replaced", i)
+	}
+	still, err := src.Meme()
+	s.Require().Nil(err)
+	s.Len(still.Gif.Image, len(frames))
+}
+
+func (s *SourceTestSuite) TestWithSource() {
+	tpl, err := LoadTemplate("fixtures/templates/earth.yaml")
+	s.Require().Nil(err)
+	src, err := DecodeSource(filesystem{}, tpl.Spec().Image)
+	s.Require().Nil(err)
+
+	g, err := tpl.WithSource(src).GetGif()
+
+	s.Require().Nil(err)
+	s.True(g.Image[0] == src.Gif.Image[0], "the decoded frames should be used")
+	s.Nil(tpl.decoded, "the template is not modified")
+}
+
+func TestSourceTestSuite(t *testing.T) {
+	suite.Run(t, new(SourceTestSuite))
+}
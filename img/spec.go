@@ -0,0 +1,242 @@
+package img
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/flopp/go-findfont"
+	"gopkg.in/yaml.v2"
+)
+
+// Defaults applied to a TemplateSpec when the corresponding
+// value is not set.
+const (
+	DefaultMinFontSize float64 = 8.0
+	DefaultMaxFontSize float64 = 52.0
+	DefaultLineSpacing float64 = 0.3
+)
+
+// TemplateSpec is the declarative description of a MemeTemplate,
+// as read from a YAML (or JSON) template file.
+type TemplateSpec struct {
+	// Name of the template. Defaults to the file name when loaded from disk.
+	Name string `yaml:"name,omitempty" json:"name,omitempty"`
+	// Image is the path to the base gif, png or jpeg image. Relative paths are resolved
+	// against the directory of the template file.
+	Image string `yaml:"image" json:"image"`
+	// Font is the name of the ttf font to use.
+	Font string `yaml:"font" json:"font"`
+	// Border (fraction of image size)
+	Border float64 `yaml:"border,omitempty" json:"border,omitempty"`
+	// MinFontSize is the smallest font size we'll try to fit the text with.
+	MinFontSize float64 `yaml:"min_font_size,omitempty" json:"min_font_size,omitempty"`
+	// MaxFontSize is the largest font size we'll try to fit the text with.
+	MaxFontSize float64 `yaml:"max_font_size,omitempty" json:"max_font_size,omitempty"`
+	// LineSpacing is the spacing between lines, as a fraction of the font size.
+	LineSpacing float64 `yaml:"line_spacing,omitempty" json:"line_spacing,omitempty"`
+	// Boxes are the text boxes, in the order text will be assigned to them.
+	Boxes []BoxSpec `yaml:"boxes" json:"boxes"`
+}
+
+// BoxSpec describes a text box as a rectangle in image coordinates.
+type BoxSpec struct {
+	// X coordinate of the top-left corner
+	X int `yaml:"x" json:"x"`
+	// Y coordinate of the top-left corner
+	Y int `yaml:"y" json:"y"`
+	// Width of the box, in pixels
+	Width int `yaml:"width" json:"width"`
+	// Height of the box, in pixels
+	Height int `yaml:"height" json:"height"`
+	// TextStyle is the style of the text in the box
+	TextStyle `yaml:",inline"`
+}
+
+// Rect returns the rectangle covered by the box.
+func (b BoxSpec) Rect() image.Rectangle {
+	return image.Rect(b.X, b.Y, b.X+b.Width, b.Y+b.Height)
+}
+
+// ReadTemplateSpec decodes a template specification from YAML or JSON.
+// Unknown fields are reported as errors.
+func ReadTemplateSpec(r io.Reader) (*TemplateSpec, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var spec TemplateSpec
+	// YAML is a superset of JSON, so this works for both.
+	if err := yaml.UnmarshalStrict(data, &spec); err != nil {
+		return nil, fmt.Errorf("invalid template: %v", err)
+	}
+	return &spec, nil
+}
+
+// ParseTemplate reads a template specification from r, validates it and
+// returns the corresponding MemeTemplate. Relative image paths are resolved
+// against the current working directory.
+func ParseTemplate(r io.Reader) (*MemeTemplate, error) {
+	spec, err := ReadTemplateSpec(r)
+	if err != nil {
+		return nil, err
+	}
+	return spec.Template()
+}
+
+// LoadTemplate reads and validates a template file from disk.
+func LoadTemplate(path string) (*MemeTemplate, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	spec, err := ReadTemplateSpec(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if spec.Name == "" {
+		base := filepath.Base(path)
+		spec.Name = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	if spec.Image != "" && !filepath.IsAbs(spec.Image) {
+		spec.Image = filepath.Join(filepath.Dir(path), spec.Image)
+	}
+	tpl, err := spec.Template()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	// Templates are long lived, so we only read their image once.
+	info, err := tpl.ImageInfo()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	tpl.imageInfo = &info
+	return tpl, nil
+}
+
+// setDefaults fills in the unset optional values.
+func (s *TemplateSpec) setDefaults() {
+	if s.MinFontSize == 0 {
+		s.MinFontSize = DefaultMinFontSize
+	}
+	if s.MaxFontSize == 0 {
+		s.MaxFontSize = DefaultMaxFontSize
+	}
+	if s.LineSpacing == 0 {
+		s.LineSpacing = DefaultLineSpacing
+	}
+}
+
+// imageConfig reads the size and format of the base image without decoding all the frames.
+func (s *TemplateSpec) imageConfig() (image.Rectangle, Format, error) {
+	if _, err := os.Stat(s.Image); err != nil {
+		return image.Rectangle{}, "", fmt.Errorf("image %s could not be opened: %v", s.Image, err)
+	}
+	cfg, format, err := DecodeImageConfig(s.Image)
+	if err != nil {
+		return image.Rectangle{}, "", fmt.Errorf("image %s is not a valid gif, png or jpeg: %v", s.Image, err)
+	}
+	return image.Rect(0, 0, cfg.Width, cfg.Height), format, nil
+}
+
+// Validate checks the template specification for consistency, and returns the
+// path to the font file it uses.
+func (s *TemplateSpec) Validate() (string, error) {
+	s.setDefaults()
+	if s.Image == "" {
+		return "", fmt.Errorf("no image specified")
+	}
+	if s.Font == "" {
+		return "", fmt.Errorf("no font specified")
+	}
+	if s.MinFontSize < 0 || s.MaxFontSize < s.MinFontSize {
+		return "", fmt.Errorf("invalid font size range %.1f-%.1f", s.MinFontSize, s.MaxFontSize)
+	}
+	if s.Border < 0 || s.Border >= 0.5 {
+		return "", fmt.Errorf("border must be between 0 and 0.5, got %.2f", s.Border)
+	}
+	if s.LineSpacing < 0 {
+		return "", fmt.Errorf("line spacing can't be negative")
+	}
+	if len(s.Boxes) == 0 {
+		return "", fmt.Errorf("at least one text box is needed")
+	}
+	fontPath, err := findfont.Find(s.Font)
+	if err != nil {
+		return "", fmt.Errorf("font %s not found: %v", s.Font, err)
+	}
+	// Check the font can actually be parsed.
+	if _, err := fonts.Font(fontPath); err != nil {
+		return "", fmt.Errorf("font at %s could not be loaded: %v", fontPath, err)
+	}
+	bounds, _, err := s.imageConfig()
+	if err != nil {
+		return "", err
+	}
+	for i, box := range s.Boxes {
+		if box.Width <= 0 || box.Height <= 0 {
+			return "", fmt.Errorf("box %d: size %dx%d is too small", i, box.Width, box.Height)
+		}
+		if !box.Rect().In(bounds) {
+			return "", fmt.Errorf("box %d: %v is outside of the image bounds %v", i, box.Rect(), bounds)
+		}
+		if err := box.TextStyle.Validate(); err != nil {
+			return "", fmt.Errorf("box %d: %v", i, err)
+		}
+	}
+	return fontPath, nil
+}
+
+// Template validates the specification and builds a MemeTemplate out of it.
+func (s *TemplateSpec) Template() (*MemeTemplate, error) {
+	fontPath, err := s.Validate()
+	if err != nil {
+		return nil, err
+	}
+	_, format, err := s.imageConfig()
+	if err != nil {
+		return nil, err
+	}
+	tpl := MemeTemplate{
+		name:        s.Name,
+		imagePath:   s.Image,
+		format:      format,
+		fontName:    s.Font,
+		border:      s.Border,
+		minFontSize: s.MinFontSize,
+		maxFontSize: s.MaxFontSize,
+		lineSpacing: s.LineSpacing,
+	}
+	for _, b := range s.Boxes {
+		tpl.boxes = append(tpl.boxes, TextBox{
+			Width:            b.Width,
+			Height:           b.Height,
+			Center:           image.Point{b.X + b.Width/2, b.Y + b.Height/2},
+			FontPath:         fontPath,
+			LineSpacingRatio: s.LineSpacing,
+			Style:            b.TextStyle,
+		})
+	}
+	return &tpl, nil
+}
@@ -0,0 +1,95 @@
+package img
+
+import (
+	"fmt"
+	"image"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type SpecTestSuite struct {
+	suite.Suite
+}
+
+func (s *SpecTestSuite) TestLoadTemplate() {
+	var testCases = []struct {
+		path     string
+		name     string
+		numBoxes int
+	}{
+		{"fixtures/templates/earth.yaml", "earth", 2},
+		{"fixtures/templates/gagarin.json", "first-man-in-space", 1},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.path, func() {
+			tpl, err := LoadTemplate(tc.path)
+
+			s.Nil(err, "error loading the template: %v", err)
+			s.Equal(tc.name, tpl.Name())
+			s.Len(tpl.boxes, tc.numBoxes)
+			m, err := tpl.GetMeme(make([]string, tc.numBoxes)...)
+			s.Nil(err, "error loading the meme: %v", err)
+			s.NotNil(m.Gif)
+		})
+	}
+}
+
+func (s *SpecTestSuite) TestSpecRoundTrip() {
+	tpl, err := LoadTemplate("fixtures/templates/earth.yaml")
+	s.Nil(err)
+	spec := tpl.Spec()
+
+	s.Equal("earth", spec.Name)
+	s.Equal(10.0, spec.MinFontSize)
+	s.Equal(40.0, spec.MaxFontSize)
+	s.Equal(DefaultLineSpacing, spec.LineSpacing)
+	s.Equal([]BoxSpec{{X: 10, Y: 10, Width: 754, Height: 120}, {X: 10, Y: 262, Width: 754, Height: 120}}, spec.Boxes)
+	s.Equal(image.Point{387, 70}, tpl.boxes[0].Center)
+}
+
+func (s *SpecTestSuite) TestParseTemplateErrors() {
+	box := "boxes: [{x: 10, y: 10, width: 100, height: 50}]"
+	var testCases = []struct {
+		yaml   string
+		errMsg string
+	}{
+		{"image: fixtures/earth.gif\nfont: DejaVuSans\n" + box, ""},
+		{"{\"image\": \"fixtures/earth.gif\", \"font\": \"DejaVuSans\", \"boxes\": [{\"x\": 1, \"y\": 1, \"width\": 10, \"height\": 10}]}", ""},
+		{"image: fixtures/earth.gif\nfont: DejaVuSans\ncolour: red\n" + box, "field colour not found"},
+		{"font: DejaVuSans\n" + box, "no image specified"},
+		{"image: fixtures/earth.gif\n" + box, "no font specified"},
+		{"image: fixtures/earth.gif\nfont: NoSuchFontAnywhere\n" + box, "font NoSuchFontAnywhere not found"},
+		{"image: fixtures/non-existent.gif\nfont: DejaVuSans\n" + box, "could not be opened"},
+		{"image: fixtures/badfile.gif\nfont: DejaVuSans\n" + box, "is not a valid gif"},
+		{"image: fixtures/earth.gif\nfont: DejaVuSans\n", "at least one text box"},
+		{"image: fixtures/earth.gif\nfont: DejaVuSans\nmin_font_size: 30\nmax_font_size: 20\n" + box, "invalid font size range"},
+		{"image: fixtures/earth.gif\nfont: DejaVuSans\nborder: 0.7\n" + box, "border must be between"},
+		{"image: fixtures/earth.gif\nfont: DejaVuSans\nboxes: [{x: 10, y: 10, width: 0, height: 50}]", "box 0: size 0x50 is too small"},
+		{"image: fixtures/earth.gif\nfont: DejaVuSans\nboxes: [{x: 10, y: 10, width: 10, height: 10}, {x: 700, y: 10, width: 100, height: 50}]", "box 1: (700,10)-(800,60) is outside of the image bounds"},
+		{"image: fixtures/earth.gif\nfont: DejaVuSans\nboxes: [{x: -1, y: 10, width: 10, height: 10}]", "box 0: (-1,10)-(9,20) is outside"},
+		{"image: fixtures/earth.gif\nfont: DejaVuSans\nboxes: [{x: 1, y: 1, width: 10, height: 10, fill: '#000', stroke_width: 0, align: left, valign: top}]", ""},
+		{"image: fixtures/earth.gif\nfont: DejaVuSans\nboxes: [{x: 1, y: 1, width: 10, height: 10, fill: black}]", "box 0: invalid color 'black'"},
+		{"image: fixtures/earth.gif\nfont: DejaVuSans\nboxes: [{x: 1, y: 1, width: 10, height: 10, align: justify}]", "box 0: unknown alignment"},
+	}
+	for _, tc := range testCases {
+		testName := fmt.Sprintf("error: %q", tc.errMsg)
+		s.Run(testName, func() {
+			tpl, err := ParseTemplate(strings.NewReader(tc.yaml))
+			if tc.errMsg == "" {
+				s.Nil(err, "unexpected error parsing the template: %v", err)
+				s.NotNil(tpl)
+			} else {
+				s.Error(err, "expected an error parsing the template")
+				if err != nil {
+					s.Contains(err.Error(), tc.errMsg)
+				}
+			}
+		})
+	}
+}
+
+func TestSpecTestSuite(t *testing.T) {
+	suite.Run(t, new(SpecTestSuite))
+}
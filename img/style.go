@@ -0,0 +1,143 @@
+package img
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"fmt"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+// Alignment is the horizontal alignment of the text in a box
+type Alignment string
+
+// Anchor is the vertical position of the text in a box
+type Anchor string
+
+// Allowed alignments and anchors. The empty value means the default,
+// so centered, in both cases.
+const (
+	AlignLeft    Alignment = "left"
+	AlignCenter  Alignment = "center"
+	AlignRight   Alignment = "right"
+	AnchorTop    Anchor    = "top"
+	AnchorMiddle Anchor    = "middle"
+	AnchorBottom Anchor    = "bottom"
+)
+
+// Default colors for the text
+const (
+	DefaultFill   string = "#FFF"
+	DefaultStroke string = "#000"
+)
+
+// TextStyle describes how text is drawn in a box. The zero value corresponds
+// to the classic meme look: white text with a black outline, centered in the box.
+type TextStyle struct {
+	// Fill is the color of the text, in hex notation
+	Fill string `yaml:"fill,omitempty" json:"fill,omitempty"`
+	// Stroke is the color of the outline, in hex notation
+	Stroke string `yaml:"stroke,omitempty" json:"stroke,omitempty"`
+	// StrokeWidth is the width of the outline, in pixels. If not set,
+	// it's proportional to the line spacing. Set it to 0 to remove the outline.
+	StrokeWidth *float64 `yaml:"stroke_width,omitempty" json:"stroke_width,omitempty"`
+	// Align is the horizontal alignment of the text
+	Align Alignment `yaml:"align,omitempty" json:"align,omitempty"`
+	// VAlign is the vertical anchor of the text
+	VAlign Anchor `yaml:"valign,omitempty" json:"valign,omitempty"`
+}
+
+// Override returns a copy of the style, with all the values set in other replacing ours.
+func (s TextStyle) Override(other TextStyle) TextStyle {
+	if other.Fill != "" {
+		s.Fill = other.Fill
+	}
+	if other.Stroke != "" {
+		s.Stroke = other.Stroke
+	}
+	if other.StrokeWidth != nil {
+		s.StrokeWidth = other.StrokeWidth
+	}
+	if other.Align != "" {
+		s.Align = other.Align
+	}
+	if other.VAlign != "" {
+		s.VAlign = other.VAlign
+	}
+	return s
+}
+
+// Validate checks all the values in the style are valid.
+func (s TextStyle) Validate() error {
+	if _, err := s.FillColor(); err != nil {
+		return err
+	}
+	if _, err := s.StrokeColor(); err != nil {
+		return err
+	}
+	if s.StrokeWidth != nil && *s.StrokeWidth < 0 {
+		return fmt.Errorf("stroke width can't be negative")
+	}
+	switch s.Align {
+	case "", AlignLeft, AlignCenter, AlignRight:
+	default:
+		return fmt.Errorf("unknown alignment '%s'", s.Align)
+	}
+	switch s.VAlign {
+	case "", AnchorTop, AnchorMiddle, AnchorBottom:
+	default:
+		return fmt.Errorf("unknown vertical anchor '%s'", s.VAlign)
+	}
+	return nil
+}
+
+// FillColor returns the color of the text.
+func (s TextStyle) FillColor() (color.Color, error) {
+	if s.Fill == "" {
+		return ParseHexColor(DefaultFill)
+	}
+	return ParseHexColor(s.Fill)
+}
+
+// StrokeColor returns the color of the outline.
+func (s TextStyle) StrokeColor() (color.Color, error) {
+	if s.Stroke == "" {
+		return ParseHexColor(DefaultStroke)
+	}
+	return ParseHexColor(s.Stroke)
+}
+
+// ParseHexColor parses a color in the #RGB, #RRGGBB or #RRGGBBAA format.
+// The leading hash is optional.
+func ParseHexColor(hex string) (color.Color, error) {
+	h := strings.TrimPrefix(hex, "#")
+	if len(h) == 3 {
+		h = string([]byte{h[0], h[0], h[1], h[1], h[2], h[2]})
+	}
+	if len(h) == 6 {
+		h += "ff"
+	}
+	if len(h) != 8 {
+		return nil, fmt.Errorf("invalid color '%s'", hex)
+	}
+	v, err := strconv.ParseUint(h, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid color '%s'", hex)
+	}
+	return color.NRGBA{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v)}, nil
+}
@@ -0,0 +1,64 @@
+package img
+
+import (
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type StyleTestSuite struct {
+	suite.Suite
+}
+
+func (s *StyleTestSuite) TestParseHexColor() {
+	var testCases = []struct {
+		hex    string
+		color  color.Color
+		hasErr bool
+	}{
+		{"#FFF", color.NRGBA{255, 255, 255, 255}, false},
+		{"ff0", color.NRGBA{255, 255, 0, 255}, false},
+		{"#102030", color.NRGBA{16, 32, 48, 255}, false},
+		{"#10203080", color.NRGBA{16, 32, 48, 128}, false},
+		{"#1020", nil, true},
+		{"#GGG", nil, true},
+		{"", nil, true},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.hex, func() {
+			c, err := ParseHexColor(tc.hex)
+			if tc.hasErr {
+				s.Error(err)
+			} else {
+				s.Nil(err)
+				s.Equal(tc.color, c)
+			}
+		})
+	}
+}
+
+func (s *StyleTestSuite) TestOverride() {
+	zero := 0.0
+	base := TextStyle{Fill: "#000", Stroke: "#FFF", Align: AlignLeft}
+
+	styled := base.Override(TextStyle{Fill: "#FF0", StrokeWidth: &zero, VAlign: AnchorBottom})
+
+	s.Equal(TextStyle{Fill: "#FF0", Stroke: "#FFF", StrokeWidth: &zero, Align: AlignLeft, VAlign: AnchorBottom}, styled)
+	s.Equal(base, base.Override(TextStyle{}), "an empty style should change nothing")
+}
+
+func (s *StyleTestSuite) TestValidate() {
+	negative := -1.0
+	s.Nil(TextStyle{}.Validate())
+	s.Nil(TextStyle{Fill: "#000", Stroke: "#FF0", Align: AlignRight, VAlign: AnchorTop}.Validate())
+	s.Error(TextStyle{Fill: "black"}.Validate())
+	s.Error(TextStyle{Stroke: "#12"}.Validate())
+	s.Error(TextStyle{StrokeWidth: &negative}.Validate())
+	s.Error(TextStyle{Align: "justify"}.Validate())
+	s.Error(TextStyle{VAlign: "center"}.Validate())
+}
+
+func TestStyleTestSuite(t *testing.T) {
+	suite.Run(t, new(StyleTestSuite))
+}
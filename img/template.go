@@ -17,31 +17,151 @@ limitations under the License.
 */
 
 import (
+	"errors"
 	"fmt"
 	"image"
 	"image/gif"
+	"io"
 	"os"
 
 	"github.com/flopp/go-findfont"
 )
 
+// ErrTextCount is returned when the number of text pieces
+// doesn't match the number of boxes in the template.
+var ErrTextCount = errors.New("wrong number of text pieces")
+
+// ImageSource gives access to base images by name.
+type ImageSource interface {
+	Get(name string) (io.ReadCloser, error)
+}
+
+// filesystem is the ImageSource where names are paths on the local filesystem.
+type filesystem struct{}
+
+func (filesystem) Get(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
 // MemeTemplate represents all the basic
 // information you need to generate a meme:
 // the base image and the position, shape and
 // font sizes in the text boxes.
 type MemeTemplate struct {
-	gifPath     string
+	name        string
+	imagePath   string
+	format      Format
 	fontName    string
 	boxes       []TextBox
 	border      float64
 	minFontSize float64
 	maxFontSize float64
 	lineSpacing float64
+	// source is where the image is read from; the local filesystem if nil.
+	source ImageSource
+	// decoded is the image, if it was already decoded.
+	decoded *Source
+	// imageInfo describes the image, if it was already read.
+	imageInfo *ImageInfo
+}
+
+// Name returns the name of the template.
+func (tpl *MemeTemplate) Name() string {
+	return tpl.name
+}
+
+// Format returns the format of the base image.
+func (tpl *MemeTemplate) Format() Format {
+	if tpl.format == "" {
+		return FormatGIF
+	}
+	return tpl.format
+}
+
+// NumBoxes returns the number of text boxes in the template.
+func (tpl *MemeTemplate) NumBoxes() int {
+	return len(tpl.boxes)
+}
+
+// Spec returns the declarative description of the template.
+func (tpl *MemeTemplate) Spec() TemplateSpec {
+	spec := TemplateSpec{
+		Name:        tpl.name,
+		Image:       tpl.imagePath,
+		Font:        tpl.fontName,
+		Border:      tpl.border,
+		MinFontSize: tpl.minFontSize,
+		MaxFontSize: tpl.maxFontSize,
+		LineSpacing: tpl.lineSpacing,
+	}
+	for _, box := range tpl.boxes {
+		spec.Boxes = append(spec.Boxes, BoxSpec{
+			X:         box.Center.X - box.Width/2,
+			Y:         box.Center.Y - box.Height/2,
+			Width:     box.Width,
+			Height:    box.Height,
+			TextStyle: box.Style,
+		})
+	}
+	return spec
+}
+
+// WithStyle returns a copy of the template where the style of all the boxes
+// is overridden by the values set in style.
+func (tpl *MemeTemplate) WithStyle(style TextStyle) *MemeTemplate {
+	styled := *tpl
+	styled.boxes = make([]TextBox, len(tpl.boxes))
+	for i, box := range tpl.boxes {
+		box.Style = box.Style.Override(style)
+		styled.boxes[i] = box
+	}
+	return &styled
+}
+
+// WithSource returns a copy of the template that makes memes from src, its
+// base image already decoded, instead of reading the image again.
+func (tpl *MemeTemplate) WithSource(src *Source) *MemeTemplate {
+	decoded := *tpl
+	decoded.decoded = src
+	return &decoded
+}
+
+// open opens the base image.
+func (tpl *MemeTemplate) open() (io.ReadCloser, error) {
+	if tpl.source == nil {
+		return filesystem{}.Get(tpl.imagePath)
+	}
+	return tpl.source.Get(tpl.imagePath)
+}
+
+// ImageHash returns the hash of the content of the base image; see HashImage.
+func (tpl *MemeTemplate) ImageHash() (string, error) {
+	info, err := tpl.ImageInfo()
+	return info.Hash, err
+}
+
+// ImageInfo describes the base image; see IdentifyImage.
+func (tpl *MemeTemplate) ImageInfo() (ImageInfo, error) {
+	if tpl.decoded != nil {
+		return tpl.decoded.Info(), nil
+	}
+	if tpl.imageInfo != nil {
+		return *tpl.imageInfo, nil
+	}
+	r, err := tpl.open()
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	defer r.Close()
+	return IdentifyImage(r)
 }
 
-// GetGif reads the gif from disk
+// GetGif reads the gif from disk, unless it was already decoded
 func (tpl *MemeTemplate) GetGif() (*gif.GIF, error) {
-	r, err := os.Open(tpl.gifPath)
+	if tpl.decoded != nil && tpl.decoded.Gif != nil {
+		return tpl.decoded.copyGif(), nil
+	}
+	r, err := tpl.open()
 	if err != nil {
 		return nil, err
 	}
@@ -49,6 +169,20 @@ func (tpl *MemeTemplate) GetGif() (*gif.GIF, error) {
 	return gif.DecodeAll(r)
 }
 
+// GetStill reads a png or jpeg image from disk, unless it was already decoded
+func (tpl *MemeTemplate) GetStill() (image.Image, error) {
+	if tpl.decoded != nil && tpl.decoded.Still != nil {
+		return tpl.decoded.Still, nil
+	}
+	r, err := tpl.open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	img, _, err := image.Decode(r)
+	return img, err
+}
+
 // GetMeme fills a template with the text strings provided
 func (tpl *MemeTemplate) GetMeme(text ...string) (*Meme, error) {
 	numText := len(text)
@@ -56,7 +190,7 @@ func (tpl *MemeTemplate) GetMeme(text ...string) (*Meme, error) {
 	// Copy the textboxes, we definitely don't want to deal with concurrency issues
 	memeBoxes := make([]TextBox, numBoxes)
 	if numText != numBoxes {
-		return nil, fmt.Errorf("%d text pieces were given, but %d expected", numText, numBoxes)
+		return nil, fmt.Errorf("%w: %d were given, but %d expected", ErrTextCount, numText, numBoxes)
 	}
 	for i, box := range tpl.boxes {
 		err := box.SetText(text[i], tpl.maxFontSize, tpl.minFontSize)
@@ -65,35 +199,82 @@ func (tpl *MemeTemplate) GetMeme(text ...string) (*Meme, error) {
 		}
 		memeBoxes[i] = box
 	}
-	g, err := tpl.GetGif()
-	meme := Meme{Gif: g, TextBoxes: &memeBoxes, Border: tpl.border}
+	meme := Meme{TextBoxes: &memeBoxes, Border: tpl.border, Format: tpl.Format()}
+	var err error
+	if meme.Format == FormatGIF {
+		meme.Gif, err = tpl.GetGif()
+	} else {
+		meme.Still, err = tpl.GetStill()
+	}
 	return &meme, err
 }
 
-// SimpleTemplate generates the simplest possible template:
+// LoadImage reads a gif, png or jpeg image into a meme with no text boxes, without
+// looking for fonts. The format is detected from the content of the file.
+func LoadImage(path string) (*Meme, error) {
+	return LoadImageFrom(filesystem{}, path)
+}
+
+// LoadImageFrom reads the image with the given name in src, like LoadImage.
+func LoadImageFrom(src ImageSource, name string) (*Meme, error) {
+	_, format, err := DecodeImageConfigFrom(src, name)
+	if err != nil {
+		return nil, err
+	}
+	tpl := MemeTemplate{imagePath: name, source: src, format: format}
+	return tpl.GetMeme()
+}
+
+// SimpleTemplate generates the simplest possible template for an image:
 // - one box in the top 1/3rd of the image
 // - one box in the bottom 1/3rd of the image
 func SimpleTemplate(imgPath string, fontName string, maxFontSize float64, minFontSize float64) (*MemeTemplate, error) {
+	return SimpleTemplateFrom(filesystem{}, imgPath, fontName, maxFontSize, minFontSize)
+}
+
+// SimpleTemplateFrom generates the simplest possible template for the image
+// with the given name in src; see SimpleTemplate.
+func SimpleTemplateFrom(src ImageSource, name string, fontName string, maxFontSize float64, minFontSize float64) (*MemeTemplate, error) {
+	// We need the size of the image
+	cfg, format, err := DecodeImageConfigFrom(src, name)
+	if err != nil {
+		return nil, err
+	}
+	tpl, err := simpleTemplate(cfg, fontName, maxFontSize, minFontSize)
+	if err != nil {
+		return nil, err
+	}
+	tpl.imagePath, tpl.source, tpl.format = name, src, format
+	return tpl, nil
+}
+
+// SimpleTemplateFor generates the simplest possible template for an image that
+// was already decoded; see SimpleTemplate. Memes made from it don't read the image again.
+func SimpleTemplateFor(src *Source, fontName string, maxFontSize float64, minFontSize float64) (*MemeTemplate, error) {
+	tpl, err := simpleTemplate(src.Config, fontName, maxFontSize, minFontSize)
+	if err != nil {
+		return nil, err
+	}
+	tpl.imagePath, tpl.format, tpl.decoded = src.Name, src.Format, src
+	return tpl, nil
+}
+
+// simpleTemplate returns the text boxes of SimpleTemplate for an image of the given size.
+func simpleTemplate(cfg image.Config, fontName string, maxFontSize float64, minFontSize float64) (*MemeTemplate, error) {
 	fontPath, err := findfont.Find(fontName)
 	if err != nil {
 		return nil, err
 	}
 	tpl := MemeTemplate{
-		gifPath:     imgPath,
+		fontName:    fontName,
 		minFontSize: minFontSize,
 		maxFontSize: maxFontSize,
 		border:      0.01,
 		lineSpacing: 0.3,
 	}
-	// We need the size of the image
-	g, err := tpl.GetGif()
-	if err != nil {
-		return &tpl, err
-	}
 	// Now generate the textboxes
-	size := g.Image[0].Bounds()
-	imgWidth := float64(size.Dx())
-	imgHeight := float64(size.Dy())
+	imgWidth := float64(cfg.Width)
+	imgHeight := float64(cfg.Height)
 	width := imgWidth * (1.0 - 2.0*tpl.border)
 	height := imgHeight * (1.0/3.0 - tpl.border)
 	X := int(imgWidth * 0.5)
@@ -114,14 +295,15 @@ func SimpleTemplate(imgPath string, fontName string, maxFontSize float64, minFon
 		LineSpacingRatio: tpl.lineSpacing,
 	}
 	tpl.boxes = []TextBox{topBox, bottomBox}
-	return &tpl, err
+	return &tpl, nil
 }
 
-// MemeFromFile initiates a simple meme from a gif
-func MemeFromFile(path string, top string, bottom string, fontName string) (*Meme, error) {
+// MemeFromFile initiates a simple meme from a gif, png or jpeg image. Text is
+// assigned, in order, to the top and bottom boxes.
+func MemeFromFile(path string, fontName string, text ...string) (*Meme, error) {
 	tpl, err := SimpleTemplate(path, fontName, 52.0, 8.0)
 	if err != nil {
 		return nil, err
 	}
-	return tpl.GetMeme(top, bottom)
+	return tpl.GetMeme(text...)
 }
@@ -1,8 +1,12 @@
 package img
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"image"
+	"image/color/palette"
+	"image/draw"
 	"image/gif"
 	"testing"
 
@@ -33,7 +37,7 @@ func (s TemplateTestSuite) createTemplate() MemeTemplate {
 		FontPath: s.fontPath,
 	}
 	return MemeTemplate {
-		gifPath:     "fixtures/earth.gif",
+		imagePath:   "fixtures/earth.gif",
 		boxes:       []TextBox{box},
 		border:      0.1,
 		minFontSize: 8.0,
@@ -48,6 +52,7 @@ func (s *TemplateTestSuite) TestGetMemeWithNoProvidedName() {
 	_, err := sut.GetMeme()
 
 	s.Error(err, "no text provided should cause a failure")
+	s.True(errors.Is(err, ErrTextCount), "the error should be ErrTextCount, got %v", err)
 }
 
 func (s *TemplateTestSuite) TestGetMeme() {
@@ -57,13 +62,13 @@ func (s *TemplateTestSuite) TestGetMeme() {
 
 	s.Nil(err, "error loading the meme: %v", err)
 	s.Equal(*(*m.TextBoxes)[0].Txt, "test", "Not correctly assigned text to textbox")
-	s.Equal((*m.TextBoxes)[0].FontSize, 52.0, "Not correctly set the font size")
+	s.InDelta(42.4, (*m.TextBoxes)[0].FontSize, fontSizePrecision, "Not correctly set the font size")
 	s.IsType(&gif.GIF{}, m.Gif, "A gif should be loaded")
 }
 
 func (s *TemplateTestSuite) TestCorruptedSourceFile() {
 	sut := s.createTemplate()
-	sut.gifPath = "fixtures/badfile.gif"
+	sut.imagePath = "fixtures/badfile.gif"
 	
 	_, err := sut.GetMeme("test")
 
@@ -82,7 +87,7 @@ func (s *TemplateTestSuite) TestGetGif() {
 	for _, tc := range testGetGif {
 		testName := fmt.Sprintf("path: %s - err: %t", tc.path, tc.isError)
 		s.Run(testName, func() {
-			sut := MemeTemplate{ gifPath: tc.path }
+			sut := MemeTemplate{ imagePath: tc.path }
 			
 			_, err := sut.GetGif()
 			
@@ -96,6 +101,114 @@ func (s *TemplateTestSuite) TestGetGif() {
 	}
 }
 
+func (s *TemplateTestSuite) TestStillMeme() {
+	var testCases = []struct {
+		path   string
+		format Format
+	}{
+		{"fixtures/gagarin.png", FormatPNG},
+		{"fixtures/gagarin.jpg", FormatJPEG},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.path, func() {
+			m, err := MemeFromFile(tc.path, defaultFont, "top", "bottom")
+			s.Nil(err, "error loading the meme: %v", err)
+			s.Nil(m.Gif, "stills should not be loaded as a gif")
+			s.Equal(tc.format, m.Format)
+			original := image.NewRGBA(m.Still.Bounds())
+			draw.Draw(original, original.Rect, m.Still, image.Point{}, draw.Src)
+
+			err = m.Generate()
+
+			s.Nil(err, "error generating the meme: %v", err)
+			s.Equal(original.Bounds(), m.Still.Bounds())
+			s.NotEqual(original, m.Still, "the text should have been drawn")
+		})
+	}
+}
+
+func (s *TemplateTestSuite) TestLoadImage() {
+	var testCases = []struct {
+		path    string
+		format  Format
+		isError bool
+	}{
+		{"fixtures/earth.gif", FormatGIF, false},
+		{"fixtures/gagarin.png", FormatPNG, false},
+		{"fixtures/badfile.gif", "", true},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.path, func() {
+			m, err := LoadImage(tc.path)
+
+			if tc.isError {
+				s.Error(err)
+				return
+			}
+			s.Require().Nil(err)
+			s.Equal(tc.format, m.Format)
+			s.Empty(*m.TextBoxes, "images have no text boxes")
+			s.Equal(tc.format == FormatGIF, m.Gif != nil)
+		})
+	}
+}
+
+// smallMeme returns a meme on a small, synthetic animated gif, so that it's fast to render.
+func (s *TemplateTestSuite) smallMeme(text string) *Meme {
+	g := gif.GIF{}
+	for i := 0; i < 8; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 120, 80), palette.Plan9)
+		for x := 0; x < 120; x++ {
+			for y := 0; y < 80; y++ {
+				frame.SetColorIndex(x, y, uint8(i*30+x))
+			}
+		}
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10)
+		g.Disposal = append(g.Disposal, gif.DisposalNone)
+	}
+	box := TextBox{Width: 100, Height: 30, Center: image.Point{60, 20}, FontPath: s.fontPath, LineSpacingRatio: 0.2}
+	if err := box.SetText(text, 52.0, 8.0); err != nil {
+		panic(err)
+	}
+	return &Meme{Gif: &g, TextBoxes: &[]TextBox{box}}
+}
+
+func (s *TemplateTestSuite) TestGenerate() {
+	var results []*gif.GIF
+	for _, workers := range []int{1, 3, 0} {
+		m := s.smallMeme("test")
+		m.Workers = workers
+
+		err := m.Generate()
+
+		s.Nil(err, "error generating the meme with %d workers: %v", workers, err)
+		results = append(results, m.Gif)
+	}
+	s.NotEqual(s.smallMeme("test").Gif.Image, results[0].Image, "the text should have been drawn")
+	s.Equal(results[0].Image, results[1].Image, "the result should not depend on the number of workers")
+	s.Equal(results[0].Image, results[2].Image, "the result should not depend on the number of workers")
+}
+
+func (s *TemplateTestSuite) TestGenerateError() {
+	m := s.smallMeme("test")
+	(*m.TextBoxes)[0].FontPath = "fixtures/non-existent.ttf"
+
+	err := m.Generate()
+
+	s.Error(err, "errors rendering frames should be returned")
+}
+
+func (s *TemplateTestSuite) TestGenerateContextCancelled() {
+	m := s.smallMeme("test")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := m.GenerateContext(ctx)
+
+	s.Equal(context.Canceled, err)
+}
+
 func TestTemplateTestSuite(t *testing.T) {
 	suite.Run(t, new(TemplateTestSuite))
 }
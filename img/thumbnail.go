@@ -0,0 +1,127 @@
+package img
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+
+	"github.com/nfnt/resize"
+)
+
+// Thumbnail describes a small preview of an image.
+type Thumbnail struct {
+	// Width and Height are the largest size of the thumbnail. The aspect
+	// ratio of the image is kept, and small images are not scaled up.
+	Width, Height int
+	// Animated keeps the whole animation, scaled down. Otherwise only one frame is kept.
+	Animated bool
+	// MaxFrames drops frames evenly from animated thumbnails longer than this.
+	// 0 keeps all the frames.
+	MaxFrames int
+	// Frame is the frame of still thumbnails. FrameBest picks the most representative one.
+	Frame int
+}
+
+// FrameBest selects the most representative frame of an animation; see BestFrame.
+const FrameBest = -1
+
+// thumbnailSamples is the number of pixels per side looked at when scoring a frame.
+const thumbnailSamples = 64
+
+// Thumbnail turns the meme into a thumbnail of its base image. The text boxes
+// are dropped, so it's meant to be called on memes with no text.
+func (m *Meme) Thumbnail(t Thumbnail) error {
+	if t.Width <= 0 || t.Height <= 0 {
+		return fmt.Errorf("%w: thumbnails must be at least 1x1", ErrInvalidTransform)
+	}
+	m.TextBoxes = nil
+	if m.Gif != nil && t.Animated {
+		return m.Constrain(Limits{MaxWidth: t.Width, MaxHeight: t.Height, MaxFrames: t.MaxFrames})
+	}
+	if m.Gif != nil {
+		frame, err := m.frameAt(t.Frame)
+		if err != nil {
+			return err
+		}
+		m.Still, m.Gif = frame, nil
+	}
+	m.Still = resize.Thumbnail(uint(t.Width), uint(t.Height), m.Still, resize.Lanczos3)
+	return nil
+}
+
+// frameAt returns a copy of frame i of the animation, as displayed. If i is
+// FrameBest, the most representative frame is returned.
+func (m *Meme) frameAt(i int) (*image.RGBA, error) {
+	if i == FrameBest {
+		i = m.BestFrame()
+	}
+	if i < 0 || i >= len(m.Gif.Image) {
+		return nil, fmt.Errorf("%w: frame %d doesn't exist, the image has %d", ErrInvalidTransform, i, len(m.Gif.Image))
+	}
+	comp := NewCompositor(m.Gif)
+	canvas, j := comp.Next()
+	for j < i {
+		canvas, j = comp.Next()
+	}
+	frame := image.NewRGBA(canvas.Rect)
+	draw.Draw(frame, frame.Rect, canvas, canvas.Rect.Min, draw.Src)
+	return frame, nil
+}
+
+// BestFrame returns the index of the most representative frame of the meme:
+// the one with the most detail, so that black or blank frames at the start of
+// fades are skipped. Still images only have frame 0.
+func (m *Meme) BestFrame() int {
+	if m.Gif == nil {
+		return 0
+	}
+	best, bestScore := 0, -1.0
+	comp := NewCompositor(m.Gif)
+	for canvas, i := comp.Next(); canvas != nil; canvas, i = comp.Next() {
+		if score := frameDetail(canvas); score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// frameDetail measures the detail in a frame as the standard deviation of the
+// luminance of a grid of its pixels. Transparent pixels count as black.
+func frameDetail(frame *image.RGBA) float64 {
+	b := frame.Rect
+	stepX := maxInt(1, b.Dx()/thumbnailSamples)
+	stepY := maxInt(1, b.Dy()/thumbnailSamples)
+	var sum, sumSq, n float64
+	for y := b.Min.Y; y < b.Max.Y; y += stepY {
+		for x := b.Min.X; x < b.Max.X; x += stepX {
+			p := frame.Pix[frame.PixOffset(x, y):]
+			// Rec. 601 luma; the pixels are premultiplied, so transparency darkens them.
+			l := 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+			sum += l
+			sumSq += l * l
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	mean := sum / n
+	return math.Sqrt(math.Max(0, sumSq/n-mean*mean))
+}
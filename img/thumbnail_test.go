@@ -0,0 +1,81 @@
+package img
+
+import (
+	"errors"
+	"image"
+	"image/gif"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ThumbnailTestSuite struct {
+	suite.Suite
+}
+
+// fadeInGif returns an animation starting with a blank frame, then showing a pattern.
+func fadeInGif() *gif.GIF {
+	g := opaqueGif()
+	g.Image[0] = solidFrame(image.Rect(0, 0, 40, 40), red)
+	return g
+}
+
+func (s *ThumbnailTestSuite) TestBestFrame() {
+	m := Meme{Gif: fadeInGif()}
+	s.Equal(1, m.BestFrame(), "the blank frame should be skipped")
+
+	still, err := MemeFromFile("fixtures/gagarin.png", defaultFont, "", "")
+	s.Require().Nil(err)
+	s.Equal(0, still.BestFrame())
+}
+
+func (s *ThumbnailTestSuite) TestThumbnail() {
+	var testCases = []struct {
+		name   string
+		thumb  Thumbnail
+		size   image.Rectangle
+		frames int
+		// pattern is a point where the green square should be visible in still thumbnails,
+		// or nil if the thumbnail should be a blank red frame.
+		pattern *image.Point
+	}{
+		{"first frame", Thumbnail{Width: 20, Height: 20}, image.Rect(0, 0, 20, 20), 1, nil},
+		{"best frame", Thumbnail{Width: 20, Height: 20, Frame: FrameBest}, image.Rect(0, 0, 20, 20), 1, &image.Point{X: 7, Y: 7}},
+		{"not scaled up", Thumbnail{Width: 100, Height: 100, Frame: 3}, image.Rect(0, 0, 40, 40), 1, &image.Point{X: 25, Y: 15}},
+		{"animated", Thumbnail{Width: 20, Height: 10, Animated: true}, image.Rect(0, 0, 10, 10), 4, nil},
+		{"sampled", Thumbnail{Width: 20, Height: 20, Animated: true, MaxFrames: 2}, image.Rect(0, 0, 20, 20), 2, nil},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			m := Meme{Gif: fadeInGif()}
+
+			err := m.Thumbnail(tc.thumb)
+
+			s.Require().Nil(err)
+			s.Equal(tc.size, m.bounds())
+			s.Equal(tc.frames, m.frameCount())
+			if tc.thumb.Animated {
+				return
+			}
+			s.Nil(m.Gif, "still thumbnails should have a single image")
+			at := image.Point{}
+			if tc.pattern != nil {
+				at = *tc.pattern
+			}
+			r, g, _, _ := m.Still.At(at.X, at.Y).RGBA()
+			s.Equal(tc.pattern != nil, g > r, "unexpected color %v at %v", m.Still.At(at.X, at.Y), at)
+		})
+	}
+}
+
+func (s *ThumbnailTestSuite) TestThumbnailErrors() {
+	for _, thumb := range []Thumbnail{{Width: 0, Height: 10}, {Width: 10, Height: 10, Frame: 4}} {
+		m := Meme{Gif: fadeInGif()}
+		err := m.Thumbnail(thumb)
+		s.True(errors.Is(err, ErrInvalidTransform), "expected an invalid transform, got %v", err)
+	}
+}
+
+func TestThumbnailTestSuite(t *testing.T) {
+	suite.Run(t, new(ThumbnailTestSuite))
+}
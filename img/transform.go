@@ -0,0 +1,250 @@
+package img
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Transform describes changes to the base image of a meme. They're applied
+// before drawing the text, so that the text is as crisp as in the original.
+// The zero value changes nothing.
+type Transform struct {
+	// Trim keeps only the frames in [Trim.Start, Trim.End) of animations. An end
+	// past the last frame is the last frame.
+	Trim *FrameRange
+	// Crop is the area of the image to keep. Text boxes are moved with it,
+	// and cut to the part that is still visible.
+	Crop image.Rectangle
+	// Width the image is resized to, keeping the aspect ratio. 0 keeps the original size.
+	Width int
+	// Reverse plays animations backwards.
+	Reverse bool
+	// Boomerang plays animations forwards, then backwards.
+	Boomerang bool
+	// Speed multiplies the speed of animations. 0 keeps the original speed.
+	Speed float64
+}
+
+// FrameRange is a range of frames, with the start included and the end excluded.
+type FrameRange struct {
+	Start, End int
+}
+
+// Normalize returns the range as it applies to an animation of n frames: the end
+// is at most n, and a range covering all the frames is nil.
+func (r *FrameRange) Normalize(n int) *FrameRange {
+	if r == nil {
+		return nil
+	}
+	norm := *r
+	if norm.End < 0 || norm.End > n {
+		norm.End = n
+	}
+	if norm.Start == 0 && norm.End == n {
+		return nil
+	}
+	return &norm
+}
+
+// ErrInvalidTransform is returned when a transform can't be applied to a meme.
+var ErrInvalidTransform = errors.New("invalid transform")
+
+// maxTransformWidth is the largest width an image can be resized to.
+const maxTransformWidth = 4096
+
+// ParseRect parses a rectangle in the "x,y,width,height" form.
+func ParseRect(s string) (image.Rectangle, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, fmt.Errorf("%w: '%s' is not in the x,y,width,height form", ErrInvalidTransform, s)
+	}
+	var v [4]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n < 0 {
+			return image.Rectangle{}, fmt.Errorf("%w: '%s' is not a valid rectangle", ErrInvalidTransform, s)
+		}
+		v[i] = n
+	}
+	return image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3]), nil
+}
+
+// ParseFrameRange parses a range of frames in the "start:end" form. Either
+// can be omitted, to mean the first or the last frame.
+func ParseFrameRange(s string) (*FrameRange, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("%w: '%s' is not in the start:end form", ErrInvalidTransform, s)
+	}
+	r := FrameRange{End: -1}
+	for i, dst := range []*int{&r.Start, &r.End} {
+		if parts[i] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(parts[i])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%w: '%s' is not a valid frame range", ErrInvalidTransform, s)
+		}
+		*dst = n
+	}
+	return &r, nil
+}
+
+// IsZero returns true if the transform doesn't change anything.
+func (t Transform) IsZero() bool {
+	return t == Transform{}
+}
+
+// Transform applies the transform to the base image of the meme, and moves
+// the text boxes to match. It must be called before Generate. Changes to the
+// timing of the animation are ignored for still images.
+func (m *Meme) Transform(t Transform) error {
+	if t.IsZero() {
+		return nil
+	}
+	if t.Speed < 0 || math.IsNaN(t.Speed) || math.IsInf(t.Speed, 0) {
+		return fmt.Errorf("%w: speed must be positive", ErrInvalidTransform)
+	}
+	if t.Width < 0 || t.Width > maxTransformWidth {
+		return fmt.Errorf("%w: width must be at most %d", ErrInvalidTransform, maxTransformWidth)
+	}
+	if m.Gif != nil {
+		// Every frame must show the whole image before we can move them around.
+		m.NormalizeImage()
+		if err := m.trim(t.Trim); err != nil {
+			return err
+		}
+	}
+	if !t.Crop.Empty() {
+		if err := m.crop(t.Crop); err != nil {
+			return err
+		}
+	}
+	if t.Width > 0 {
+		b := m.bounds()
+		height := maxInt(1, int(math.Round(float64(b.Dy())*float64(t.Width)/float64(b.Dx()))))
+		if err := m.resize(t.Width, height, m.frameCount()); err != nil {
+			return err
+		}
+	}
+	if m.Gif == nil {
+		return nil
+	}
+	g := m.Gif
+	if len(g.Delay) != len(g.Image) {
+		delays := make([]int, len(g.Image))
+		copy(delays, g.Delay)
+		g.Delay = delays
+	}
+	if t.Reverse {
+		for i, j := 0, len(g.Image)-1; i < j; i, j = i+1, j-1 {
+			g.Image[i], g.Image[j] = g.Image[j], g.Image[i]
+			g.Delay[i], g.Delay[j] = g.Delay[j], g.Delay[i]
+		}
+	}
+	if t.Boomerang {
+		// Don't repeat the first and last frame when turning around.
+		for i := len(g.Image) - 2; i > 0; i-- {
+			g.Image = append(g.Image, g.Image[i])
+			g.Delay = append(g.Delay, g.Delay[i])
+		}
+	}
+	if t.Speed > 0 {
+		for i, d := range g.Delay {
+			// Browsers play very short delays at 100ms, so that's what we speed up.
+			if d < minDelay {
+				d = 10
+			}
+			g.Delay[i] = maxInt(minDelay, int(math.Round(float64(d)/t.Speed)))
+		}
+	}
+	setDisposal(g)
+	return nil
+}
+
+// trim keeps only the frames in the range.
+func (m *Meme) trim(r *FrameRange) error {
+	if r == nil {
+		return nil
+	}
+	g := m.Gif
+	r = r.Normalize(len(g.Image))
+	if r == nil {
+		return nil
+	}
+	start, end := r.Start, r.End
+	if start >= end {
+		return fmt.Errorf("%w: can't keep frames %d to %d of %d", ErrInvalidTransform, start, end, len(g.Image))
+	}
+	g.Image = g.Image[start:end]
+	if len(g.Delay) >= end {
+		g.Delay = g.Delay[start:end]
+	}
+	return nil
+}
+
+// crop keeps only the area r of the image, and moves the text boxes accordingly.
+func (m *Meme) crop(r image.Rectangle) error {
+	b := m.bounds()
+	if !r.In(b) {
+		return fmt.Errorf("%w: %v is not inside the image (%v)", ErrInvalidTransform, r, b)
+	}
+	dst := image.Rect(0, 0, r.Dx(), r.Dy())
+	if m.Still != nil {
+		cropped := image.NewRGBA(dst)
+		draw.Draw(cropped, dst, m.Still, r.Min, draw.Src)
+		m.Still = cropped
+	} else {
+		for i, frame := range m.Gif.Image {
+			cropped := image.NewPaletted(dst, frame.Palette)
+			for y := 0; y < dst.Dy(); y++ {
+				copy(cropped.Pix[y*cropped.Stride:][:dst.Dx()], frame.Pix[frame.PixOffset(r.Min.X, r.Min.Y+y):])
+			}
+			m.Gif.Image[i] = cropped
+		}
+		m.Gif.Config.Width, m.Gif.Config.Height = r.Dx(), r.Dy()
+	}
+	if m.TextBoxes == nil {
+		return nil
+	}
+	boxes := make([]TextBox, len(*m.TextBoxes))
+	for i, box := range *m.TextBoxes {
+		// Keep the part of the box that's still visible.
+		half := image.Pt(box.Width/2, box.Height/2)
+		visible := image.Rectangle{box.Center.Sub(half), box.Center.Sub(half).Add(image.Pt(box.Width, box.Height))}.Intersect(r).Sub(r.Min)
+		box.Width, box.Height = visible.Dx(), visible.Dy()
+		box.Center = visible.Min.Add(image.Pt(visible.Dx()/2, visible.Dy()/2))
+		if box.Txt != nil && *box.Txt != "" {
+			if visible.Empty() {
+				return fmt.Errorf("%w: text box %d is outside of the cropped area", ErrInvalidTransform, i)
+			}
+			if err := box.SetText(*box.Txt, box.FontSize, box.FontSize/2); err != nil {
+				return fmt.Errorf("%w: text box %d: %v", ErrInvalidTransform, i, err)
+			}
+		}
+		boxes[i] = box
+	}
+	m.TextBoxes = &boxes
+	return nil
+}
@@ -0,0 +1,158 @@
+package img
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type TransformTestSuite struct {
+	suite.Suite
+}
+
+// numberedGif returns an animation where the color of the top left pixel of every frame
+// tells which frame it is.
+func numberedGif(n int) *gif.GIF {
+	g := &gif.GIF{}
+	for i := 0; i < n; i++ {
+		frame := solidFrame(image.Rect(0, 0, 40, 20), red)
+		frame.Palette = append(frame.Palette, color.RGBA{uint8(i), uint8(i), uint8(i), 0xff})
+		frame.SetColorIndex(0, 0, uint8(len(frame.Palette)-1))
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10*(i+1))
+	}
+	return g
+}
+
+// frameNumbers returns the number of every frame of a gif made by numberedGif.
+func frameNumbers(g *gif.GIF) []int {
+	var numbers []int
+	for _, frame := range g.Image {
+		r, _, _, _ := frame.At(frame.Rect.Min.X, frame.Rect.Min.Y).RGBA()
+		numbers = append(numbers, int(r>>8))
+	}
+	return numbers
+}
+
+func (s *TransformTestSuite) TestFrames() {
+	var testCases = []struct {
+		name      string
+		transform Transform
+		frames    []int
+		delays    []int
+	}{
+		{"nothing", Transform{}, []int{0, 1, 2, 3}, []int{10, 20, 30, 40}},
+		{"trim", Transform{Trim: &FrameRange{1, 3}}, []int{1, 2}, []int{20, 30}},
+		{"trim to the end", Transform{Trim: &FrameRange{2, -1}}, []int{2, 3}, []int{30, 40}},
+		{"trim past the end", Transform{Trim: &FrameRange{2, 5}}, []int{2, 3}, []int{30, 40}},
+		{"reverse", Transform{Reverse: true}, []int{3, 2, 1, 0}, []int{40, 30, 20, 10}},
+		{"boomerang", Transform{Boomerang: true}, []int{0, 1, 2, 3, 2, 1}, []int{10, 20, 30, 40, 30, 20}},
+		{"speed", Transform{Speed: 2}, []int{0, 1, 2, 3}, []int{5, 10, 15, 20}},
+		{"slow down", Transform{Speed: 0.5}, []int{0, 1, 2, 3}, []int{20, 40, 60, 80}},
+		{"all together", Transform{Trim: &FrameRange{0, 2}, Reverse: true, Boomerang: true, Speed: 10}, []int{1, 0}, []int{2, 2}},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			m := Meme{Gif: numberedGif(4)}
+
+			err := m.Transform(tc.transform)
+
+			s.Nil(err)
+			s.Equal(tc.frames, frameNumbers(m.Gif))
+			s.Equal(tc.delays, m.Gif.Delay)
+			if !tc.transform.IsZero() {
+				s.Len(m.Gif.Disposal, len(tc.frames))
+			}
+		})
+	}
+}
+
+func (s *TransformTestSuite) TestInvalid() {
+	var testCases = []struct {
+		name      string
+		transform Transform
+	}{
+		{"trim after the end", Transform{Trim: &FrameRange{4, 6}}},
+		{"empty trim", Transform{Trim: &FrameRange{2, 2}}},
+		{"negative speed", Transform{Speed: -1}},
+		{"huge width", Transform{Width: 100000}},
+		{"crop outside", Transform{Crop: image.Rect(30, 0, 50, 10)}},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			m := Meme{Gif: numberedGif(4)}
+
+			err := m.Transform(tc.transform)
+
+			s.True(errors.Is(err, ErrInvalidTransform), "unexpected error %v", err)
+		})
+	}
+}
+
+func (s *TransformTestSuite) TestCropAndResize() {
+	m := Meme{Gif: numberedGif(2)}
+
+	err := m.Transform(Transform{Crop: image.Rect(0, 0, 20, 10), Width: 10})
+
+	s.Nil(err)
+	for _, frame := range m.Gif.Image {
+		s.Equal(image.Rect(0, 0, 10, 5), frame.Bounds())
+	}
+	s.Equal(10, m.Gif.Config.Width)
+}
+
+func (s *TransformTestSuite) TestTextBoxes() {
+	m, err := MemeFromFile("fixtures/gagarin.png", defaultFont, "top", "bottom")
+	s.Require().Nil(err)
+	top, bottom := (*m.TextBoxes)[0], (*m.TextBoxes)[1]
+
+	// Cut away the left half, and some of the bottom.
+	err = m.Transform(Transform{Crop: image.Rect(150, 0, 307, 340), Width: 314})
+
+	s.Require().Nil(err)
+	s.Equal(image.Rect(0, 0, 314, 680), m.Still.Bounds())
+	moved := (*m.TextBoxes)[0]
+	s.True(moved.Width < top.Width*2, "the box should be cut to the visible area")
+	s.Equal(top.Center.Y*2, moved.Center.Y)
+	s.True(moved.Layout.Fits(&moved))
+	s.Nil(m.Generate())
+
+	m, err = MemeFromFile("fixtures/gagarin.png", defaultFont, "top", "bottom")
+	s.Require().Nil(err)
+	err = m.Transform(Transform{Crop: image.Rect(0, 0, 307, bottom.Center.Y-bottom.Height)})
+	s.True(errors.Is(err, ErrInvalidTransform), "the bottom text can't be drawn anymore")
+}
+
+func (s *TransformTestSuite) TestParse() {
+	r, err := ParseRect("1,2,30,40")
+	s.Nil(err)
+	s.Equal(image.Rect(1, 2, 31, 42), r)
+	for _, bad := range []string{"", "1,2,3", "a,b,c,d", "-1,0,10,10"} {
+		_, err = ParseRect(bad)
+		s.True(errors.Is(err, ErrInvalidTransform), "%s should not be valid", bad)
+	}
+	var testCases = []struct {
+		s     string
+		r     *FrameRange
+		isErr bool
+	}{
+		{"1:3", &FrameRange{1, 3}, false},
+		{":3", &FrameRange{0, 3}, false},
+		{"2:", &FrameRange{2, -1}, false},
+		{"3", nil, true},
+		{"a:b", nil, true},
+	}
+	for _, tc := range testCases {
+		fr, err := ParseFrameRange(tc.s)
+		s.Equal(tc.isErr, err != nil, tc.s)
+		s.Equal(tc.r, fr, tc.s)
+	}
+}
+
+func TestTransformTestSuite(t *testing.T) {
+	suite.Run(t, new(TransformTestSuite))
+}
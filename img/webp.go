@@ -0,0 +1,465 @@
+package img
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"math/bits"
+)
+
+// WebP memes are encoded losslessly (VP8L), see
+// https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification
+// The encoder is deliberately simple: it only uses the subtract green transform
+// and backward references to the pixel on the left or above, which is enough
+// for the large flat areas and the static backgrounds that are common in memes.
+
+// vp8lMaxSize is the largest width or height VP8L can store.
+const vp8lMaxSize = 1 << 14
+
+const (
+	vp8lLiteralCodes  = 256
+	vp8lLengthCodes   = 24
+	vp8lDistanceCodes = 40
+	// vp8lMaxLength is the longest backward reference allowed.
+	vp8lMaxLength = 4096
+	// vp8lMinLength is the shortest backward reference worth using.
+	vp8lMinLength = 3
+	// Distance codes for the pixel above and the one on the left.
+	vp8lDistanceUp   = 1
+	vp8lDistanceLeft = 2
+)
+
+// codeLengthCodeOrder is the order in which the code lengths of the code length code are stored.
+var codeLengthCodeOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// bitWriter writes bits least significant first, as VP8L expects.
+type bitWriter struct {
+	buf []byte
+	acc uint64
+	n   uint
+}
+
+func (b *bitWriter) write(v uint32, n uint) {
+	b.acc |= uint64(v) << b.n
+	b.n += n
+	for b.n >= 8 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc >>= 8
+		b.n -= 8
+	}
+}
+
+// bytes returns the bits written so far, padded to a whole byte.
+func (b *bitWriter) bytes() []byte {
+	if b.n > 0 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc, b.n = 0, 0
+	}
+	return b.buf
+}
+
+// prefixCode is a canonical Huffman code.
+type prefixCode struct {
+	lengths []uint8
+	// codes are bit-reversed, so that they can be written least significant bit first
+	codes []uint16
+	// single is true when there is only one symbol, which is then written with no bits at all
+	single bool
+}
+
+// huffmanLengths returns the code lengths of a Huffman code for the symbol counts,
+// limited to maxLength bits. At least one symbol always gets a length.
+func huffmanLengths(counts []int, maxLength int) []uint8 {
+	lengths := make([]uint8, len(counts))
+	var used []int
+	for s, c := range counts {
+		if c > 0 {
+			used = append(used, s)
+		}
+	}
+	if len(used) < 2 {
+		s := 0
+		if len(used) == 1 {
+			s = used[0]
+		}
+		lengths[s] = 1
+		return lengths
+	}
+	weights := append([]int{}, counts...)
+	n := len(used)
+	for {
+		sortByWeight(used, weights)
+		// Leaves are 0..n-1, in order of weight; internal nodes are created in
+		// order of weight too, so we can always merge the two lightest ones.
+		weight := make([]int, 2*n-1)
+		parent := make([]int, 2*n-1)
+		for i, s := range used {
+			weight[i] = weights[s]
+		}
+		leaf, inner, next := 0, n, n
+		pick := func() int {
+			if leaf < n && (inner == next || weight[leaf] <= weight[inner]) {
+				leaf++
+				return leaf - 1
+			}
+			inner++
+			return inner - 1
+		}
+		for ; next < 2*n-1; next++ {
+			a, b := pick(), pick()
+			weight[next] = weight[a] + weight[b]
+			parent[a], parent[b] = next, next
+		}
+		depth := make([]int, 2*n-1)
+		maxDepth := 0
+		for i := 2*n - 3; i >= 0; i-- {
+			depth[i] = depth[parent[i]] + 1
+			maxDepth = maxInt(maxDepth, depth[i])
+		}
+		if maxDepth <= maxLength {
+			for i, s := range used {
+				lengths[s] = uint8(depth[i])
+			}
+			return lengths
+		}
+		// Flatten the distribution and try again.
+		for _, s := range used {
+			weights[s] = (weights[s] + 1) / 2
+		}
+	}
+}
+
+// sortByWeight sorts the symbols by weight, then by value. It's an insertion
+// sort, which is plenty for alphabets this small.
+func sortByWeight(symbols []int, weights []int) {
+	for i := 1; i < len(symbols); i++ {
+		for j := i; j > 0; j-- {
+			a, b := symbols[j-1], symbols[j]
+			if weights[a] < weights[b] || (weights[a] == weights[b] && a < b) {
+				break
+			}
+			symbols[j-1], symbols[j] = b, a
+		}
+	}
+}
+
+// newPrefixCode builds the canonical code for the given code lengths.
+func newPrefixCode(lengths []uint8) *prefixCode {
+	c := &prefixCode{lengths: lengths, codes: make([]uint16, len(lengths))}
+	var count [16]int
+	nonZero := 0
+	for _, l := range lengths {
+		if l > 0 {
+			count[l]++
+			nonZero++
+		}
+	}
+	if nonZero == 1 {
+		c.single = true
+		return c
+	}
+	var next [16]int
+	code := 0
+	for l := 1; l < 16; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	for s, l := range lengths {
+		if l > 0 {
+			c.codes[s] = uint16(bits.Reverse16(uint16(next[l])) >> (16 - l))
+			next[l]++
+		}
+	}
+	return c
+}
+
+func (c *prefixCode) write(b *bitWriter, symbol int) {
+	if !c.single {
+		b.write(uint32(c.codes[symbol]), uint(c.lengths[symbol]))
+	}
+}
+
+// codeLengthToken is a symbol of the code length code, with its extra bits.
+type codeLengthToken struct {
+	symbol, extra int
+	extraBits     uint
+}
+
+// codeLengthTokens run-length encodes code lengths: 16 repeats the previous
+// length 3-6 times, 17 and 18 are runs of 3-10 and 11-138 zeros.
+func codeLengthTokens(lengths []uint8) []codeLengthToken {
+	var tokens []codeLengthToken
+	for i := 0; i < len(lengths); {
+		l := lengths[i]
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == l {
+			run++
+		}
+		i += run
+		if l != 0 {
+			tokens = append(tokens, codeLengthToken{symbol: int(l)})
+			run--
+			for ; run >= 3; run -= minInt(run, 6) {
+				tokens = append(tokens, codeLengthToken{16, minInt(run, 6) - 3, 2})
+			}
+		} else {
+			for ; run >= 11; run -= minInt(run, 138) {
+				tokens = append(tokens, codeLengthToken{18, minInt(run, 138) - 11, 7})
+			}
+			if run >= 3 {
+				tokens = append(tokens, codeLengthToken{17, run - 3, 3})
+				run = 0
+			}
+		}
+		for ; run > 0; run-- {
+			tokens = append(tokens, codeLengthToken{symbol: int(l)})
+		}
+	}
+	return tokens
+}
+
+// writePrefixCode builds the prefix code for the symbol counts, and writes it
+// in the normal (not simple) form.
+func writePrefixCode(b *bitWriter, counts []int) *prefixCode {
+	code := newPrefixCode(huffmanLengths(counts, 15))
+	tokens := codeLengthTokens(code.lengths)
+	clCounts := make([]int, len(codeLengthCodeOrder))
+	for _, t := range tokens {
+		clCounts[t.symbol]++
+	}
+	clCode := newPrefixCode(huffmanLengths(clCounts, 7))
+	n := len(codeLengthCodeOrder)
+	for n > 4 && clCode.lengths[codeLengthCodeOrder[n-1]] == 0 {
+		n--
+	}
+	b.write(0, 1)
+	b.write(uint32(n-4), 4)
+	for _, s := range codeLengthCodeOrder[:n] {
+		b.write(uint32(clCode.lengths[s]), 3)
+	}
+	// All the code lengths are written.
+	b.write(0, 1)
+	for _, t := range tokens {
+		clCode.write(b, t.symbol)
+		b.write(uint32(t.extra), t.extraBits)
+	}
+	return code
+}
+
+// lz77Prefix splits a backward reference length or distance into
+// a prefix symbol and extra bits.
+func lz77Prefix(v int) (symbol int, extra int, extraBits uint) {
+	if v <= 4 {
+		return v - 1, 0, 0
+	}
+	d := v - 1
+	high := bits.Len(uint(d)) - 1
+	second := (d >> uint(high-1)) & 1
+	extraBits = uint(high - 1)
+	return 2*high + second, d & (1<<extraBits - 1), extraBits
+}
+
+// vp8lToken is either a literal pixel or a backward reference.
+type vp8lToken struct {
+	argb uint32
+	// length is zero for literals
+	length, distance int
+}
+
+// encodeVP8L returns the VP8L bitstream for an image.
+func encodeVP8L(img *image.NRGBA) ([]byte, error) {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	if width > vp8lMaxSize || height > vp8lMaxSize {
+		return nil, fmt.Errorf("%w: webp images can be at most %d pixels wide and tall", ErrUnsupportedFormat, vp8lMaxSize)
+	}
+	// Apply the subtract green transform while converting to ARGB.
+	pix := make([]uint32, 0, width*height)
+	alpha := false
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(img.Rect.Min.X, y):][:4*width]
+		for x := 0; x < len(row); x += 4 {
+			r, g, b, a := row[x], row[x+1], row[x+2], row[x+3]
+			alpha = alpha || a != 0xff
+			pix = append(pix, uint32(a)<<24|uint32(r-g)<<16|uint32(g)<<8|uint32(b-g))
+		}
+	}
+
+	// Find the backward references, and count the symbols.
+	var tokens []vp8lToken
+	green := make([]int, vp8lLiteralCodes+vp8lLengthCodes)
+	red := make([]int, vp8lLiteralCodes)
+	blue := make([]int, vp8lLiteralCodes)
+	alphas := make([]int, vp8lLiteralCodes)
+	distances := make([]int, vp8lDistanceCodes)
+	for p := 0; p < len(pix); {
+		left, up := matchLength(pix, p, 1), 0
+		if p >= width {
+			up = matchLength(pix, p, width)
+		}
+		if maxInt(left, up) < vp8lMinLength {
+			argb := pix[p]
+			tokens = append(tokens, vp8lToken{argb: argb})
+			green[(argb>>8)&0xff]++
+			red[(argb>>16)&0xff]++
+			blue[argb&0xff]++
+			alphas[argb>>24]++
+			p++
+			continue
+		}
+		t := vp8lToken{length: left, distance: vp8lDistanceLeft}
+		if up > left {
+			t = vp8lToken{length: up, distance: vp8lDistanceUp}
+		}
+		tokens = append(tokens, t)
+		symbol, _, _ := lz77Prefix(t.length)
+		green[vp8lLiteralCodes+symbol]++
+		symbol, _, _ = lz77Prefix(t.distance)
+		distances[symbol]++
+		p += t.length
+	}
+
+	b := &bitWriter{}
+	b.write(0x2f, 8)
+	b.write(uint32(width-1), 14)
+	b.write(uint32(height-1), 14)
+	if alpha {
+		b.write(1, 1)
+	} else {
+		b.write(0, 1)
+	}
+	b.write(0, 3)
+	// One transform, subtract green.
+	b.write(1, 1)
+	b.write(2, 2)
+	b.write(0, 1)
+	// No color cache, and a single group of prefix codes.
+	b.write(0, 1)
+	b.write(0, 1)
+	codes := []*prefixCode{
+		writePrefixCode(b, green),
+		writePrefixCode(b, red),
+		writePrefixCode(b, blue),
+		writePrefixCode(b, alphas),
+		writePrefixCode(b, distances),
+	}
+	for _, t := range tokens {
+		if t.length == 0 {
+			codes[0].write(b, int((t.argb>>8)&0xff))
+			codes[1].write(b, int((t.argb>>16)&0xff))
+			codes[2].write(b, int(t.argb&0xff))
+			codes[3].write(b, int(t.argb>>24))
+			continue
+		}
+		symbol, extra, extraBits := lz77Prefix(t.length)
+		codes[0].write(b, vp8lLiteralCodes+symbol)
+		b.write(uint32(extra), extraBits)
+		symbol, extra, extraBits = lz77Prefix(t.distance)
+		codes[4].write(b, symbol)
+		b.write(uint32(extra), extraBits)
+	}
+	return b.bytes(), nil
+}
+
+// matchLength returns how many pixels starting at p are equal to the ones dist pixels before.
+func matchLength(pix []uint32, p, dist int) int {
+	if p < dist {
+		return 0
+	}
+	n := 0
+	for p+n < len(pix) && n < vp8lMaxLength && pix[p+n] == pix[p+n-dist] {
+		n++
+	}
+	return n
+}
+
+// riffChunk appends a RIFF chunk to buf, padded to an even size.
+func riffChunk(buf *bytes.Buffer, name string, data []byte) {
+	var header [8]byte
+	copy(header[:], name)
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(data)))
+	buf.Write(header[:])
+	buf.Write(data)
+	if len(data)%2 == 1 {
+		buf.WriteByte(0)
+	}
+}
+
+// putUint24 writes a 24 bits little endian integer.
+func putUint24(b []byte, v int) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+func encodeWebP(w io.Writer, m *Meme) error {
+	bounds, frames := m.animation(true)
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	if len(frames) == 1 {
+		data, err := encodeVP8L(frames[0].img)
+		if err != nil {
+			return err
+		}
+		riffChunk(&body, "VP8L", data)
+	} else {
+		var anmf bytes.Buffer
+		alpha := false
+		for _, frame := range frames {
+			data, err := encodeVP8L(frame.img)
+			if err != nil {
+				return err
+			}
+			// The alpha hint is the 29th bit of the VP8L header.
+			alpha = alpha || data[4]&0x10 != 0
+			r := frame.img.Rect.Sub(bounds.Min)
+			header := make([]byte, 16)
+			putUint24(header[0:], r.Min.X/2)
+			putUint24(header[3:], r.Min.Y/2)
+			putUint24(header[6:], r.Dx()-1)
+			putUint24(header[9:], r.Dy()-1)
+			putUint24(header[12:], frame.delay*10)
+			// Don't blend the frame with the previous one, and don't dispose of it.
+			header[15] = 0x02
+			var chunk bytes.Buffer
+			chunk.Write(header)
+			riffChunk(&chunk, "VP8L", data)
+			riffChunk(&anmf, "ANMF", chunk.Bytes())
+		}
+		vp8x := make([]byte, 10)
+		vp8x[0] = 0x02
+		if alpha {
+			vp8x[0] |= 0x10
+		}
+		putUint24(vp8x[4:], bounds.Dx()-1)
+		putUint24(vp8x[7:], bounds.Dy()-1)
+		riffChunk(&body, "VP8X", vp8x)
+		anim := make([]byte, 6)
+		binary.LittleEndian.PutUint16(anim[4:], uint16(m.loops()))
+		riffChunk(&body, "ANIM", anim)
+		body.Write(anmf.Bytes())
+	}
+	var header [8]byte
+	copy(header[:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(body.Len()))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := body.WriteTo(w)
+	return err
+}
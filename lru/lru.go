@@ -0,0 +1,112 @@
+// Package lru implements an in-memory cache bounded by the total size of its
+// values, which evicts the least recently used ones first.
+package lru
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Cache is a least recently used cache, safe for concurrent use. The size of
+// every value is given by the caller, in whatever unit MaxSize is.
+type Cache struct {
+	// MaxSize is the maximum total size of the values.
+	MaxSize int64
+	// OnLookup is called after every Get, with whether the key was found.
+	OnLookup func(hit bool)
+
+	mu    sync.Mutex
+	order *list.List
+	items map[string]*list.Element
+	size  int64
+}
+
+type entry struct {
+	key   string
+	value interface{}
+	size  int64
+}
+
+// New returns an empty cache holding at most maxSize worth of values.
+func New(maxSize int64) *Cache {
+	return &Cache{MaxSize: maxSize, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+// Get returns the value stored under key, and marks it as recently used.
+func (c *Cache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	el, ok := c.items[key]
+	var value interface{}
+	if ok {
+		c.order.MoveToFront(el)
+		value = el.Value.(*entry).value
+	}
+	c.mu.Unlock()
+	if c.OnLookup != nil {
+		c.OnLookup(ok)
+	}
+	return value, ok
+}
+
+// Add stores value under key, then evicts the least recently used values until
+// the cache is within MaxSize. Values larger than MaxSize are not stored.
+func (c *Cache) Add(key string, value interface{}, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	if size > c.MaxSize {
+		return
+	}
+	c.items[key] = c.order.PushFront(&entry{key: key, value: value, size: size})
+	c.size += size
+	for c.size > c.MaxSize {
+		c.remove(c.order.Back())
+	}
+}
+
+// Remove deletes the value stored under key, if any.
+func (c *Cache) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+}
+
+func (c *Cache) remove(el *list.Element) {
+	e := c.order.Remove(el).(*entry)
+	delete(c.items, e.key)
+	c.size -= e.size
+}
+
+// Len returns the number of values in the cache.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// Size returns the total size of the values in the cache.
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
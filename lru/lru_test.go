@@ -0,0 +1,101 @@
+package lru
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type LRUTestSuite struct {
+	suite.Suite
+	Sut *Cache
+}
+
+func (s *LRUTestSuite) SetupTest() {
+	s.Sut = New(10)
+}
+
+func (s *LRUTestSuite) TestGetAdd() {
+	_, ok := s.Sut.Get("a")
+	s.False(ok)
+
+	s.Sut.Add("a", "first", 4)
+	value, ok := s.Sut.Get("a")
+	s.True(ok)
+	s.Equal("first", value)
+
+	// Adding a key again replaces its value.
+	s.Sut.Add("a", "second", 6)
+	value, _ = s.Sut.Get("a")
+	s.Equal("second", value)
+	s.Equal(1, s.Sut.Len())
+	s.Equal(int64(6), s.Sut.Size())
+
+	s.Sut.Remove("a")
+	_, ok = s.Sut.Get("a")
+	s.False(ok)
+	s.Equal(int64(0), s.Sut.Size())
+}
+
+func (s *LRUTestSuite) TestEviction() {
+	s.Sut.Add("a", 1, 4)
+	s.Sut.Add("b", 2, 4)
+	// a is now the most recently used.
+	s.Sut.Get("a")
+	s.Sut.Add("c", 3, 4)
+
+	_, ok := s.Sut.Get("b")
+	s.False(ok, "the least recently used value should be evicted")
+	for _, key := range []string{"a", "c"} {
+		_, ok := s.Sut.Get(key)
+		s.True(ok, "%s should still be cached", key)
+	}
+	s.Equal(int64(8), s.Sut.Size())
+
+	// Values larger than the cache are not stored, and don't evict anything.
+	s.Sut.Add("huge", 4, 11)
+	_, ok = s.Sut.Get("huge")
+	s.False(ok)
+	s.Equal(2, s.Sut.Len())
+}
+
+func (s *LRUTestSuite) TestOnLookup() {
+	var hits, misses int
+	s.Sut.OnLookup = func(hit bool) {
+		if hit {
+			hits++
+		} else {
+			misses++
+		}
+	}
+	s.Sut.Add("a", 1, 1)
+	s.Sut.Get("a")
+	s.Sut.Get("a")
+	s.Sut.Get("b")
+	s.Equal(2, hits)
+	s.Equal(1, misses)
+}
+
+func (s *LRUTestSuite) TestConcurrent() {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprintf("%d-%d", i, j%5)
+				s.Sut.Add(key, j, 1)
+				s.Sut.Get(key)
+			}
+		}(i)
+	}
+	wg.Wait()
+	s.Equal(10, s.Sut.Len())
+	s.Equal(int64(10), s.Sut.Size())
+}
+
+func TestLRUTestSuite(t *testing.T) {
+	suite.Run(t, new(LRUTestSuite))
+}
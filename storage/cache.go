@@ -0,0 +1,182 @@
+package storage
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Cache is a storage whose files can be regenerated, so that the least recently
+// used ones can be removed to keep it within a maximum size and age. Accesses
+// are tracked in memory: files nobody used since the process started are
+// considered last used when they were written. This only works if all the
+// accesses to the storage go through a single Cache.
+type Cache struct {
+	Storage
+	// MaxSize is the maximum total size of the files, in bytes. 0 means no limit.
+	MaxSize int64
+	// MaxAge is how long files are kept after they were last used. 0 means forever.
+	MaxAge time.Duration
+	// OnClean is called with the report of every cleanup.
+	OnClean func(CleanReport)
+
+	mu sync.Mutex
+	// used is the time each file was last used.
+	used map[string]time.Time
+	// now returns the current time.
+	now func() time.Time
+}
+
+// CleanReport describes the content of a cache after a cleanup.
+type CleanReport struct {
+	Files        int
+	Bytes        int64
+	Evicted      int
+	EvictedBytes int64
+}
+
+// NewCache returns a cache of the files in s, with the given limits.
+func NewCache(s Storage, maxSize int64, maxAge time.Duration) *Cache {
+	return &Cache{Storage: s, MaxSize: maxSize, MaxAge: maxAge, used: make(map[string]time.Time), now: time.Now}
+}
+
+// Touch records that a file was used. Files the cache doesn't know about yet
+// are ignored, so that requests for missing files don't fill the memory.
+func (c *Cache) Touch(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.used[name]; ok {
+		c.used[name] = c.now()
+	}
+}
+
+// use records that a file known to exist was used.
+func (c *Cache) use(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.used[name] = c.now()
+}
+
+// Get opens the file, and marks it as used.
+func (c *Cache) Get(name string) (io.ReadCloser, error) {
+	r, err := c.Storage.Get(name)
+	if err == nil {
+		c.use(name)
+	}
+	return r, err
+}
+
+// Put saves the file, and marks it as used.
+func (c *Cache) Put(name string, data []byte) error {
+	err := c.Storage.Put(name, data)
+	if err == nil {
+		c.use(name)
+	}
+	return err
+}
+
+// Exists returns true if the file exists, and marks it as used: it's
+// called before serving a file.
+func (c *Cache) Exists(name string) (bool, error) {
+	ok, err := c.Storage.Exists(name)
+	if ok {
+		c.use(name)
+	}
+	return ok, err
+}
+
+// Delete removes the file.
+func (c *Cache) Delete(name string) error {
+	err := c.Storage.Delete(name)
+	if err == nil {
+		c.mu.Lock()
+		delete(c.used, name)
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// Clean removes the files that weren't used for longer than MaxAge, then the
+// least recently used ones until the total size is within MaxSize.
+func (c *Cache) Clean() (CleanReport, error) {
+	var report CleanReport
+	files, err := c.Storage.List("")
+	if err != nil {
+		return report, err
+	}
+	lastUsed := c.lastUsed(files)
+	// Least recently used first.
+	sort.SliceStable(files, func(i, j int) bool {
+		return lastUsed[files[i].Name].Before(lastUsed[files[j].Name])
+	})
+	for _, file := range files {
+		report.Bytes += file.Size
+	}
+	report.Files = len(files)
+	now := c.now()
+	for _, file := range files {
+		expired := c.MaxAge > 0 && now.Sub(lastUsed[file.Name]) > c.MaxAge
+		tooLarge := c.MaxSize > 0 && report.Bytes > c.MaxSize
+		if !expired && !tooLarge {
+			break
+		}
+		if err := c.Delete(file.Name); err != nil {
+			return c.report(report), err
+		}
+		report.Files--
+		report.Bytes -= file.Size
+		report.Evicted++
+		report.EvictedBytes += file.Size
+	}
+	return c.report(report), nil
+}
+
+// report passes the report to OnClean, if set, and returns it.
+func (c *Cache) report(report CleanReport) CleanReport {
+	if c.OnClean != nil {
+		c.OnClean(report)
+	}
+	return report
+}
+
+// lastUsed returns when each of the files was last used. The files the cache
+// doesn't know about start being tracked, and the ones that don't exist anymore
+// are forgotten.
+func (c *Cache) lastUsed(files []Info) map[string]time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lastUsed := make(map[string]time.Time, len(files))
+	for _, file := range files {
+		t, ok := c.used[file.Name]
+		if !ok || file.ModTime.After(t) {
+			t = file.ModTime
+		}
+		lastUsed[file.Name] = t
+	}
+	for name := range c.used {
+		if _, ok := lastUsed[name]; !ok {
+			delete(c.used, name)
+		}
+	}
+	for name, t := range lastUsed {
+		c.used[name] = t
+	}
+	return lastUsed
+}
@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type CacheTestSuite struct {
+	suite.Suite
+	TempDir string
+	Local   *Local
+	Sut     *Cache
+	Now     time.Time
+}
+
+func (s *CacheTestSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "memeoid-cache")
+	if err != nil {
+		panic(err)
+	}
+	s.TempDir = dir
+	s.Local = NewLocal(dir, "/meme/")
+	s.Sut = NewCache(s.Local, 0, 0)
+	s.Now = time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	s.Sut.now = func() time.Time { return s.Now }
+}
+
+func (s *CacheTestSuite) TearDownTest() {
+	os.RemoveAll(s.TempDir)
+}
+
+// put writes a file of the given size, last modified at the given time.
+func (s *CacheTestSuite) put(name string, size int, modTime time.Time) {
+	s.Require().Nil(s.Local.Put(name, make([]byte, size)))
+	s.Require().Nil(os.Chtimes(s.Local.Path(name), modTime, modTime))
+}
+
+func (s *CacheTestSuite) names() []string {
+	files, err := s.Local.List("")
+	s.Require().Nil(err)
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	return names
+}
+
+func (s *CacheTestSuite) TestNoLimits() {
+	s.put("a.gif", 10, s.Now.Add(-1000*time.Hour))
+
+	report, err := s.Sut.Clean()
+
+	s.Nil(err)
+	s.Equal(CleanReport{Files: 1, Bytes: 10}, report)
+	s.Equal([]string{"a.gif"}, s.names())
+}
+
+func (s *CacheTestSuite) TestMaxAge() {
+	s.Sut.MaxAge = 24 * time.Hour
+	s.put("old.gif", 10, s.Now.Add(-48*time.Hour))
+	s.put("used.gif", 10, s.Now.Add(-48*time.Hour))
+	s.put("new.gif", 10, s.Now.Add(-time.Hour))
+	// Files are tracked once they're used, or after a cleanup.
+	ok, err := s.Sut.Exists("used.gif")
+	s.Require().True(ok)
+	s.Require().Nil(err)
+
+	report, err := s.Sut.Clean()
+
+	s.Nil(err)
+	s.Equal(CleanReport{Files: 2, Bytes: 20, Evicted: 1, EvictedBytes: 10}, report)
+	s.Equal([]string{"new.gif", "used.gif"}, s.names())
+
+	// Accesses through Touch are tracked for known files.
+	s.Now = s.Now.Add(20 * time.Hour)
+	s.Sut.Touch("new.gif")
+	s.Now = s.Now.Add(20 * time.Hour)
+	report, err = s.Sut.Clean()
+	s.Nil(err)
+	s.Equal(1, report.Evicted)
+	s.Equal([]string{"new.gif"}, s.names())
+}
+
+func (s *CacheTestSuite) TestMaxSize() {
+	s.Sut.MaxSize = 25
+	s.put("a.gif", 10, s.Now.Add(-3*time.Hour))
+	s.put("b.gif", 10, s.Now.Add(-2*time.Hour))
+	s.put("c.gif", 10, s.Now.Add(-time.Hour))
+	// a.gif is the oldest, but was used last.
+	r, err := s.Sut.Get("a.gif")
+	s.Require().Nil(err)
+	r.Close()
+	var reports []CleanReport
+	s.Sut.OnClean = func(report CleanReport) { reports = append(reports, report) }
+
+	report, err := s.Sut.Clean()
+
+	s.Nil(err)
+	s.Equal(CleanReport{Files: 2, Bytes: 20, Evicted: 1, EvictedBytes: 10}, report)
+	s.Equal([]CleanReport{report}, reports)
+	s.Equal([]string{"a.gif", "c.gif"}, s.names())
+}
+
+func (s *CacheTestSuite) TestForget() {
+	s.put("a.gif", 10, s.Now)
+	_, err := s.Sut.Clean()
+	s.Require().Nil(err)
+	s.Require().Nil(s.Local.Delete("a.gif"))
+
+	_, err = s.Sut.Clean()
+
+	s.Nil(err)
+	s.Empty(s.Sut.used, "files removed from the storage are forgotten")
+	// Touching a file that doesn't exist doesn't track it.
+	s.Sut.Touch("a.gif")
+	s.Empty(s.Sut.used)
+}
+
+func TestCacheTestSuite(t *testing.T) {
+	suite.Run(t, new(CacheTestSuite))
+}
+
+func TestCacheStorage(t *testing.T) {
+	suite.Run(t, &StorageTestSuite{New: func() (Storage, func()) {
+		dir, err := ioutil.TempDir("", "memeoid-cache")
+		if err != nil {
+			panic(err)
+		}
+		return NewCache(NewLocal(dir, "/meme/"), 0, 0), func() { os.RemoveAll(dir) }
+	}})
+}
@@ -0,0 +1,148 @@
+package storage
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Local stores files in a directory of the local filesystem.
+type Local struct {
+	// Dir is the directory files are stored in. It's created when needed.
+	Dir string
+	// BaseURL is the url the directory is served at, e.g. "/meme/".
+	BaseURL string
+}
+
+// NewLocal returns a storage for the files in dir, served at baseURL.
+func NewLocal(dir string, baseURL string) *Local {
+	return &Local{Dir: dir, BaseURL: baseURL}
+}
+
+// Path returns the path of a file on the filesystem.
+func (l *Local) Path(name string) string {
+	return filepath.Join(l.Dir, name)
+}
+
+// notFound converts the errors about missing files to ErrNotFound.
+func notFound(name string, err error) error {
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return err
+}
+
+// Get opens the file with the given name.
+func (l *Local) Get(name string) (io.ReadCloser, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(l.Path(name))
+	if err != nil {
+		return nil, notFound(name, err)
+	}
+	return f, nil
+}
+
+// Put writes the file to a temporary file, then renames it.
+func (l *Local) Put(name string, data []byte) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	// Temporary files are hidden, so that List skips them.
+	tmp, err := ioutil.TempFile(l.Dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), l.Path(name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Exists returns true if the file exists.
+func (l *Local) Exists(name string) (bool, error) {
+	return exists(l, name)
+}
+
+// Stat returns information about the file.
+func (l *Local) Stat(name string) (Info, error) {
+	if err := checkName(name); err != nil {
+		return Info{}, err
+	}
+	fi, err := os.Stat(l.Path(name))
+	if err != nil {
+		return Info{}, notFound(name, err)
+	}
+	if fi.IsDir() {
+		return Info{}, fmt.Errorf("%w: %s is a directory", ErrNotFound, name)
+	}
+	return Info{Name: name, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// List returns the files in the directory whose name starts with prefix.
+// Hidden files and subdirectories are skipped.
+func (l *Local) List(prefix string) ([]Info, error) {
+	files, err := ioutil.ReadDir(l.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var infos []Info
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || strings.HasPrefix(name, ".") || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		infos = append(infos, Info{Name: name, Size: fi.Size(), ModTime: fi.ModTime()})
+	}
+	return infos, nil
+}
+
+// Delete removes the file.
+func (l *Local) Delete(name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if err := os.Remove(l.Path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// URL returns the url of the file under BaseURL.
+func (l *Local) URL(name string) string {
+	return l.BaseURL + url.PathEscape(name)
+}
@@ -0,0 +1,309 @@
+package storage
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3 stores files in a bucket of an S3-compatible object store, like AWS S3
+// or MinIO. Requests use path-style urls and version 4 signatures.
+type S3 struct {
+	// Endpoint is the url of the service, e.g. "https://s3.eu-west-1.amazonaws.com".
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is added to the names of all the files, e.g. "memes/".
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// PublicURL is the url clients download the files from, prefix included,
+	// e.g. the url of a CDN. Defaults to the url of the prefix in the bucket,
+	// which must then be publicly readable.
+	PublicURL string
+	// Client makes the requests; http.DefaultClient is used if nil.
+	Client *http.Client
+}
+
+// s3Time is the format of timestamps in signatures.
+const s3Time = "20060102T150405Z"
+
+// s3ListResult is the response to a ListObjectsV2 request.
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// uriEncode escapes s as required by signatures: everything but unreserved
+// characters is percent-encoded, slashes included unless keepSlash is true.
+func uriEncode(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes the query string, sorted by key, as required by signatures.
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for key, values := range query {
+		for _, v := range values {
+			params = append(params, uriEncode(key, false)+"="+uriEncode(v, false))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign adds an AWS version 4 signature to the request, made at time t. All the
+// headers already set are signed, together with the host.
+func (s *S3) sign(req *http.Request, payloadHash string, t time.Time) {
+	stamp := t.UTC().Format(s3Time)
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, true),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := stamp[:8] + "/" + s.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{stamp[:8], s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+// objectURL returns the url of an object in the bucket.
+func (s *S3) objectURL(key string) string {
+	u := strings.TrimSuffix(s.Endpoint, "/") + "/" + uriEncode(s.Bucket, false)
+	if key != "" {
+		u += "/" + uriEncode(key, true)
+	}
+	return u
+}
+
+// do sends a signed request about the object with the given key.
+func (s *S3) do(method string, key string, query url.Values, body []byte, contentType string) (*http.Response, error) {
+	u := s.objectURL(key)
+	if len(query) > 0 {
+		u += "?" + canonicalQuery(query)
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	hash := sha256.Sum256(body)
+	s.sign(req, hex.EncodeToString(hash[:]), time.Now())
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// checkResponse returns an error unless the response has one of the expected statuses.
+// The body of failed responses is closed.
+func checkResponse(resp *http.Response, name string, expected ...int) error {
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return nil
+		}
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return fmt.Errorf("s3: %s %s: %s", resp.Request.Method, name, resp.Status)
+}
+
+// Get downloads the file.
+func (s *S3) Get(name string) (io.ReadCloser, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	resp, err := s.do(http.MethodGet, s.Prefix+name, nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp, name, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Put uploads the file. Objects are replaced atomically by the store.
+func (s *S3) Put(name string, data []byte) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	resp, err := s.do(http.MethodPut, s.Prefix+name, nil, data, contentType)
+	if err != nil {
+		return err
+	}
+	if err := checkResponse(resp, name, http.StatusOK); err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Exists returns true if the file exists.
+func (s *S3) Exists(name string) (bool, error) {
+	return exists(s, name)
+}
+
+// Stat returns information about the file.
+func (s *S3) Stat(name string) (Info, error) {
+	if err := checkName(name); err != nil {
+		return Info{}, err
+	}
+	resp, err := s.do(http.MethodHead, s.Prefix+name, nil, nil, "")
+	if err != nil {
+		return Info{}, err
+	}
+	if err := checkResponse(resp, name, http.StatusOK); err != nil {
+		return Info{}, err
+	}
+	resp.Body.Close()
+	modTime, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return Info{}, fmt.Errorf("s3: bad modification time for %s: %v", name, err)
+	}
+	return Info{Name: name, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+// List returns the files whose name starts with prefix. Objects in "subdirectories"
+// of the storage prefix are skipped.
+func (s *S3) List(prefix string) ([]Info, error) {
+	var infos []Info
+	query := url.Values{"list-type": {"2"}, "prefix": {s.Prefix + prefix}}
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil, "")
+		if err != nil {
+			return nil, err
+		}
+		if err := checkResponse(resp, s.Bucket, http.StatusOK); err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3: bad listing of %s: %v", s.Bucket, err)
+		}
+		for _, obj := range result.Contents {
+			name := strings.TrimPrefix(obj.Key, s.Prefix)
+			if strings.Contains(name, "/") {
+				continue
+			}
+			infos = append(infos, Info{Name: name, Size: obj.Size, ModTime: obj.LastModified})
+		}
+		if !result.IsTruncated {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// Delete removes the file.
+func (s *S3) Delete(name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodDelete, s.Prefix+name, nil, nil, "")
+	if err != nil {
+		return err
+	}
+	if err := checkResponse(resp, name, http.StatusNoContent, http.StatusOK, http.StatusNotFound); err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// URL returns the url of the file under PublicURL, or in the bucket.
+func (s *S3) URL(name string) string {
+	if s.PublicURL != "" {
+		return strings.TrimSuffix(s.PublicURL, "/") + "/" + uriEncode(name, false)
+	}
+	return s.objectURL(s.Prefix + name)
+}
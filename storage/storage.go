@@ -0,0 +1,76 @@
+// Package storage abstracts where memeoid keeps its files: the base images,
+// and the memes and thumbnails it generates.
+package storage
+
+/*
+Copyright © 2020 Giuseppe Lavagetto
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Storage is a flat collection of files: names can't contain slashes.
+type Storage interface {
+	// Get opens the file with the given name, or returns ErrNotFound.
+	Get(name string) (io.ReadCloser, error)
+	// Put saves data as the file with the given name, replacing it if it exists.
+	// Readers see either the old content or the new one, never a partial file.
+	Put(name string, data []byte) error
+	// Exists returns true if the file exists.
+	Exists(name string) (bool, error)
+	// Stat returns information about the file, or ErrNotFound.
+	Stat(name string) (Info, error)
+	// List returns the files whose name starts with prefix, sorted by name.
+	List(prefix string) ([]Info, error)
+	// Delete removes the file. Removing a file that doesn't exist is not an error.
+	Delete(name string) error
+	// URL returns the url clients can download the file from.
+	URL(name string) string
+}
+
+// Info describes a file in a storage.
+type Info struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// ErrNotFound is returned when a file doesn't exist.
+var ErrNotFound = errors.New("file not found")
+
+// ErrInvalidName is returned for names that could point outside of the storage.
+var ErrInvalidName = errors.New("invalid file name")
+
+// checkName makes sure the name is a plain file name.
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("%w: '%s'", ErrInvalidName, name)
+	}
+	return nil
+}
+
+// exists implements Exists on top of Stat.
+func exists(s Storage, name string) (bool, error) {
+	_, err := s.Stat(name)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// StorageTestSuite checks the behaviour every storage must have.
+type StorageTestSuite struct {
+	suite.Suite
+	// New returns an empty storage, and a function to clean it up.
+	New     func() (Storage, func())
+	Sut     Storage
+	cleanup func()
+}
+
+func (s *StorageTestSuite) SetupTest() {
+	s.Sut, s.cleanup = s.New()
+}
+
+func (s *StorageTestSuite) TearDownTest() {
+	s.cleanup()
+}
+
+func (s *StorageTestSuite) TestPutGet() {
+	s.Require().Nil(s.Sut.Put("a.gif", []byte("gif")))
+
+	r, err := s.Sut.Get("a.gif")
+	s.Require().Nil(err)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	s.Nil(err)
+	s.Equal("gif", string(data))
+
+	// Files are replaced.
+	s.Require().Nil(s.Sut.Put("a.gif", []byte("new gif")))
+	info, err := s.Sut.Stat("a.gif")
+	s.Nil(err)
+	s.Equal(Info{Name: "a.gif", Size: 7, ModTime: info.ModTime}, info)
+	s.False(info.ModTime.IsZero())
+}
+
+func (s *StorageTestSuite) TestNotFound() {
+	_, err := s.Sut.Get("missing.gif")
+	s.True(errors.Is(err, ErrNotFound), "expected ErrNotFound, got %v", err)
+	_, err = s.Sut.Stat("missing.gif")
+	s.True(errors.Is(err, ErrNotFound), "expected ErrNotFound, got %v", err)
+	ok, err := s.Sut.Exists("missing.gif")
+	s.Nil(err)
+	s.False(ok)
+	s.Nil(s.Sut.Delete("missing.gif"), "deleting a missing file is not an error")
+}
+
+func (s *StorageTestSuite) TestInvalidNames() {
+	for _, name := range []string{"", "..", "../etc/passwd", "a/b.gif"} {
+		_, err := s.Sut.Get(name)
+		s.True(errors.Is(err, ErrInvalidName), "expected ErrInvalidName for '%s', got %v", name, err)
+		s.True(errors.Is(s.Sut.Put(name, nil), ErrInvalidName))
+	}
+}
+
+func (s *StorageTestSuite) TestListDelete() {
+	for _, name := range []string{"b.gif", "thumb-a.jpg", "a.gif", "thumb-b.jpg"} {
+		s.Require().Nil(s.Sut.Put(name, []byte(name)))
+	}
+
+	all, err := s.Sut.List("")
+	s.Nil(err)
+	var names []string
+	for _, info := range all {
+		names = append(names, info.Name)
+	}
+	s.Equal([]string{"a.gif", "b.gif", "thumb-a.jpg", "thumb-b.jpg"}, names)
+
+	thumbs, err := s.Sut.List("thumb-")
+	s.Nil(err)
+	s.Len(thumbs, 2)
+	s.Equal(int64(len("thumb-a.jpg")), thumbs[0].Size)
+
+	s.Nil(s.Sut.Delete("thumb-a.jpg"))
+	ok, err := s.Sut.Exists("thumb-a.jpg")
+	s.Nil(err)
+	s.False(ok)
+	thumbs, err = s.Sut.List("thumb-")
+	s.Nil(err)
+	s.Len(thumbs, 1)
+}
+
+func TestLocal(t *testing.T) {
+	suite.Run(t, &StorageTestSuite{New: func() (Storage, func()) {
+		dir, err := ioutil.TempDir("", "memeoid-storage")
+		if err != nil {
+			panic(err)
+		}
+		// The directory is created on the first write.
+		local := NewLocal(dir+"/files", "/files/")
+		return local, func() { os.RemoveAll(dir) }
+	}})
+}
+
+func TestLocalURL(t *testing.T) {
+	local := NewLocal("/tmp", "/meme/")
+	if u := local.URL("my meme.gif"); u != "/meme/my%20meme.gif" {
+		t.Errorf("unexpected url %s", u)
+	}
+}